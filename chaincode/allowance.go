@@ -24,14 +24,20 @@ import (
 )
 
 func (t *TokenChaincode) setAllowance(stub shim.ChaincodeStubInterface, from, spender string, value uint64) error {
-	key, _ := stub.CreateCompositeKey(IndexAllowance, []string{from, spender})
+	key, err := stub.CreateCompositeKey(IndexAllowance, []string{from, spender})
+	if err != nil {
+		return err
+	}
 	data := make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, value)
 	return stub.PutState(key, data)
 }
 
 func (t *TokenChaincode) allowance(stub shim.ChaincodeStubInterface, from, spender string) (uint64, error) {
-	key, _ := stub.CreateCompositeKey(IndexAllowance, []string{from, spender})
+	key, err := stub.CreateCompositeKey(IndexAllowance, []string{from, spender})
+	if err != nil {
+		return 0, err
+	}
 	data, err := stub.GetState(key)
 	if err != nil {
 		return 0, err
@@ -46,6 +52,9 @@ func (t *TokenChaincode) allowance(stub shim.ChaincodeStubInterface, from, spend
 }
 
 func (t *TokenChaincode) allowancesAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
 	approveRq := Balance{}
 	if err := json.Unmarshal([]byte(args[0]), &approveRq); err != nil {
 		return shim.Error(err.Error())
@@ -66,6 +75,9 @@ func (t *TokenChaincode) allowancesAsJson(stub shim.ChaincodeStubInterface, args
 		}
 
 		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 2 {
+			return shim.Error("Invalid allowance key: " + kv.Key)
+		}
 		spender := parts[1]
 		valueBytes := kv.Value
 
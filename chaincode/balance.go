@@ -47,14 +47,47 @@ func (t *TokenChaincode) balanceAsJson(stub shim.ChaincodeStubInterface, args []
 }
 
 func (t *TokenChaincode) setBalance(stub shim.ChaincodeStubInterface, cn string, balance uint64) error {
-	key, _ := stub.CreateCompositeKey(IndexBalance, []string{cn})
-	data := make([]byte, 8)
-	binary.LittleEndian.PutUint64(data, balance)
-	return stub.PutState(key, data)
+	return t.setBalances(stub, Balance{User: cn, Value: balance})
+}
+
+// sets the balances changed by a transaction, from their committed values,
+// so it is called once per transaction with each account at most once.
+// The holder count changes by the net number of holders joining or leaving
+func (t *TokenChaincode) setBalances(stub shim.ChaincodeStubInterface, balances ...Balance) error {
+	var joined, left uint64
+	for _, balance := range balances {
+		key, err := stub.CreateCompositeKey(IndexBalance, []string{balance.User})
+		if err != nil {
+			return err
+		}
+		current, err := t.balance(stub, balance.User)
+		if err != nil {
+			return err
+		}
+		switch {
+		case current == 0 && balance.Value > 0:
+			joined++
+		case current > 0 && balance.Value == 0:
+			left++
+		}
+		err = updateSnapshot(stub, IndexSnapshotBalance, []string{balance.User}, current)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, balance.Value)
+		if err := stub.PutState(key, data); err != nil {
+			return err
+		}
+	}
+	return updateHolderCount(stub, joined, left)
 }
 
 func (t *TokenChaincode) balance(stub shim.ChaincodeStubInterface, cn string) (uint64, error) {
-	key, _ := stub.CreateCompositeKey(IndexBalance, []string{cn})
+	key, err := stub.CreateCompositeKey(IndexBalance, []string{cn})
+	if err != nil {
+		return 0, err
+	}
 	data, err := stub.GetState(key)
 	if err != nil {
 		return 0, err
@@ -0,0 +1,141 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/hyperledger/fabric/common/util"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+)
+
+func transferProposal(txID string, from *testca.Identity, transferData string) mock.Proposal {
+	return mock.Proposal{
+		TxID:  txID,
+		MspID: from.MspID,
+		Cert:  from.CertPEM,
+		Args:  util.ToChaincodeArgs("transfer", transferData),
+	}
+}
+
+func expectValidation(t *testing.T, results []*mock.TxResult, codes ...pb.TxValidationCode) {
+	for i, result := range results {
+		if result.ValidationCode != codes[i] {
+			t.Errorf("Expected tx %s to be %s, got %s (%s)", result.TxID, codes[i], result.ValidationCode, result.Response.Message)
+		}
+	}
+}
+
+// version at which the key was read, if it was
+func readVersion(rwset *mock.RWSet, key string) (uint64, bool) {
+	for _, read := range rwset.Reads {
+		if read.Collection == "" && read.Key == key {
+			return read.Version, true
+		}
+	}
+	return 0, false
+}
+
+// alice and bob hold 100 each
+func blockLedger(t *testing.T) (*mock.FullMockStub, []*testca.Identity) {
+	stub := fuzzLedger(t)
+	issuer, alice, bob := invariantActors[0], invariantActors[1], invariantActors[2]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 100}`))
+	return stub, []*testca.Identity{issuer, alice, bob}
+}
+
+func TestBlockConflictingTransfers(t *testing.T) {
+	stub, ids := blockLedger(t)
+	alice := ids[1]
+
+	// both transfers read alice's balance from the same snapshot
+	eventsBefore := len(stub.Events)
+	results := stub.MockBlock([]mock.Proposal{
+		transferProposal("tx1", alice, `{"to": "carol", "value": 60}`),
+		transferProposal("tx2", alice, `{"to": "dave", "value": 60}`),
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT)
+
+	balanceAlice, _ := balance(stub, "alice")
+	balanceDave, _ := balance(stub, "dave")
+	if balanceAlice.Value != 40 || balanceDave.Value != 0 {
+		t.Errorf("Expected only the first transfer to be committed: (%d, %d)", balanceAlice.Value, balanceDave.Value)
+	}
+	if events := stub.Events[eventsBefore:]; len(events) != 1 || events[0].TxId != "tx1" {
+		t.Error("Expected only the event of the valid transaction")
+	}
+
+	// retrying on the new state is endorsed against the committed transfer
+	results = stub.MockBlock([]mock.Proposal{
+		transferProposal("tx2-retry", alice, `{"to": "dave", "value": 60}`),
+	})
+	if results[0].Endorsed() {
+		t.Error("Expected the retry to fail endorsement: " + results[0].ValidationCode.String())
+	}
+}
+
+func TestBlockHotReceiver(t *testing.T) {
+	stub, ids := blockLedger(t)
+	alice, bob := ids[1], ids[2]
+
+	// independent senders still conflict on the receiver's balance
+	results := stub.MockBlock([]mock.Proposal{
+		transferProposal("tx1", alice, `{"to": "carol", "value": 10}`),
+		transferProposal("tx2", bob, `{"to": "carol", "value": 10}`),
+		transferProposal("tx3", bob, `{"to": "dave", "value": 10}`),
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT, pb.TxValidationCode_VALID)
+}
+
+func TestBlockStaleEndorsement(t *testing.T) {
+	stub, ids := blockLedger(t)
+	alice := ids[1]
+
+	// the endorsement reads alice's balance at its committed version
+	balanceKey, _ := stub.CreateCompositeKey(IndexBalance, []string{"alice"})
+	stale := stub.MockEndorse(transferProposal("tx1", alice, `{"to": "carol", "value": 10}`))
+	if stale.Endorsed() == false || len(stale.RWSet.Writes) != 2 {
+		t.Fatalf("Unexpected read/write set: %+v", stale.RWSet)
+	}
+	version, read := readVersion(stale.RWSet, balanceKey)
+	if !read || version == 0 {
+		t.Fatalf("Expected alice's balance to be read at its version, got %+v", stale.RWSet.Reads)
+	}
+	if b, _ := balance(stub, "carol"); b.Value != 0 {
+		t.Error("Endorsement should not change the committed state")
+	}
+
+	// approve only writes, a blind write never conflicts
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("2", util.ToChaincodeArgs("approve", `{"spender": "bob", "value": 10}`))
+	stub.MockCommit([]*mock.TxResult{stale})
+	expectValidation(t, []*mock.TxResult{stale}, pb.TxValidationCode_VALID)
+
+	// the committed transfer gave alice's balance a new version
+	next := stub.MockEndorse(transferProposal("tx2", alice, `{"to": "carol", "value": 10}`))
+	if newVersion, _ := readVersion(next.RWSet, balanceKey); newVersion <= version {
+		t.Errorf("Expected alice's balance to be read at a version after %d, got %d", version, newVersion)
+	}
+
+	stale = stub.MockEndorse(mock.Proposal{TxID: "tx3", MspID: alice.MspID, Cert: alice.CertPEM, Args: util.ToChaincodeArgs("allowances", `{"user": "alice"}`)})
+	stub.MockInvoke("4", util.ToChaincodeArgs("approve", `{"spender": "carol", "value": 10}`))
+	stub.MockCommit([]*mock.TxResult{stale})
+	expectValidation(t, []*mock.TxResult{stale}, pb.TxValidationCode_PHANTOM_READ_CONFLICT)
+}
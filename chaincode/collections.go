@@ -0,0 +1,66 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// collection definition, as passed to peer chaincode instantiate --collections-config
+type CollectionConfig struct {
+	Name              string `json:"name"`
+	Policy            string `json:"policy"`
+	RequiredPeerCount int    `json:"requiredPeerCount"`
+	MaxPeerCount      int    `json:"maxPeerCount"`
+	BlockToLive       uint64 `json:"blockToLive"`
+	MemberOnlyRead    bool   `json:"memberOnlyRead"`
+}
+
+// name of the collection shared by two organisations, in either order
+func BilateralCollectionName(mspA, mspB string) string {
+	if mspB < mspA {
+		mspA, mspB = mspB, mspA
+	}
+	return mspA + "-" + mspB
+}
+
+// one collection for each pair of organisations, readable by their clients only.
+// The private data never expires and reaches at least one other peer at endorsement
+func BilateralCollections(msps []string) []CollectionConfig {
+	sorted := append([]string{}, msps...)
+	sort.Strings(sorted)
+
+	configs := []CollectionConfig{}
+	for i, mspA := range sorted {
+		for _, mspB := range sorted[i+1:] {
+			if mspA == mspB {
+				continue
+			}
+			members := []string{"'" + mspA + ".member'", "'" + mspB + ".member'"}
+			configs = append(configs, CollectionConfig{
+				Name:              BilateralCollectionName(mspA, mspB),
+				Policy:            "OR(" + strings.Join(members, ",") + ")",
+				RequiredPeerCount: 1,
+				MaxPeerCount:      1,
+				BlockToLive:       0,
+				MemberOnlyRead:    true,
+			})
+		}
+	}
+	return configs
+}
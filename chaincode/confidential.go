@@ -0,0 +1,393 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/confidential"
+	"math/big"
+)
+
+// Confidential balances are Pedersen commitments, public to the channel.
+// Transfers split the sender's commitment into an output for the receiver and
+// the change, both with a proof that they commit to a 64 bit amount, so
+// the chaincode checks that no tokens are created without learning the amounts.
+// The openings are sealed for the auditor configured in the token data, which
+// the chaincode can't open: it only checks they are given, and an opening that
+// doesn't open its commitment is found by the auditor, not rejected here.
+// Deposits and withdrawals are checked like the private ones. Transfers check
+// both parties, but not the limits or fees depending on the hidden amount.
+// The public amounts of the deposits and withdrawals add up to the tokens in
+// confidential balances, which dividends leave out.
+
+const KeyConfidentialSupply = "__confidential"
+const IndexConfidential = "cn~confidential"
+const IndexConfidentialTransfer = "tx~confidential"
+
+// parses the PEM public key of an auditor
+func parseViewingKey(keyPEM string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("Failed to parse PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("Viewing key must be a P-256 key")
+	}
+	return ecKey, nil
+}
+
+func (t *TokenChaincode) setConfidentialBalance(stub shim.ChaincodeStubInterface, cn string, commitment *confidential.Commitment) error {
+	key, err := stub.CreateCompositeKey(IndexConfidential, []string{cn})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, commitment.Bytes())
+}
+
+func (t *TokenChaincode) confidentialBalance(stub shim.ChaincodeStubInterface, cn string) (*confidential.Commitment, error) {
+	key, err := stub.CreateCompositeKey(IndexConfidential, []string{cn})
+	if err != nil {
+		return nil, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// if the user cn is not in the state, then the balance commits to 0
+	if data == nil {
+		return confidential.Commit(0, new(big.Int)), nil
+	}
+
+	return confidential.ParseCommitment(data)
+}
+
+// records the transfer for the auditors, without the proofs
+func (t *TokenChaincode) recordConfidentialTransfer(stub shim.ChaincodeStubInterface, transfer ConfidentialTransfer) error {
+	key, err := stub.CreateCompositeKey(IndexConfidentialTransfer, []string{stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	transfer.OutputProof = nil
+	transfer.ChangeProof = nil
+	transferBytes, _ := json.Marshal(transfer)
+	err = stub.PutState(key, transferBytes)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("ConfidentialTransfer", transferBytes)
+}
+
+func parseConfidentialTransfer(args []string) (ConfidentialTransfer, error) {
+	transfer := ConfidentialTransfer{}
+	if len(args) != 1 {
+		return transfer, errors.New("Expected 1 argument")
+	}
+	err := json.Unmarshal([]byte(args[0]), &transfer)
+	if err != nil {
+		return transfer, errors.New("Error parsing transfer json")
+	}
+	return transfer, nil
+}
+
+// openings must be sealed for the auditor if there is one, though they can't
+// be checked against the commitments without its key
+func (t *TokenChaincode) audited(stub shim.ChaincodeStubInterface) (bool, error) {
+	token, err := tokenData(stub)
+	if err != nil {
+		return false, errors.New("Error getting token data")
+	}
+	return token.AuditorKey != "", nil
+}
+
+// the change is left to the sender, so it must have a range proof
+func checkChange(transfer ConfidentialTransfer, audited bool) error {
+	if transfer.Change == nil {
+		return errors.New("Expected the change commitment")
+	}
+	if err := transfer.ChangeProof.Verify(transfer.Change); err != nil {
+		return errors.New("Invalid change range proof: " + err.Error())
+	}
+	if audited && len(transfer.ChangeAudit) == 0 {
+		return errors.New("Expected the change opening for the auditor")
+	}
+	return nil
+}
+
+// moves a public amount of the caller's tokens to its confidential balance
+func (t *TokenChaincode) confidentialDeposit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	transfer, err := parseConfidentialTransfer(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	deposit := Transfer{From: caller, To: caller, Value: transfer.Value}
+	if res := checkSanctions(stub, "confidentialDeposit", deposit); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, deposit); res != nil {
+		return *res
+	}
+	event, err := transferFee(stub, deposit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	publicBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	commitment, err := t.confidentialBalance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting confidential balance")
+	}
+	if publicBalance < transfer.Value {
+		return shim.Error("Not enough balance")
+	}
+
+	// the amount is public, so it is committed without blinding
+	output := confidential.Commit(event.Net, new(big.Int))
+	err = t.setBalance(stub, caller, publicBalance-transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting balance")
+	}
+	err = recordFee(stub, event)
+	if err != nil {
+		return shim.Error("Error recording fee")
+	}
+	err = t.setConfidentialBalance(stub, caller, commitment.Add(output))
+	if err != nil {
+		return shim.Error("Error setting confidential balance")
+	}
+	err = updateShieldedSupply(stub, KeyConfidentialSupply, event.Net, 0)
+	if err != nil {
+		return shim.Error("Error updating confidential supply: " + err.Error())
+	}
+	err = recordSpending(stub, caller, transfer.Value)
+	if err != nil {
+		return shim.Error("Error recording spending")
+	}
+
+	record := ConfidentialTransfer{Kind: "deposit", From: caller, To: caller, Value: event.Net, Output: output}
+	if err := t.recordConfidentialTransfer(stub, record); err != nil {
+		return shim.Error("Error recording transfer")
+	}
+	return shim.Success(nil)
+}
+
+func (t *TokenChaincode) confidentialTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	transfer, err := parseConfidentialTransfer(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	from, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting from data")
+	}
+	if transfer.To == "" || transfer.To == from {
+		return shim.Error("Expected another receiver")
+	}
+	if err := checkNotMigrated(stub, from, transfer.To); err != nil {
+		return shim.Error(err.Error())
+	}
+	// the amount is hidden, the rules depending on it only see a zero value
+	parties := Transfer{From: from, To: transfer.To}
+	if res := checkSanctions(stub, "confidentialTransfer", parties); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, parties); res != nil {
+		return *res
+	}
+
+	audited, err := t.audited(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if transfer.Output == nil {
+		return shim.Error("Expected the output commitment")
+	}
+	if err := transfer.OutputProof.Verify(transfer.Output); err != nil {
+		return shim.Error("Invalid output range proof: " + err.Error())
+	}
+	if audited && len(transfer.OutputAudit) == 0 {
+		return shim.Error("Expected the output opening for the auditor")
+	}
+	if err := checkChange(transfer, audited); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fromBalance, err := t.confidentialBalance(stub, from)
+	if err != nil {
+		return shim.Error("Error getting to or from balance")
+	}
+	toBalance, err := t.confidentialBalance(stub, transfer.To)
+	if err != nil {
+		return shim.Error("Error getting to or from balance")
+	}
+
+	// inputs equal outputs, both of them being non negative
+	if !transfer.Output.Add(transfer.Change).Equal(fromBalance) {
+		return shim.Error("Output and change do not add up to the balance")
+	}
+
+	err = t.setConfidentialBalance(stub, from, transfer.Change)
+	if err != nil {
+		return shim.Error("Error setting to or from balance")
+	}
+	err = t.setConfidentialBalance(stub, transfer.To, toBalance.Add(transfer.Output))
+	if err != nil {
+		return shim.Error("Error setting to or from balance")
+	}
+
+	transfer.Kind = "transfer"
+	transfer.From = from
+	transfer.Value = 0
+	if err := t.recordConfidentialTransfer(stub, transfer); err != nil {
+		return shim.Error("Error recording transfer")
+	}
+	return shim.Success(nil)
+}
+
+// moves a public amount from the caller's confidential balance to its public one
+func (t *TokenChaincode) confidentialWithdraw(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	transfer, err := parseConfidentialTransfer(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	// the tokens enter the public state as if they were minted to the caller
+	withdrawal := Transfer{To: caller, Value: transfer.Value}
+	if res := checkSanctions(stub, "confidentialWithdraw", withdrawal); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, withdrawal); res != nil {
+		return *res
+	}
+	audited, err := t.audited(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkChange(transfer, audited); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	commitment, err := t.confidentialBalance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting confidential balance")
+	}
+	publicBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+
+	output := confidential.Commit(transfer.Value, new(big.Int))
+	if !output.Add(transfer.Change).Equal(commitment) {
+		return shim.Error("Value and change do not add up to the balance")
+	}
+	if publicBalance+transfer.Value < publicBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	err = t.setConfidentialBalance(stub, caller, transfer.Change)
+	if err != nil {
+		return shim.Error("Error setting confidential balance")
+	}
+	err = t.setBalance(stub, caller, publicBalance+transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting balance")
+	}
+	err = updateShieldedSupply(stub, KeyConfidentialSupply, 0, transfer.Value)
+	if err != nil {
+		return shim.Error("Error updating confidential supply: " + err.Error())
+	}
+
+	record := ConfidentialTransfer{Kind: "withdraw", From: caller, To: caller, Value: transfer.Value, Output: output, Change: transfer.Change, ChangeAudit: transfer.ChangeAudit}
+	if err := t.recordConfidentialTransfer(stub, record); err != nil {
+		return shim.Error("Error recording transfer")
+	}
+	return shim.Success(nil)
+}
+
+func (t *TokenChaincode) confidentialBalanceAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	balanceRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &balanceRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	commitment, err := t.confidentialBalance(stub, balanceRq.User)
+	if err != nil {
+		return shim.Error("Error getting confidential balance: " + err.Error())
+	}
+
+	result, _ := json.Marshal(ConfidentialBalance{User: balanceRq.User, Commitment: commitment})
+	return shim.Success(result)
+}
+
+// every confidential transfer, for the auditors to open
+func (t *TokenChaincode) confidentialTransfersAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexConfidentialTransfer, []string{})
+	if err != nil {
+		return shim.Error("Error getting transfers")
+	}
+	defer iterator.Close()
+
+	transfers := []ConfidentialTransfer{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error("Error getting transfers")
+		}
+		transfer := ConfidentialTransfer{}
+		if err := json.Unmarshal(kv.Value, &transfer); err != nil {
+			return shim.Error("Error parsing transfer")
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	result, _ := json.Marshal(transfers)
+	return shim.Success(result)
+}
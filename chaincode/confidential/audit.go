@@ -0,0 +1,93 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package confidential
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// Openings are sealed for an auditor (or for the receiver of a transfer) with
+// ECIES: an ephemeral P-256 key agreement with the viewing key, AES-GCM
+// under the SHA-256 of the shared secret and of the ephemeral public key.
+
+func sealKey(sharedX *big.Int, ephemeral []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append(scalarBytes(sharedX), ephemeral...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypts the opening for the holder of the viewing key
+func Seal(viewingKey *ecdsa.PublicKey, opening Opening) ([]byte, error) {
+	if viewingKey.Curve != curve {
+		return nil, errors.New("Viewing key must be a P-256 key")
+	}
+	k, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	ex, ey := curve.ScalarBaseMult(scalarBytes(k))
+	ephemeral := elliptic.MarshalCompressed(curve, ex, ey)
+	sharedX, _ := curve.ScalarMult(viewingKey.X, viewingKey.Y, scalarBytes(k))
+
+	aead, err := sealKey(sharedX, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _ := json.Marshal(Opening{Value: opening.Value, Blinding: opening.blinding()})
+	// the key is used once, so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeral, nonce, plaintext, nil), nil
+}
+
+// decrypts a sealed opening and checks that it opens the commitment
+func Unseal(viewingKey *ecdsa.PrivateKey, sealed []byte, commitment *Commitment) (Opening, error) {
+	opening := Opening{}
+	if len(sealed) < 33 {
+		return opening, errors.New("Invalid sealed opening")
+	}
+	ex, ey := elliptic.UnmarshalCompressed(curve, sealed[:33])
+	if ex == nil {
+		return opening, errors.New("Invalid sealed opening")
+	}
+	sharedX, _ := curve.ScalarMult(ex, ey, scalarBytes(viewingKey.D))
+
+	aead, err := sealKey(sharedX, sealed[:33])
+	if err != nil {
+		return opening, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[33:], nil)
+	if err != nil {
+		return opening, errors.New("Opening sealed for another viewing key")
+	}
+	if err := json.Unmarshal(plaintext, &opening); err != nil {
+		return opening, err
+	}
+	if !opening.Commitment().Equal(commitment) {
+		return opening, errors.New("Sealed opening does not open the commitment")
+	}
+	return opening, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package confidential
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func mustOpening(t *testing.T, value uint64) Opening {
+	opening, err := NewOpening(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opening
+}
+
+func TestCommitmentsAreHomomorphic(t *testing.T) {
+	balance := mustOpening(t, 1000)
+	output := mustOpening(t, 300)
+	change, err := balance.Sub(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !output.Commitment().Add(change.Commitment()).Equal(balance.Commitment()) {
+		t.Error("Expected the output and the change to add up to the balance")
+	}
+	if output.Commitment().Add(mustOpening(t, 700).Commitment()).Equal(balance.Commitment()) {
+		t.Error("Expected another blinding to give another commitment")
+	}
+	if _, err := output.Sub(balance); err == nil {
+		t.Error("Expected a negative change to fail")
+	}
+}
+
+func TestCommitmentEncoding(t *testing.T) {
+	for _, opening := range []Opening{mustOpening(t, 42), {Value: 0}} {
+		data, err := json.Marshal(opening.Commitment())
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := &Commitment{}
+		if err := json.Unmarshal(data, parsed); err != nil || !parsed.Equal(opening.Commitment()) {
+			t.Errorf("Expected the commitment to %d to round trip: %v", opening.Value, err)
+		}
+	}
+	if _, err := ParseCommitment([]byte{2, 1, 2, 3}); err == nil {
+		t.Error("Expected an invalid point to be rejected")
+	}
+}
+
+func TestRangeProof(t *testing.T) {
+	for _, value := range []uint64{0, 1, 1000, math.MaxUint64} {
+		opening := mustOpening(t, value)
+		proof, err := ProveRange(opening)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proof.Verify(opening.Commitment()); err != nil {
+			t.Errorf("Expected the proof of %d to verify: %v", value, err)
+		}
+		if err := proof.Verify(mustOpening(t, value).Commitment()); err == nil {
+			t.Errorf("Expected the proof of %d not to verify another commitment", value)
+		}
+	}
+}
+
+func TestRangeProofOfNegativeAmount(t *testing.T) {
+	// a commitment to -1 is a commitment to N-1, far above 2^64
+	blinding := big.NewInt(7)
+	minusOne := Commit(0, blinding).Sub(Commit(1, new(big.Int)))
+
+	// proving the bits of 2^64-1 does not help, they add up to another point
+	proof, err := ProveRange(Opening{Value: math.MaxUint64, Blinding: blinding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(minusOne); err == nil {
+		t.Error("Expected the proof not to verify a negative amount")
+	}
+
+	// tampering with a bit breaks its OR-proof
+	opening := mustOpening(t, 5)
+	proof, _ = ProveRange(opening)
+	proof.Bits[1].Commitment = proof.Bits[1].Commitment.Add(Commit(1, new(big.Int)))
+	if err := proof.Verify(opening.Commitment()); err == nil {
+		t.Error("Expected a tampered bit to be rejected")
+	}
+}
+
+func TestSealForAuditor(t *testing.T) {
+	viewingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	opening := mustOpening(t, 1234)
+
+	sealed, err := Seal(&viewingKey.PublicKey, opening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Unseal(viewingKey, sealed, opening.Commitment())
+	if err != nil || opened.Value != 1234 {
+		t.Errorf("Expected the auditor to open 1234, got %d (%v)", opened.Value, err)
+	}
+	if _, err := Unseal(otherKey, sealed, opening.Commitment()); err == nil {
+		t.Error("Expected another key not to open the commitment")
+	}
+	if _, err := Unseal(viewingKey, sealed, mustOpening(t, 1234).Commitment()); err == nil {
+		t.Error("Expected the opening to be checked against the commitment")
+	}
+}
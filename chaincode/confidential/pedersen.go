@@ -0,0 +1,192 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package confidential implements Pedersen commitments on P-256, range proofs
+// showing a committed amount fits in 64 bits, and the encryption of openings
+// for auditors, for confidential transfers of the token.
+package confidential
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var curve = elliptic.P256()
+
+// second generator, nobody knows its discrete log with respect to G
+var hx, hy = hashToPoint([]byte("fabric-token pedersen generator H"))
+
+// try-and-increment, taking the point with the even y
+func hashToPoint(seed []byte) (*big.Int, *big.Int) {
+	params := curve.Params()
+	three := big.NewInt(3)
+	for counter := uint32(0); ; counter++ {
+		counterBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(counterBytes, counter)
+		digest := sha256.Sum256(append(append([]byte{}, seed...), counterBytes...))
+		x := new(big.Int).SetBytes(digest[:])
+		x.Mod(x, params.P)
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil {
+			continue
+		}
+		if y.Bit(0) == 1 {
+			y.Sub(params.P, y)
+		}
+		return x, y
+	}
+}
+
+// Commitment to a value v with a blinding r, v·G + r·H
+type Commitment struct {
+	x, y *big.Int
+}
+
+// point at infinity, the commitment to 0 with no blinding
+func (c *Commitment) isInfinity() bool {
+	return c.x.Sign() == 0 && c.y.Sign() == 0
+}
+
+func scalar(k *big.Int) []byte {
+	return new(big.Int).Mod(k, curve.Params().N).Bytes()
+}
+
+func Commit(value uint64, blinding *big.Int) *Commitment {
+	vx, vy := curve.ScalarBaseMult(scalar(new(big.Int).SetUint64(value)))
+	rx, ry := curve.ScalarMult(hx, hy, scalar(blinding))
+	x, y := curve.Add(vx, vy, rx, ry)
+	return &Commitment{x, y}
+}
+
+func (c *Commitment) Add(other *Commitment) *Commitment {
+	x, y := curve.Add(c.x, c.y, other.x, other.y)
+	return &Commitment{x, y}
+}
+
+func (c *Commitment) Sub(other *Commitment) *Commitment {
+	return c.Add(other.neg())
+}
+
+func (c *Commitment) neg() *Commitment {
+	if c.isInfinity() {
+		return c
+	}
+	return &Commitment{new(big.Int).Set(c.x), new(big.Int).Sub(curve.Params().P, c.y)}
+}
+
+func (c *Commitment) mul(k *big.Int) *Commitment {
+	x, y := curve.ScalarMult(c.x, c.y, scalar(k))
+	return &Commitment{x, y}
+}
+
+func (c *Commitment) Equal(other *Commitment) bool {
+	return c.x.Cmp(other.x) == 0 && c.y.Cmp(other.y) == 0
+}
+
+// compressed point, a single zero byte for the point at infinity
+func (c *Commitment) Bytes() []byte {
+	if c.isInfinity() {
+		return []byte{0}
+	}
+	return elliptic.MarshalCompressed(curve, c.x, c.y)
+}
+
+func ParseCommitment(data []byte) (*Commitment, error) {
+	if len(data) == 1 && data[0] == 0 {
+		return &Commitment{new(big.Int), new(big.Int)}, nil
+	}
+	x, y := elliptic.UnmarshalCompressed(curve, data)
+	if x == nil {
+		return nil, errors.New("Invalid commitment")
+	}
+	return &Commitment{x, y}, nil
+}
+
+func (c *Commitment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Bytes())
+}
+
+func (c *Commitment) UnmarshalJSON(data []byte) error {
+	var commitmentBytes []byte
+	if err := json.Unmarshal(data, &commitmentBytes); err != nil {
+		return err
+	}
+	parsed, err := ParseCommitment(commitmentBytes)
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
+
+// Opening of a commitment, known to its holder and to the auditors
+type Opening struct {
+	Value    uint64   `json:"value"`
+	Blinding *big.Int `json:"blinding"`
+}
+
+func randomScalar() (*big.Int, error) {
+	return rand.Int(rand.Reader, curve.Params().N)
+}
+
+// commitment to the value with a random blinding
+func NewOpening(value uint64) (Opening, error) {
+	blinding, err := randomScalar()
+	if err != nil {
+		return Opening{}, err
+	}
+	return Opening{Value: value, Blinding: blinding}, nil
+}
+
+// a missing blinding is 0, as for deposits of public amounts
+func (o Opening) blinding() *big.Int {
+	if o.Blinding == nil {
+		return new(big.Int)
+	}
+	return o.Blinding
+}
+
+func (o Opening) Commitment() *Commitment {
+	return Commit(o.Value, o.blinding())
+}
+
+func (o Opening) Add(other Opening) (Opening, error) {
+	if o.Value+other.Value < o.Value {
+		return Opening{}, errors.New("Value overflow")
+	}
+	blinding := new(big.Int).Add(o.blinding(), other.blinding())
+	return Opening{Value: o.Value + other.Value, Blinding: blinding.Mod(blinding, curve.Params().N)}, nil
+}
+
+// opening of the change of a transfer, c - other
+func (o Opening) Sub(other Opening) (Opening, error) {
+	if o.Value < other.Value {
+		return Opening{}, errors.New("Not enough balance")
+	}
+	blinding := new(big.Int).Sub(o.blinding(), other.blinding())
+	return Opening{Value: o.Value - other.Value, Blinding: blinding.Mod(blinding, curve.Params().N)}, nil
+}
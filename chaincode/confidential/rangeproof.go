@@ -0,0 +1,183 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package confidential
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strconv"
+)
+
+// A range proof commits to every bit of the amount and proves, for each bit
+// commitment C_i, the knowledge of x such that C_i = x·H or C_i - G = x·H
+// (a Schnorr OR-proof made non-interactive with Fiat-Shamir). The bit
+// commitments weighted by 2^i must add up to the proven commitment, so the
+// amount is in [0, 2^64) and the sums checked by the chaincode cannot wrap
+// around the group order.
+
+const RangeBits = 64
+
+type BitProof struct {
+	Commitment *Commitment `json:"c"`
+	E0         []byte      `json:"e0"`
+	E1         []byte      `json:"e1"`
+	S0         []byte      `json:"s0"`
+	S1         []byte      `json:"s1"`
+}
+
+type RangeProof struct {
+	Bits []BitProof `json:"bits"`
+}
+
+// proves that the committed value is a 64 bit unsigned integer
+func ProveRange(opening Opening) (*RangeProof, error) {
+	n := curve.Params().N
+	commitment := opening.Commitment()
+
+	// the blindings of the bits add up to the blinding of the value
+	blindings := make([]*big.Int, RangeBits)
+	first := new(big.Int).Set(opening.blinding())
+	for i := 1; i < RangeBits; i++ {
+		blinding, err := randomScalar()
+		if err != nil {
+			return nil, err
+		}
+		blindings[i] = blinding
+		first.Sub(first, new(big.Int).Lsh(blinding, uint(i)))
+	}
+	blindings[0] = first.Mod(first, n)
+
+	proof := &RangeProof{Bits: make([]BitProof, RangeBits)}
+	for i := 0; i < RangeBits; i++ {
+		bit := (opening.Value >> uint(i)) & 1
+		bitProof, err := proveBit(commitment, i, bit, blindings[i])
+		if err != nil {
+			return nil, err
+		}
+		proof.Bits[i] = bitProof
+	}
+	return proof, nil
+}
+
+func proveBit(commitment *Commitment, index int, bit uint64, blinding *big.Int) (BitProof, error) {
+	n := curve.Params().N
+	c := Commit(bit, blinding)
+	statements := bitStatements(c)
+
+	// the branch of the other bit value is simulated
+	proven, simulated := bit, 1-bit
+	k, err := randomScalar()
+	if err != nil {
+		return BitProof{}, err
+	}
+	eSimulated, err := randomScalar()
+	if err != nil {
+		return BitProof{}, err
+	}
+	sSimulated, err := randomScalar()
+	if err != nil {
+		return BitProof{}, err
+	}
+
+	announcements := make([]*Commitment, 2)
+	announcements[proven] = Commit(0, k)
+	announcements[simulated] = Commit(0, sSimulated).Sub(statements[simulated].mul(eSimulated))
+
+	e := challenge(commitment, index, c, announcements)
+	eReal := new(big.Int).Sub(e, eSimulated)
+	eReal.Mod(eReal, n)
+	sReal := new(big.Int).Mul(eReal, blinding)
+	sReal.Add(sReal, k)
+	sReal.Mod(sReal, n)
+
+	es, ss := make([][]byte, 2), make([][]byte, 2)
+	es[proven], ss[proven] = scalarBytes(eReal), scalarBytes(sReal)
+	es[simulated], ss[simulated] = scalarBytes(eSimulated), scalarBytes(sSimulated)
+	return BitProof{Commitment: c, E0: es[0], E1: es[1], S0: ss[0], S1: ss[1]}, nil
+}
+
+// C_i and C_i - G, one of them is a multiple of H
+func bitStatements(c *Commitment) []*Commitment {
+	return []*Commitment{c, c.Sub(Commit(1, new(big.Int)))}
+}
+
+func challenge(commitment *Commitment, index int, c *Commitment, announcements []*Commitment) *big.Int {
+	h := sha256.New()
+	h.Write([]byte("fabric-token range proof " + strconv.Itoa(index)))
+	h.Write(commitment.Bytes())
+	h.Write(c.Bytes())
+	for _, a := range announcements {
+		h.Write(a.Bytes())
+	}
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e.Mod(e, curve.Params().N)
+}
+
+func scalarBytes(k *big.Int) []byte {
+	b := make([]byte, 32)
+	return k.FillBytes(b)
+}
+
+func parseScalar(b []byte) (*big.Int, error) {
+	k := new(big.Int).SetBytes(b)
+	if len(b) != 32 || k.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("Invalid scalar")
+	}
+	return k, nil
+}
+
+// checks the proof for the given commitment
+func (p *RangeProof) Verify(commitment *Commitment) error {
+	if p == nil || len(p.Bits) != RangeBits {
+		return errors.New("Range proof must have " + strconv.Itoa(RangeBits) + " bits")
+	}
+
+	n := curve.Params().N
+	sum := Commit(0, new(big.Int))
+	for i, bitProof := range p.Bits {
+		if bitProof.Commitment == nil {
+			return errors.New("Missing bit commitment")
+		}
+		scalars := make([]*big.Int, 4)
+		for j, b := range [][]byte{bitProof.E0, bitProof.E1, bitProof.S0, bitProof.S1} {
+			k, err := parseScalar(b)
+			if err != nil {
+				return err
+			}
+			scalars[j] = k
+		}
+		es, ss := scalars[:2], scalars[2:]
+
+		statements := bitStatements(bitProof.Commitment)
+		announcements := make([]*Commitment, 2)
+		for j := range announcements {
+			announcements[j] = Commit(0, ss[j]).Sub(statements[j].mul(es[j]))
+		}
+		e := new(big.Int).Add(es[0], es[1])
+		if e.Mod(e, n).Cmp(challenge(commitment, i, bitProof.Commitment, announcements)) != 0 {
+			return errors.New("Invalid proof of bit " + strconv.Itoa(i))
+		}
+
+		sum = sum.Add(bitProof.Commitment.mul(new(big.Int).Lsh(big.NewInt(1), uint(i))))
+	}
+
+	if !sum.Equal(commitment) {
+		return errors.New("Bit commitments do not add up to the commitment")
+	}
+	return nil
+}
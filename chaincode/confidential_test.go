@@ -0,0 +1,236 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/confidential"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+	"time"
+)
+
+var auditorViewingKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+// the issuer holds 1000 public tokens, openings are sealed for the auditor
+func confidentialLedger(t *testing.T) *mock.FullMockStub {
+	keyBytes, _ := x509.MarshalPKIXPublicKey(&auditorViewingKey.PublicKey)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyBytes})
+	tokenBytes, _ := json.Marshal(Token{Name: "Confidential", TotalSupply: 1000, AuditorKey: string(keyPEM)})
+
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", string(tokenBytes))); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	return stub
+}
+
+func confidentialInvoke(stub *mock.FullMockStub, txID string, caller *testca.Identity, function string, transfer ConfidentialTransfer) pb.Response {
+	stub.MockCreator(caller.MspID, caller.CertPEM)
+	transferBytes, _ := json.Marshal(transfer)
+	return stub.MockInvoke(txID, util.ToChaincodeArgs(function, string(transferBytes)))
+}
+
+// splits the balance into an output for the receiver and the change, as a client does
+func newConfidentialTransfer(t *testing.T, balance confidential.Opening, value uint64, to *testca.Identity) (ConfidentialTransfer, confidential.Opening) {
+	output, err := confidential.NewOpening(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := balance.Sub(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := ConfidentialTransfer{To: to.Cert.Subject.CommonName, Output: output.Commitment(), Change: change.Commitment()}
+	transfer.OutputProof, _ = confidential.ProveRange(output)
+	transfer.ChangeProof, _ = confidential.ProveRange(change)
+	transfer.OutputAudit, _ = confidential.Seal(&auditorViewingKey.PublicKey, output)
+	transfer.ChangeAudit, _ = confidential.Seal(&auditorViewingKey.PublicKey, change)
+	transfer.Memo, _ = confidential.Seal(&to.Key.PublicKey, output)
+	return transfer, change
+}
+
+func queryConfidentialBalance(t *testing.T, stub *mock.FullMockStub, cn string) *confidential.Commitment {
+	res := stub.MockInvoke("confidentialBalance", util.ToChaincodeArgs("confidentialBalance", `{"user": "`+cn+`"}`))
+	b := ConfidentialBalance{}
+	if err := json.Unmarshal(res.Payload, &b); err != nil || b.Commitment == nil {
+		t.Fatalf("Confidential balance query failed: %s %v", res.Message, err)
+	}
+	return b.Commitment
+}
+
+func TestConfidentialTransfers(t *testing.T) {
+	stub := confidentialLedger(t)
+	issuer, alice := invariantActors[0], invariantActors[1]
+
+	if res := confidentialInvoke(stub, "tx1", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 1000}); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	issuerBalance := confidential.Opening{Value: 1000}
+
+	transfer, change := newConfidentialTransfer(t, issuerBalance, 300, alice)
+	if res := confidentialInvoke(stub, "tx2", issuer, "confidentialTransfer", transfer); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if !queryConfidentialBalance(t, stub, "issuer").Equal(change.Commitment()) {
+		t.Error("Expected the issuer's balance to be the change")
+	}
+
+	// alice learns the output from the memo and withdraws part of it
+	aliceBalance, err := confidential.Unseal(alice.Key, transfer.Memo, queryConfidentialBalance(t, stub, "alice"))
+	if err != nil || aliceBalance.Value != 300 {
+		t.Fatalf("Expected alice to open 300, got %d (%v)", aliceBalance.Value, err)
+	}
+	withdrawal := confidential.Opening{Value: 100}
+	aliceChange, _ := aliceBalance.Sub(withdrawal)
+	withdraw := ConfidentialTransfer{Value: 100, Change: aliceChange.Commitment()}
+	withdraw.ChangeProof, _ = confidential.ProveRange(aliceChange)
+	withdraw.ChangeAudit, _ = confidential.Seal(&auditorViewingKey.PublicKey, aliceChange)
+	if res := confidentialInvoke(stub, "tx3", alice, "confidentialWithdraw", withdraw); res.Status != shim.OK {
+		t.Fatal("Withdraw failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 100 {
+		t.Errorf("Expected alice to hold 100 public tokens, got %d", b.Value)
+	}
+}
+
+func TestConfidentialAudit(t *testing.T) {
+	stub := confidentialLedger(t)
+	issuer, alice, bob := invariantActors[0], invariantActors[1], invariantActors[2]
+
+	confidentialInvoke(stub, "tx4", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 1000})
+	transfer, change := newConfidentialTransfer(t, confidential.Opening{Value: 1000}, 300, alice)
+	confidentialInvoke(stub, "tx5", issuer, "confidentialTransfer", transfer)
+	transfer, _ = newConfidentialTransfer(t, change, 450, bob)
+	confidentialInvoke(stub, "tx6", issuer, "confidentialTransfer", transfer)
+
+	// the auditor opens every amount recorded on the ledger
+	res := stub.MockInvoke("transfers", util.ToChaincodeArgs("confidentialTransfers"))
+	transfers := []ConfidentialTransfer{}
+	json.Unmarshal(res.Payload, &transfers)
+	opened := map[string]uint64{}
+	for _, transfer := range transfers {
+		if transfer.Kind != "transfer" {
+			continue
+		}
+		output, err := confidential.Unseal(auditorViewingKey, transfer.OutputAudit, transfer.Output)
+		if err != nil {
+			t.Fatal("Auditor could not open the output: " + err.Error())
+		}
+		change, err := confidential.Unseal(auditorViewingKey, transfer.ChangeAudit, transfer.Change)
+		if err != nil {
+			t.Fatal("Auditor could not open the change: " + err.Error())
+		}
+		opened[transfer.To] = output.Value
+		opened[transfer.From] = change.Value
+	}
+	if opened["alice"] != 300 || opened["bob"] != 450 || opened["issuer"] != 250 {
+		t.Errorf("Expected the auditor to open 300, 450 and 250, got %v", opened)
+	}
+}
+
+func TestConfidentialTransferChecks(t *testing.T) {
+	stub := confidentialLedger(t)
+	issuer, alice := invariantActors[0], invariantActors[1]
+	confidentialInvoke(stub, "tx7", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 1000})
+	balance := confidential.Opening{Value: 1000}
+
+	// spending more than the balance leaves a negative change without a range proof
+	overspend, _ := newConfidentialTransfer(t, confidential.Opening{Value: 1300}, 1300, alice)
+	overspend.Change = balance.Commitment().Sub(overspend.Output)
+
+	// outputs not adding up to the balance, with valid range proofs
+	minted, _ := newConfidentialTransfer(t, confidential.Opening{Value: 2000}, 300, alice)
+
+	missingAudit, _ := newConfidentialTransfer(t, balance, 300, alice)
+	missingAudit.OutputAudit = nil
+
+	missingProof, _ := newConfidentialTransfer(t, balance, 300, alice)
+	missingProof.OutputProof = nil
+
+	for name, transfer := range map[string]ConfidentialTransfer{
+		"overspend":     overspend,
+		"minted":        minted,
+		"missing audit": missingAudit,
+		"missing proof": missingProof,
+	} {
+		if res := confidentialInvoke(stub, "tx8", issuer, "confidentialTransfer", transfer); res.Status == shim.OK {
+			t.Errorf("Expected the %s transfer to fail", name)
+		}
+	}
+	if !queryConfidentialBalance(t, stub, "issuer").Equal(balance.Commitment()) {
+		t.Error("Expected the balance to be unchanged")
+	}
+}
+
+func TestConfidentialCompliance(t *testing.T) {
+	roles := map[string][]RoleRule{"compliance": {{Attr: "hf.Type", Value: "compliance"}}}
+	tokenBytes, _ := json.Marshal(Token{Name: "Confidential", TotalSupply: 1000, Roles: roles})
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer, officer, bob := roleActors["issuer"], roleActors["officer"], recoveryActors["bob"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", string(tokenBytes))); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	if res := confidentialInvoke(stub, "1", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 100}); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+
+	// the receiver is named, so it is checked
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	batch := fmt.Sprintf(`{"list": "OFAC", "chunk": 0, "chunks": 1, "entries": [{"hash": "%s"}]}`, hashCN("bob"))
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("importSanctions", batch)); res.Status != shim.OK {
+		t.Fatal("ImportSanctions failed: " + res.Message)
+	}
+	transfer, _ := newConfidentialTransfer(t, confidential.Opening{Value: 100}, 30, bob)
+	if res := confidentialInvoke(stub, "3", issuer, "confidentialTransfer", transfer); res.Status != StatusSanctioned {
+		t.Errorf("Expected the transfer to bob to be blocked, got %d %s", res.Status, res.Message)
+	}
+
+	// locked up tokens are not deposited
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	lockUp := fmt.Sprintf(`{"user": "issuer", "until": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("setLockUp", lockUp)); res.Status != shim.OK {
+		t.Fatal("SetLockUp failed: " + res.Message)
+	}
+	if res := confidentialInvoke(stub, "5", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 10}); res.Status != StatusRestricted {
+		t.Errorf("Expected the deposit to be restricted, got %d %s", res.Status, res.Message)
+	}
+}
+
+func TestInitWithInvalidAuditorKey(t *testing.T) {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	res := stub.MockInit("init", util.ToChaincodeArgs("init", `{"totalSupply": 1000, "auditorKey": "invalid"}`))
+	if res.Status == shim.OK {
+		t.Error("Expected an invalid auditor key to be rejected")
+	}
+}
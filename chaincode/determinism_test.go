@@ -0,0 +1,52 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/mock"
+	"testing"
+)
+
+func TestDeterministicEndorsements(t *testing.T) {
+	stub, ids := blockLedger(t)
+	alice, bob := ids[1], ids[2]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("approve", `{"spender": "carol", "value": 20}`))
+	stub.MockInvoke("4", util.ToChaincodeArgs("approve", `{"spender": "dave", "value": 30}`))
+
+	newChaincode := func() shim.Chaincode { return &TokenChaincode{} }
+	proposals := []mock.Proposal{
+		{TxID: "info", Args: util.ToChaincodeArgs("info")},
+		{TxID: "balance", Args: util.ToChaincodeArgs("balance", `{"user": "alice"}`)},
+		{TxID: "allowances", Args: util.ToChaincodeArgs("allowances", `{"user": "alice"}`)},
+		{TxID: "transfer", Args: util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 10}`)},
+		{TxID: "approve", Args: util.ToChaincodeArgs("approve", `{"spender": "carol", "value": 10}`)},
+		{TxID: "transferFrom", MspID: bob.MspID, Cert: bob.CertPEM, Args: util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "carol", "value": 10}`)},
+		{TxID: "failure", Args: util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 1000}`)},
+	}
+
+	for _, proposal := range proposals {
+		if proposal.Cert == "" {
+			proposal.MspID, proposal.Cert = alice.MspID, alice.CertPEM
+		}
+		if err := mock.CheckDeterminism(stub, newChaincode, proposal, 4); err != nil {
+			t.Error(err)
+		}
+	}
+}
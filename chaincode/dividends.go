@@ -0,0 +1,463 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+)
+
+// Distributions pay an amount to the holders pro rata of their balances at a
+// snapshot taken when the distribution is created. Instead of crediting every
+// holder, a distribution records the amount per token unit, scaled by 10^18,
+// and holders claim what their balances at the snapshots of the distributions
+// since their last claim add up to. Whole units left unpaid when rounding the
+// amount per unit are carried to the next distribution, and what is left when
+// rounding the claim of a holder is kept for its next one. Tokens distributed
+// and not claimed yet, staked tokens, staking rewards and fees not collected
+// yet are not in any balance and get no share. The series keeps what was
+// funded and each holder's claim what it was paid, so claims of different
+// holders don't conflict.
+//
+// Distributions in this token are funded by the creator's balance. Fabric calls
+// other chaincodes as the creator of the transaction, so payouts in another
+// token are transfers from the payer to the holder claiming them, which the
+// payer approves in that token. Distributions of each token and payer are
+// numbered from 1. When an account is migrated, what it did not claim is kept
+// for the new account.
+
+const IndexDividends = "token~payer~dividends"
+const IndexDistribution = "token~payer~id~distribution"
+const IndexDividendClaim = "token~payer~cn~claim"
+
+var dividendScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+func parseBig(value string) *big.Int {
+	n, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return n
+}
+
+func bigUint(value uint64) *big.Int {
+	return new(big.Int).SetUint64(value)
+}
+
+// distributions in this token don't depend on who funded them
+func dividendSeries(token, payer string) []string {
+	if token == "" {
+		return []string{"", ""}
+	}
+	return []string{token, payer}
+}
+
+// tokens out of the public balances, which get no dividends: the ones distributed
+// and not claimed yet, the staked ones and staking rewards, the ones in private
+// or confidential balances, whose holders can't claim, and the fees not collected
+// yet
+func heldTokens(stub shim.ChaincodeStubInterface) (uint64, error) {
+	dividends := DividendSeries{}
+	if _, err := getJson(stub, IndexDividends, dividendSeries("", ""), &dividends); err != nil {
+		return 0, err
+	}
+	staking, err := stakingState(stub)
+	if err != nil {
+		return 0, err
+	}
+	private, err := shieldedSupply(stub, KeyPrivateSupply)
+	if err != nil {
+		return 0, err
+	}
+	confidentialSupply, err := shieldedSupply(stub, KeyConfidentialSupply)
+	if err != nil {
+		return 0, err
+	}
+	fees, _, err := pendingFees(stub)
+	if err != nil {
+		return 0, err
+	}
+	claimed, err := claimedDividends(stub)
+	if err != nil {
+		return 0, err
+	}
+	if claimed > dividends.Funded {
+		return 0, fmt.Errorf("Dividends claimed %d above the funded %d", claimed, dividends.Funded)
+	}
+	return dividends.Funded - claimed + staking.TotalStaked + staking.Pool + staking.Rewards + private + confidentialSupply + fees, nil
+}
+
+// the dividends in this token paid to all holders, added up from their claims
+func claimedDividends(stub shim.ChaincodeStubInterface) (uint64, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexDividendClaim, dividendSeries("", ""))
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	var claimed uint64
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		claim := DividendClaim{}
+		if err := json.Unmarshal(kv.Value, &claim); err != nil {
+			return 0, err
+		}
+		if claimed+claim.Claimed < claimed {
+			return 0, errors.New("Claimed dividends overflow")
+		}
+		claimed += claim.Claimed
+	}
+	return claimed, nil
+}
+
+// the distributions of the series after the given one
+func distributionsAfter(stub shim.ChaincodeStubInterface, series []string, after uint64) ([]Distribution, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexDistribution, series)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	distributions := []Distribution{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		distribution := Distribution{}
+		if err := json.Unmarshal(kv.Value, &distribution); err != nil {
+			return nil, err
+		}
+		if distribution.ID > after {
+			distributions = append(distributions, distribution)
+		}
+	}
+	return distributions, nil
+}
+
+// adds the dividends of the distributions since the last claim of the user
+func (t *TokenChaincode) claimable(stub shim.ChaincodeStubInterface, claim *DividendClaim) (bool, error) {
+	series := dividendSeries(claim.Token, claim.Payer)
+	last := DividendClaim{}
+	if _, err := getJson(stub, IndexDividendClaim, append(series, claim.User), &last); err != nil {
+		return false, err
+	}
+	distributions, err := distributionsAfter(stub, series, last.LastID)
+	if err != nil {
+		return false, err
+	}
+
+	scaled := parseBig(last.Remainder)
+	for _, distribution := range distributions {
+		balance, err := t.balanceAt(stub, claim.User, distribution.SnapshotID)
+		if err != nil {
+			return false, err
+		}
+		scaled.Add(scaled, new(big.Int).Mul(bigUint(balance), parseBig(distribution.PerUnit)))
+		last.LastID = distribution.ID
+	}
+
+	value, remainder := new(big.Int).QuoRem(scaled, dividendScale, new(big.Int))
+	claim.LastID, claim.Value, claim.Remainder = last.LastID, value.Uint64(), remainder.String()
+	claim.Claimed = last.Claimed + claim.Value
+	return len(distributions) > 0, nil
+}
+
+func (t *TokenChaincode) createDistribution(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("CreateDistribution expected 1 argument")
+	}
+	distribution := Distribution{}
+	err := json.Unmarshal([]byte(args[0]), &distribution)
+	if err != nil {
+		return shim.Error("Error parsing distribution json")
+	}
+	if distribution.Amount == 0 {
+		return shim.Error("Expected the amount to distribute")
+	}
+	err = requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	payer, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+
+	series := dividendSeries(distribution.Token, payer)
+	dividends := DividendSeries{}
+	if _, err := getJson(stub, IndexDividends, series, &dividends); err != nil {
+		return shim.Error("Error getting dividends")
+	}
+	total := distribution.Amount + dividends.Dust
+	if total < distribution.Amount {
+		return shim.Error("Distribution amount overflow")
+	}
+
+	held, err := heldTokens(stub)
+	if err != nil {
+		return shim.Error("Error getting held tokens")
+	}
+
+	// the amount leaves the balances before the snapshot, so it gets no share of itself
+	if distribution.Token == "" {
+		payerBalance, err := t.balance(stub, payer)
+		if err != nil {
+			return shim.Error("Error getting balance")
+		}
+		if payerBalance < distribution.Amount {
+			return shim.Error("Not enough balance")
+		}
+		if err := t.setBalance(stub, payer, payerBalance-distribution.Amount); err != nil {
+			return shim.Error("Error setting balance")
+		}
+		held += distribution.Amount
+		dividends.Funded += distribution.Amount
+	}
+
+	snapshot, err := takeSnapshot(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	token, err := tokenData(stub)
+	if err != nil {
+		return shim.Error("Error getting token data")
+	}
+	if token.TotalSupply <= held {
+		return shim.Error("No holders to distribute to")
+	}
+	units := bigUint(token.TotalSupply - held)
+
+	perUnit := new(big.Int).Mul(bigUint(total), dividendScale)
+	perUnit.Quo(perUnit, units)
+	// the fractions of a unit are owed to the holders, so only whole units not paid
+	// out are carried, or they would be distributed twice
+	paid := new(big.Int).Mul(perUnit, units)
+	paid.Add(paid, new(big.Int).Sub(dividendScale, big.NewInt(1)))
+	paid.Quo(paid, dividendScale)
+
+	dividends.LastID++
+	dividends.Cumulative = new(big.Int).Add(parseBig(dividends.Cumulative), perUnit).String()
+	dividends.Dust = total - paid.Uint64()
+
+	distribution.ID = dividends.LastID
+	distribution.Payer = payer
+	distribution.SnapshotID = snapshot.ID
+	distribution.Time = snapshot.Time
+	distribution.PerUnit = perUnit.String()
+	distribution.Cumulative = dividends.Cumulative
+	distribution.Dust = dividends.Dust
+	if distribution.Token == "" {
+		distribution.Payer = ""
+	}
+
+	err = putJson(stub, IndexDividends, series, dividends)
+	if err != nil {
+		return shim.Error("Error saving dividends")
+	}
+	err = putJson(stub, IndexDistribution, append(series, fmt.Sprintf("%020d", distribution.ID)), distribution)
+	if err != nil {
+		return shim.Error("Error saving distribution")
+	}
+
+	distributionBytes, _ := json.Marshal(distribution)
+	stub.SetEvent("DistributionCreated", distributionBytes)
+	return shim.Success(distributionBytes)
+}
+
+// pays the caller's dividends in this token, or the ones of the payer in another token
+// moves what the migrated account did not claim in every series to the new
+// account, whose next claim pays it along with its own dividends
+func (t *TokenChaincode) migrateDividends(stub shim.ChaincodeStubInterface, from, to string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexDividends, []string{})
+	if err != nil {
+		return err
+	}
+	series := [][]string{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 2 {
+			iterator.Close()
+			return fmt.Errorf("Invalid dividends key: %s", kv.Key)
+		}
+		series = append(series, parts)
+	}
+	iterator.Close()
+
+	for _, parts := range series {
+		fromClaim := DividendClaim{User: from, Token: parts[0], Payer: parts[1]}
+		if _, err := t.claimable(stub, &fromClaim); err != nil {
+			return err
+		}
+		scaled := new(big.Int).Mul(bigUint(fromClaim.Value), dividendScale)
+		scaled.Add(scaled, parseBig(fromClaim.Remainder))
+		if scaled.Sign() == 0 {
+			continue
+		}
+
+		toClaim := DividendClaim{User: to, Token: parts[0], Payer: parts[1]}
+		if _, err := getJson(stub, IndexDividendClaim, []string{parts[0], parts[1], to}, &toClaim); err != nil {
+			return err
+		}
+		toClaim.Remainder = scaled.Add(scaled, parseBig(toClaim.Remainder)).String()
+		if err := putJson(stub, IndexDividendClaim, []string{parts[0], parts[1], to}, toClaim); err != nil {
+			return err
+		}
+
+		// settled up to the last distribution, without paying the old account
+		fromClaim.Claimed -= fromClaim.Value
+		fromClaim.Value, fromClaim.Remainder = 0, "0"
+		if err := putJson(stub, IndexDividendClaim, []string{parts[0], parts[1], from}, fromClaim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TokenChaincode) claim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	claim := DividendClaim{}
+	if len(args) > 1 {
+		return shim.Error("Claim expected at most 1 argument")
+	}
+	if len(args) == 1 {
+		if err := json.Unmarshal([]byte(args[0]), &claim); err != nil {
+			return shim.Error("Error parsing claim json")
+		}
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if claim.User != "" && claim.User != caller {
+		return shim.Error("Only the holder can claim its dividends")
+	}
+	claim.User = caller
+	if claim.Token == "" {
+		claim.Payer = ""
+	} else if claim.Payer == "" {
+		return shim.Error("Expected the payer of the dividends")
+	}
+
+	if err := checkNotMigrated(stub, claim.User); err != nil {
+		return shim.Error(err.Error())
+	}
+	found, err := t.claimable(stub, &claim)
+	if err != nil {
+		return shim.Error("Error getting dividends: " + err.Error())
+	}
+	if !found {
+		return shim.Error("No dividends to claim")
+	}
+	if res := checkSanctions(stub, "claim", Transfer{From: claim.Payer, To: claim.User, Value: claim.Value}); res != nil {
+		return *res
+	}
+	// dividends in this token enter the balance like a mint, the other token
+	// checks its own payouts
+	if claim.Token == "" {
+		if res := t.checkRestrictions(stub, Transfer{To: claim.User, Value: claim.Value}); res != nil {
+			return *res
+		}
+		// the other holders' claims are not read, so they don't conflict with this one
+		dividends := DividendSeries{}
+		if _, err := getJson(stub, IndexDividends, dividendSeries("", ""), &dividends); err != nil {
+			return shim.Error("Error getting dividends")
+		}
+		if claim.Claimed > dividends.Funded {
+			return shim.Error("Claim above the funded dividends")
+		}
+	}
+
+	err = putJson(stub, IndexDividendClaim, append(dividendSeries(claim.Token, claim.Payer), claim.User), claim)
+	if err != nil {
+		return shim.Error("Error saving claim")
+	}
+
+	if claim.Token == "" {
+		userBalance, err := t.balance(stub, claim.User)
+		if err != nil {
+			return shim.Error("Error getting balance")
+		}
+		if userBalance+claim.Value < userBalance {
+			return shim.Error("Receiver balance overflow")
+		}
+		if err := t.setBalance(stub, claim.User, userBalance+claim.Value); err != nil {
+			return shim.Error("Error setting balance")
+		}
+	} else if claim.Value > 0 {
+		transferData, _ := json.Marshal(Transfer{From: claim.Payer, To: claim.User, Value: claim.Value})
+		res := stub.InvokeChaincode(claim.Token, util.ToChaincodeArgs("transferFrom", string(transferData)), "")
+		if res.Status != shim.OK {
+			return shim.Error("Payout failed: " + res.Message)
+		}
+	}
+
+	claimBytes, _ := json.Marshal(claim)
+	stub.SetEvent("DividendsClaimed", claimBytes)
+	return shim.Success(claimBytes)
+}
+
+// what the user would get by claiming, without claiming it
+func (t *TokenChaincode) claimableAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	claim := DividendClaim{}
+	if err := json.Unmarshal([]byte(args[0]), &claim); err != nil {
+		return shim.Error(err.Error())
+	}
+	if claim.Token == "" {
+		claim.Payer = ""
+	}
+	if _, err := t.claimable(stub, &claim); err != nil {
+		return shim.Error("Error getting dividends: " + err.Error())
+	}
+	result, _ := json.Marshal(claim)
+	return shim.Success(result)
+}
+
+// distributions in a token, by a payer if the token is another one
+func (t *TokenChaincode) distributionsAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	rq := Distribution{}
+	if len(args) > 1 {
+		return shim.Error("Expected token and payer to query")
+	}
+	if len(args) == 1 {
+		if err := json.Unmarshal([]byte(args[0]), &rq); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	distributions, err := distributionsAfter(stub, dividendSeries(rq.Token, rq.Payer), 0)
+	if err != nil {
+		return shim.Error("Error getting distributions")
+	}
+	result, _ := json.Marshal(distributions)
+	return shim.Success(result)
+}
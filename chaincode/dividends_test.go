@@ -0,0 +1,263 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+)
+
+// the issuer keeps 500 of the 1000 tokens, alice has 300, bob 100 and the admin 100
+func dividendsLedger(t *testing.T) *mock.FullMockStub {
+	stub := rolesLedger(t)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	for _, transfer := range []string{`{"to": "alice", "value": 300}`, `{"to": "bob", "value": 100}`, `{"to": "admin", "value": 100}`} {
+		if res := stub.MockInvoke(transfer, util.ToChaincodeArgs("transfer", transfer)); res.Status != shim.OK {
+			t.Fatal("Transfer failed: " + res.Message)
+		}
+	}
+	return stub
+}
+
+func distribute(t *testing.T, stub *mock.FullMockStub, distributionData string) Distribution {
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	res := stub.MockInvoke("distribute", util.ToChaincodeArgs("createDistribution", distributionData))
+	if res.Status != shim.OK {
+		t.Fatal("CreateDistribution failed: " + res.Message)
+	}
+	distribution := Distribution{}
+	json.Unmarshal(res.Payload, &distribution)
+	return distribution
+}
+
+func claimDividends(stub *mock.FullMockStub, caller *testca.Identity, claimData string) (DividendClaim, pb.Response) {
+	stub.MockCreator(caller.MspID, caller.CertPEM)
+	res := stub.MockInvoke("claim-"+caller.Cert.Subject.CommonName, util.ToChaincodeArgs("claim", claimData))
+	claim := DividendClaim{}
+	json.Unmarshal(res.Payload, &claim)
+	return claim, res
+}
+
+func TestCreateDistribution(t *testing.T) {
+	stub := dividendsLedger(t)
+	issuer, admin := roleActors["issuer"], roleActors["admin"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("createDistribution", `{"amount": 10}`)); res.Status == shim.OK {
+		t.Error("Expected only admins to create distributions")
+	}
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	for _, invalid := range []string{`{"amount": 0}`, `{"amount": 101}`} {
+		if res := stub.MockInvoke("2", util.ToChaincodeArgs("createDistribution", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected the distribution %s to be rejected", invalid)
+		}
+	}
+
+	// the 100 tokens are shared by the 900 left in the balances
+	distribution := distribute(t, stub, `{"amount": 100}`)
+	if distribution.ID != 1 || distribution.SnapshotID != 1 || distribution.PerUnit != "111111111111111111" || distribution.Dust != 0 {
+		t.Errorf("Unexpected distribution %+v", distribution)
+	}
+	if b, _ := balance(stub, "admin"); b.Value != 0 {
+		t.Errorf("Expected the admin to fund the distribution, got %d left", b.Value)
+	}
+
+	// the fractions of a unit left by the first distribution are owed to the holders, not carried
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("transfer", `{"to": "admin", "value": 49}`))
+	distribution = distribute(t, stub, `{"amount": 49}`)
+	if distribution.ID != 2 || distribution.PerUnit != "57579318448883666" || distribution.Cumulative != "168690429559994777" || distribution.Dust != 0 {
+		t.Errorf("Unexpected distribution %+v", distribution)
+	}
+
+	distributions := []Distribution{}
+	json.Unmarshal(stub.MockInvoke("4", util.ToChaincodeArgs("distributions")).Payload, &distributions)
+	if len(distributions) != 2 || distributions[0].Amount != 100 || distributions[1].Amount != 49 {
+		t.Errorf("Unexpected distributions %+v", distributions)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	stub := dividendsLedger(t)
+	issuer, admin := roleActors["issuer"], roleActors["admin"]
+	alice, bob, carol := recoveryActors["alice"], recoveryActors["bob"], recoveryActors["carol"]
+	distribute(t, stub, `{"amount": 100}`)
+
+	// alice's share is the one of her balance at the snapshot
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 300}`))
+	claimable := DividendClaim{}
+	json.Unmarshal(stub.MockInvoke("2", util.ToChaincodeArgs("claimable", `{"user": "alice"}`)).Payload, &claimable)
+	if claimable.Value != 33 || claimable.LastID != 1 {
+		t.Errorf("Expected alice to be able to claim 33, got %+v", claimable)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 0 {
+		t.Errorf("Expected the query not to pay, got %d", b.Value)
+	}
+	if _, res := claimDividends(stub, alice, `{"user": "bob"}`); res.Status == shim.OK {
+		t.Error("Expected alice not to claim bob's dividends")
+	}
+	if claim, res := claimDividends(stub, alice, `{}`); res.Status != shim.OK || claim.Value != 33 || claim.Remainder != "333333333333333300" {
+		t.Errorf("Unexpected claim %+v (%s)", claim, res.Message)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 33 {
+		t.Errorf("Expected alice to receive 33, got %d", b.Value)
+	}
+	if _, res := claimDividends(stub, alice, `{}`); res.Status == shim.OK {
+		t.Error("Expected no dividends to claim twice")
+	}
+	if claim, res := claimDividends(stub, carol, `{}`); res.Status != shim.OK || claim.Value != 0 {
+		t.Errorf("Expected carol to have no dividends, got %+v (%s)", claim, res.Message)
+	}
+
+	// claims of several distributions keep the rounding remainders of each
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("transfer", `{"to": "admin", "value": 100}`))
+	distribute(t, stub, `{"amount": 100}`)
+	claimed := uint64(33)
+	for _, holder := range []*testca.Identity{issuer, alice, bob, carol, admin} {
+		claim, res := claimDividends(stub, holder, `{}`)
+		if res.Status != shim.OK {
+			t.Fatal("Claim failed: " + res.Message)
+		}
+		claimed += claim.Value
+	}
+	if claimed > 200 || claimed < 197 {
+		t.Errorf("Expected up to 200 tokens to be claimed, and not much less, got %d", claimed)
+	}
+	if b, _ := balance(stub, "bob"); b.Value != 100+11+12 {
+		t.Errorf("Expected bob to receive 23, got %d", b.Value-100)
+	}
+}
+
+func TestClaimWithShieldedTokens(t *testing.T) {
+	stub := dividendsLedger(t)
+	stub.MockCollection(privateCollection, "Org1MSP", "Org2MSP")
+	issuer := roleActors["issuer"]
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+
+	// the issuer's 500 tokens leave the public balances before the distribution
+	if res := privateInvoke(stub, issuer, "privateDeposit", `{"value": 200}`); res.Status != shim.OK {
+		t.Fatal("Private deposit failed: " + res.Message)
+	}
+	if res := confidentialInvoke(stub, "deposit", issuer, "confidentialDeposit", ConfidentialTransfer{Value: 300}); res.Status != shim.OK {
+		t.Fatal("Confidential deposit failed: " + res.Message)
+	}
+	distribute(t, stub, `{"amount": 100}`)
+
+	// the 100 tokens are shared by the 400 public tokens of alice and bob
+	for holder, expected := range map[*testca.Identity]uint64{issuer: 0, alice: 75, bob: 25} {
+		if claim, res := claimDividends(stub, holder, `{}`); res.Status != shim.OK || claim.Value != expected {
+			t.Errorf("Expected %s to claim %d, got %+v (%s)", holder.Cert.Subject.CommonName, expected, claim, res.Message)
+		}
+	}
+}
+
+func TestClaimAfterMigration(t *testing.T) {
+	stub := dividendsLedger(t)
+	alice, alice2 := recoveryActors["alice"], recoveryActors["alice2"]
+	distribute(t, stub, `{"amount": 100}`)
+
+	// alice's unclaimed dividends follow her account
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`))
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	claimable := DividendClaim{}
+	json.Unmarshal(stub.MockInvoke("3", util.ToChaincodeArgs("claimable", `{"user": "alice"}`)).Payload, &claimable)
+	if claimable.Value != 0 || claimable.Remainder != "0" {
+		t.Errorf("Expected nothing left for the old account, got %+v", claimable)
+	}
+	if claim, res := claimDividends(stub, alice2, `{}`); res.Status != shim.OK || claim.Value != 33 || claim.Remainder != "333333333333333300" {
+		t.Errorf("Expected alice2 to claim the 33 of alice, got %+v (%s)", claim, res.Message)
+	}
+	if b, _ := balance(stub, "alice2"); b.Value != 333 {
+		t.Errorf("Expected alice2 to hold 333, got %d", b.Value)
+	}
+}
+
+func TestClaimInOtherToken(t *testing.T) {
+	stub := dividendsLedger(t)
+	issuer, admin, alice := roleActors["issuer"], roleActors["admin"], recoveryActors["alice"]
+	usd := rolesLedger(t)
+	usd.MockCreator(issuer.MspID, issuer.CertPEM)
+	usd.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "admin", "value": 1000}`))
+	stub.MockPeerChaincode("usd", usd, "")
+
+	// the admin pays 500 usd to the 1000 tokens
+	if distribution := distribute(t, stub, `{"amount": 500, "token": "usd"}`); distribution.PerUnit != "500000000000000000" || distribution.Payer != "admin" {
+		t.Errorf("Unexpected distribution %+v", distribution)
+	}
+	if b, _ := balance(stub, "admin"); b.Value != 100 {
+		t.Errorf("Expected the admin's tokens to stay, got %d", b.Value)
+	}
+
+	// the holder claims, the payout being a transfer from the payer, which approves it
+	if _, res := claimDividends(stub, alice, `{"token": "usd"}`); res.Status == shim.OK {
+		t.Error("Expected the payer of the usd dividends")
+	}
+	if _, res := claimDividends(stub, alice, `{"user": "bob", "token": "usd", "payer": "admin"}`); res.Status == shim.OK {
+		t.Error("Expected only the holder to claim its dividends")
+	}
+	unapproved := stub.MockBlock([]mock.Proposal{{TxID: "unapproved", MspID: alice.MspID, Cert: alice.CertPEM,
+		Args: util.ToChaincodeArgs("claim", `{"token": "usd", "payer": "admin"}`)}})
+	if unapproved[0].Valid() {
+		t.Error("Expected the payout to need the payer's approval")
+	}
+	usd.MockCreator(admin.MspID, admin.CertPEM)
+	usd.MockInvoke("2", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 150}`))
+	if claim, res := claimDividends(stub, alice, `{"token": "usd", "payer": "admin"}`); res.Status != shim.OK || claim.Value != 150 {
+		t.Fatalf("Unexpected claim %+v (%s)", claim, res.Message)
+	}
+	aliceUSD, _ := balance(usd, "alice")
+	adminUSD, _ := balance(usd, "admin")
+	if aliceUSD.Value != 150 || adminUSD.Value != 850 {
+		t.Errorf("Expected the admin to pay alice 150 usd, got (%d, %d)", aliceUSD.Value, adminUSD.Value)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 300 {
+		t.Errorf("Expected no payout in the token, got %d", b.Value)
+	}
+}
+
+func TestClaimInBlock(t *testing.T) {
+	stub := dividendsLedger(t)
+	distribute(t, stub, `{"amount": 100}`)
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+
+	// each holder's claim has its own key, a second claim of alice conflicts with the first one
+	claim := func(txID string, holder *testca.Identity) mock.Proposal {
+		return mock.Proposal{TxID: txID, MspID: holder.MspID, Cert: holder.CertPEM, Args: util.ToChaincodeArgs("claim")}
+	}
+	results := stub.MockBlock([]mock.Proposal{claim("tx1", alice), claim("tx2", bob), claim("tx3", alice)})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT)
+	aliceBalance, _ := balance(stub, "alice")
+	bobBalance, _ := balance(stub, "bob")
+	if aliceBalance.Value != 333 || bobBalance.Value != 111 {
+		t.Errorf("Expected alice and bob to be paid once, got (%d, %d)", aliceBalance.Value, bobBalance.Value)
+	}
+	if _, res := claimDividends(stub, alice, `{}`); res.Status == shim.OK {
+		t.Error("Expected alice to have nothing left to claim")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// requires a member of each given MSP to endorse every change of the caller's
+// balance, on top of the chaincode endorsement policy. No MSPs remove the policy
+func (t *TokenChaincode) setEndorsers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetEndorsers expected 1 argument")
+	}
+
+	endorsers := Endorsers{}
+	err := json.Unmarshal([]byte(args[0]), &endorsers)
+	if err != nil {
+		return shim.Error("Error parsing endorsers json")
+	}
+
+	// only the holder sets the policy of its own balance
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if endorsers.User != "" && endorsers.User != caller {
+		return shim.Error("Only the holder can set the endorsers of a balance")
+	}
+
+	key, err := stub.CreateCompositeKey(IndexBalance, []string{caller})
+	if err != nil {
+		return shim.Error("Error creating balance key")
+	}
+
+	var policy []byte
+	if len(endorsers.MSPs) > 0 {
+		ep, _ := statebased.NewStateEP(nil)
+		err = ep.AddOrgs(statebased.RoleTypeMember, endorsers.MSPs...)
+		if err != nil {
+			return shim.Error("Error creating endorsement policy: " + err.Error())
+		}
+		policy, err = ep.Policy()
+		if err != nil {
+			return shim.Error("Error creating endorsement policy: " + err.Error())
+		}
+	}
+
+	// the policy is metadata of the key, which has to exist in the state
+	balanceBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	if balanceBytes == nil {
+		err = t.setBalance(stub, caller, 0)
+		if err != nil {
+			return shim.Error("Error setting balance")
+		}
+	}
+
+	err = stub.SetStateValidationParameter(key, policy)
+	if err != nil {
+		return shim.Error("Error setting endorsement policy")
+	}
+
+	return shim.Success(nil)
+}
+
+// MSPs required to endorse changes of the user's balance
+func (t *TokenChaincode) endorsersAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	endorsersRq := Endorsers{}
+	if err := json.Unmarshal([]byte(args[0]), &endorsersRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(IndexBalance, []string{endorsersRq.User})
+	if err != nil {
+		return shim.Error("Error creating balance key")
+	}
+	policy, err := stub.GetStateValidationParameter(key)
+	if err != nil {
+		return shim.Error("Error getting endorsement policy")
+	}
+
+	endorsers := Endorsers{User: endorsersRq.User, MSPs: []string{}}
+	if policy != nil {
+		ep, err := statebased.NewStateEP(policy)
+		if err != nil {
+			return shim.Error("Error parsing endorsement policy")
+		}
+		endorsers.MSPs = append(endorsers.MSPs, ep.ListOrgs()...)
+	}
+
+	result, _ := json.Marshal(endorsers)
+	return shim.Success(result)
+}
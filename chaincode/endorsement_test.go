@@ -0,0 +1,146 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testdata"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// MSPs listed in the policy stored on the user's balance key
+func balancePolicyOrgs(t *testing.T, stub *mock.FullMockStub, cn string) []string {
+	key, _ := stub.CreateCompositeKey(IndexBalance, []string{cn})
+	policy, err := stub.GetStateValidationParameter(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy == nil {
+		return nil
+	}
+	ep, err := statebased.NewStateEP(policy)
+	if err != nil {
+		t.Fatal("Invalid endorsement policy: " + err.Error())
+	}
+	return ep.ListOrgs()
+}
+
+func queryEndorsers(t *testing.T, stub *mock.FullMockStub, cn string) []string {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("endorsers", `{"user": "`+cn+`"}`))
+	if res.Status != shim.OK {
+		t.Fatal("Endorsers query failed: " + res.Message)
+	}
+	endorsers := Endorsers{}
+	json.Unmarshal(res.Payload, &endorsers)
+	return endorsers.MSPs
+}
+
+func TestSetEndorsers(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setEndorsers", `{"msps": ["Org2MSP", "Org1MSP"]}`))
+	if res.Status != shim.OK {
+		t.Fatal("SetEndorsers failed: " + res.Message)
+	}
+
+	expected := []string{"Org1MSP", "Org2MSP"}
+	if orgs := balancePolicyOrgs(t, stub, testdata.TestUser1CN); !reflect.DeepEqual(orgs, expected) {
+		t.Errorf("Expected the policy to require %v, got %v", expected, orgs)
+	}
+	if orgs := queryEndorsers(t, stub, testdata.TestUser1CN); !reflect.DeepEqual(orgs, expected) {
+		t.Errorf("Expected endorsers %v, got %v", expected, orgs)
+	}
+	if orgs := queryEndorsers(t, stub, testdata.TestUser2CN); len(orgs) != 0 {
+		t.Errorf("Expected no endorsers for a balance without policy, got %v", orgs)
+	}
+
+	// the balance itself is unchanged
+	if b, _ := balance(stub, testdata.TestUser1CN); b.Value != fabricToken.TotalSupply {
+		t.Errorf("Expected the balance to be unchanged, got %d", b.Value)
+	}
+
+	res = stub.MockInvoke("2", util.ToChaincodeArgs("setEndorsers", `{"msps": []}`))
+	if res.Status != shim.OK {
+		t.Fatal("SetEndorsers failed: " + res.Message)
+	}
+	if orgs := balancePolicyOrgs(t, stub, testdata.TestUser1CN); orgs != nil {
+		t.Errorf("Expected the policy to be removed, got %v", orgs)
+	}
+}
+
+func TestSetEndorsersWithoutBalance(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser2Cert)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setEndorsers", `{"user": "testUser2", "msps": ["Org2MSP"]}`))
+	if res.Status != shim.OK {
+		t.Fatal("SetEndorsers failed: " + res.Message)
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexBalance, []string{testdata.TestUser2CN})
+	if stub.State[key] == nil {
+		t.Error("Expected the balance key to be created for the policy")
+	}
+	if orgs := balancePolicyOrgs(t, stub, testdata.TestUser2CN); !reflect.DeepEqual(orgs, []string{"Org2MSP"}) {
+		t.Errorf("Expected the policy to require Org2MSP, got %v", orgs)
+	}
+}
+
+func TestSetEndorsersOfOtherHolder(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser2Cert)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setEndorsers", `{"user": "testUser", "msps": ["Org2MSP"]}`))
+	if res.Status == shim.OK {
+		t.Error("Expected setting the endorsers of another holder to fail")
+	}
+	if orgs := balancePolicyOrgs(t, stub, testdata.TestUser1CN); orgs != nil {
+		t.Errorf("Expected no policy, got %v", orgs)
+	}
+}
+
+func TestSetEndorsersInBlock(t *testing.T) {
+	stub := initToken(t)
+	user := invariantActors[1]
+	stub.MockTime(time.Now())
+
+	// the policy is part of the write set and only set once committed
+	result := stub.MockEndorse(mock.Proposal{
+		TxID:  "tx1",
+		MspID: user.MspID,
+		Cert:  user.CertPEM,
+		Args:  util.ToChaincodeArgs("setEndorsers", `{"msps": ["`+user.MspID+`"]}`),
+	})
+	if !result.Endorsed() || len(result.RWSet.MetadataWrites) != 1 {
+		t.Fatalf("Expected one metadata write, got %v (%s)", result.RWSet.MetadataWrites, result.Response.Message)
+	}
+	if orgs := balancePolicyOrgs(t, stub, "alice"); orgs != nil {
+		t.Errorf("Expected no policy before the commit, got %v", orgs)
+	}
+
+	stub.MockCommit([]*mock.TxResult{result})
+	if orgs := balancePolicyOrgs(t, stub, "alice"); !reflect.DeepEqual(orgs, []string{user.MspID}) {
+		t.Errorf("Expected the policy to require %s, got %v", user.MspID, orgs)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// Fees are deducted from the value of transfers, the receiver getting the
+// net amount. Each fee is kept under a key of its own transaction, as the
+// spending of the velocity limits is, so transfers paying fees don't conflict
+// on the collector's balance; the collector moves them to its balance with
+// collectFees. The admin replaces the fee schedule, every version of which is
+// kept.
+
+const KeyFees = "__fees"
+const IndexFeeVersion = "version~fees"
+const IndexFee = "collector~tx~fee"
+
+const maxBPS = 10000
+
+func feeSchedule(stub shim.ChaincodeStubInterface) (FeeSchedule, error) {
+	schedule := FeeSchedule{}
+	data, err := stub.GetState(KeyFees)
+	if err != nil || data == nil {
+		return schedule, err
+	}
+	err = json.Unmarshal(data, &schedule)
+	return schedule, err
+}
+
+func (schedule FeeSchedule) validate() error {
+	if schedule.BPS > maxBPS {
+		return errors.New("Basis points are at most 10000")
+	}
+	for i, tier := range schedule.Tiers {
+		if tier.BPS > maxBPS {
+			return errors.New("Basis points are at most 10000")
+		}
+		if i > 0 && tier.Min <= schedule.Tiers[i-1].Min {
+			return errors.New("Tiers must be sorted by their increasing minimum")
+		}
+	}
+	charges := schedule.Flat > 0 || schedule.BPS > 0 || len(schedule.Tiers) > 0
+	if charges && schedule.Collector == "" {
+		return errors.New("Expected the fee collector")
+	}
+	return nil
+}
+
+// value * bps / 10000 without overflowing
+func applyBPS(value, bps uint64) uint64 {
+	return value/maxBPS*bps + value%maxBPS*bps/maxBPS
+}
+
+// fee of moving value from one account to another
+func (schedule FeeSchedule) fee(from, to string, value uint64) (uint64, error) {
+	if schedule.Collector == "" || from == schedule.Collector || to == schedule.Collector {
+		return 0, nil
+	}
+	for _, exempt := range schedule.Exempt {
+		if exempt == from || exempt == to {
+			return 0, nil
+		}
+	}
+
+	// the tier with the highest minimum up to the value replaces the base fee
+	flat, bps := schedule.Flat, schedule.BPS
+	for _, tier := range schedule.Tiers {
+		if value >= tier.Min {
+			flat, bps = tier.Flat, tier.BPS
+		}
+	}
+	fee := flat + applyBPS(value, bps)
+	if fee < flat || fee > value {
+		return 0, errors.New("Transfer value does not cover the fee")
+	}
+	return fee, nil
+}
+
+// the transfer with its fee under the current schedule
+func transferFee(stub shim.ChaincodeStubInterface, transfer Transfer) (TransferEvent, error) {
+	event := TransferEvent{Transfer: transfer, Net: transfer.Value}
+	schedule, err := feeSchedule(stub)
+	if err != nil {
+		return event, errors.New("Error getting fee schedule")
+	}
+	event.Fee, err = schedule.fee(transfer.From, transfer.To, transfer.Value)
+	if err != nil {
+		return event, err
+	}
+	if event.Fee > 0 {
+		event.Net -= event.Fee
+		event.FeeVersion, event.Collector = schedule.Version, schedule.Collector
+	}
+	return event, nil
+}
+
+// keeps the fee of the transfer for its collector, if any
+func recordFee(stub shim.ChaincodeStubInterface, event TransferEvent) error {
+	if event.Fee == 0 {
+		return nil
+	}
+	key, err := stub.CreateCompositeKey(IndexFee, []string{event.Collector, stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, event.Fee)
+	return stub.PutState(key, data)
+}
+
+// the fees not collected yet with their keys, of all collectors without one
+func pendingFees(stub shim.ChaincodeStubInterface, collector ...string) (uint64, []string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexFee, collector)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer iterator.Close()
+
+	var fees uint64
+	keys := []string{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(kv.Value) != 8 {
+			return 0, nil, fmt.Errorf("Invalid fee: %q", kv.Key)
+		}
+		fee := binary.LittleEndian.Uint64(kv.Value)
+		if fees+fee < fees {
+			return 0, nil, errors.New("Pending fees overflow")
+		}
+		fees += fee
+		keys = append(keys, kv.Key)
+	}
+	return fees, keys, nil
+}
+
+// the fees of a migrated collector follow its account
+func moveFees(stub shim.ChaincodeStubInterface, from, to string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexFee, []string{from})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 2 {
+			return fmt.Errorf("Invalid fee key: %q", kv.Key)
+		}
+		key, err := stub.CreateCompositeKey(IndexFee, []string{to, parts[1]})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, kv.Value); err != nil {
+			return err
+		}
+		if err := stub.DelState(kv.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// credits the caller with the fees it collected since its last call
+func (t *TokenChaincode) collectFees(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("CollectFees expected no argument")
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	fees, keys, err := pendingFees(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting fees: " + err.Error())
+	}
+	if fees == 0 {
+		return shim.Error("No fees to collect")
+	}
+
+	// the fees enter the caller's balance like a mint
+	collected := Transfer{To: caller, Value: fees}
+	if res := checkSanctions(stub, "collectFees", collected); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, collected); res != nil {
+		return *res
+	}
+	callerBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	if callerBalance+fees < callerBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	if err := t.setBalance(stub, caller, callerBalance+fees); err != nil {
+		return shim.Error("Error setting balance")
+	}
+	for _, key := range keys {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error("Error removing fee")
+		}
+	}
+
+	paidBytes, _ := json.Marshal(Balance{User: caller, Value: fees})
+	stub.SetEvent("FeesCollected", paidBytes)
+	return shim.Success(paidBytes)
+}
+
+// replaces the fee schedule with a new version, callers need the admin role
+func (t *TokenChaincode) setFees(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetFees expected 1 argument")
+	}
+	schedule := FeeSchedule{}
+	err := json.Unmarshal([]byte(args[0]), &schedule)
+	if err != nil {
+		return shim.Error("Error parsing fee schedule json")
+	}
+	if err := schedule.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	current, err := feeSchedule(stub)
+	if err != nil {
+		return shim.Error("Error getting fee schedule")
+	}
+	schedule.Version = current.Version + 1
+	scheduleBytes, _ := json.Marshal(schedule)
+	err = stub.PutState(KeyFees, scheduleBytes)
+	if err != nil {
+		return shim.Error("Error saving fee schedule")
+	}
+	key, err := stub.CreateCompositeKey(IndexFeeVersion, []string{fmt.Sprintf("%020d", schedule.Version)})
+	if err == nil {
+		err = stub.PutState(key, scheduleBytes)
+	}
+	if err != nil {
+		return shim.Error("Error saving fee schedule")
+	}
+
+	stub.SetEvent("FeesUpdated", scheduleBytes)
+	return shim.Success(scheduleBytes)
+}
+
+// the current fee schedule, or the one of the version given as a number
+func (t *TokenChaincode) feesAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Expected the version to query")
+	}
+	if len(args) == 0 {
+		schedule, err := feeSchedule(stub)
+		if err != nil {
+			return shim.Error("Error getting fee schedule")
+		}
+		result, _ := json.Marshal(schedule)
+		return shim.Success(result)
+	}
+
+	version, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return shim.Error("Invalid version: " + args[0])
+	}
+	key, err := stub.CreateCompositeKey(IndexFeeVersion, []string{fmt.Sprintf("%020d", version)})
+	if err != nil {
+		return shim.Error("Error creating fee schedule key")
+	}
+	scheduleBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Error getting fee schedule")
+	}
+	if scheduleBytes == nil {
+		return shim.Error("Unknown fee schedule version: " + args[0])
+	}
+	return shim.Success(scheduleBytes)
+}
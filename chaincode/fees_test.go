@@ -0,0 +1,169 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+)
+
+var treasury = rolesCA.MustIssue("treasury", testca.Options{})
+
+func setFees(t *testing.T, stub *mock.FullMockStub, schedule string) {
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("fees", util.ToChaincodeArgs("setFees", schedule)); res.Status != shim.OK {
+		t.Fatal("SetFees failed: " + res.Message)
+	}
+}
+
+func lastTransfer(stub *mock.FullMockStub) TransferEvent {
+	event := TransferEvent{}
+	json.Unmarshal(stub.Events[len(stub.Events)-1].Payload, &event)
+	return event
+}
+
+func TestSetFees(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setFees", `{"collector": "treasury", "flat": 1}`)); res.Status == shim.OK {
+		t.Error("Expected only admins to set the fees")
+	}
+
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	for _, invalid := range []string{
+		`{"flat": 1}`,
+		`{"collector": "treasury", "bps": 10001}`,
+		`{"collector": "treasury", "tiers": [{"min": 100, "bps": 10}, {"min": 100, "bps": 5}]}`,
+	} {
+		if res := stub.MockInvoke("2", util.ToChaincodeArgs("setFees", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected the schedule %s to be rejected", invalid)
+		}
+	}
+
+	// every schedule is a new version, older ones are kept
+	setFees(t, stub, `{"collector": "treasury", "flat": 1, "version": 42}`)
+	setFees(t, stub, `{"collector": "treasury", "bps": 10}`)
+	current, first := FeeSchedule{}, FeeSchedule{}
+	json.Unmarshal(stub.MockInvoke("3", util.ToChaincodeArgs("fees")).Payload, &current)
+	json.Unmarshal(stub.MockInvoke("4", util.ToChaincodeArgs("fees", "1")).Payload, &first)
+	if current.Version != 2 || current.BPS != 10 || first.Version != 1 || first.Flat != 1 {
+		t.Errorf("Unexpected schedules: %+v, %+v", current, first)
+	}
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("fees", "3")); res.Status == shim.OK {
+		t.Error("Expected no schedule for an unknown version")
+	}
+}
+
+func TestTransferFees(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer, alice := roleActors["issuer"], recoveryActors["alice"]
+	setFees(t, stub, `{"collector": "treasury", "flat": 1, "bps": 100, "exempt": ["bob"],
+		"tiers": [{"min": 500, "bps": 50}]}`)
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	for _, transfer := range []struct {
+		to              string
+		value, fee, net uint64
+	}{
+		{"alice", 100, 2, 98},
+		{"carol", 600, 3, 597},
+		{"bob", 100, 0, 100},
+		{"dave", 1, 1, 0},
+	} {
+		txID := "transfer-" + transfer.to
+		transferData, _ := json.Marshal(Transfer{To: transfer.to, Value: transfer.value})
+		if res := stub.MockInvoke(txID, util.ToChaincodeArgs("transfer", string(transferData))); res.Status != shim.OK {
+			t.Fatal("Transfer failed: " + res.Message)
+		}
+		event := lastTransfer(stub)
+		if event.Value != transfer.value || event.Fee != transfer.fee || event.Net != transfer.net {
+			t.Errorf("Expected %d to %s to have the fee %d, got %+v", transfer.value, transfer.to, transfer.fee, event)
+		}
+		if b, _ := balance(stub, transfer.to); b.Value != transfer.net {
+			t.Errorf("Expected %s to receive %d, got %d", transfer.to, transfer.net, b.Value)
+		}
+	}
+	if event := lastTransfer(stub); event.FeeVersion != 1 || event.Collector != "treasury" {
+		t.Errorf("Expected the event to give the schedule, got %+v", event)
+	}
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "dave", "value": 0}`)); res.Status == shim.OK {
+		t.Error("Expected a transfer not covering the fee to fail")
+	}
+
+	stub.MockInvoke("3", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 50}`))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "carol", "value": 50}`)); res.Status != shim.OK {
+		t.Fatal("TransferFrom failed: " + res.Message)
+	}
+	if event := lastTransfer(stub); event.Fee != 1 || event.Net != 49 {
+		t.Errorf("Unexpected transferFrom fee: %+v", event)
+	}
+	if allowances, _ := allAllowances(stub, "issuer"); len(allowances) != 1 || allowances[0].Value != 0 {
+		t.Errorf("Expected the gross value to be spent from the allowance, got %+v", allowances)
+	}
+
+	// the collector moves the fees to its balance
+	if b, _ := balance(stub, "treasury"); b.Value != 0 {
+		t.Errorf("Expected the fees to wait for the collector, got %d", b.Value)
+	}
+	stub.MockCreator(treasury.MspID, treasury.CertPEM)
+	collected := Balance{}
+	res := stub.MockInvoke("5", util.ToChaincodeArgs("collectFees"))
+	json.Unmarshal(res.Payload, &collected)
+	if res.Status != shim.OK || collected.Value != 7 {
+		t.Fatalf("Expected the collector to collect the 7 fees, got %d (%s)", collected.Value, res.Message)
+	}
+	if b, _ := balance(stub, "treasury"); b.Value != 7 {
+		t.Errorf("Expected the collector to hold the 7 fees, got %d", b.Value)
+	}
+	if res := stub.MockInvoke("6", util.ToChaincodeArgs("collectFees")); res.Status == shim.OK {
+		t.Error("Expected the fees to be collected once")
+	}
+	if res := stub.MockInvoke("7", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 7}`)); res.Status != shim.OK || lastTransfer(stub).Fee != 0 {
+		t.Error("Expected the collector to transfer without fee")
+	}
+}
+
+func TestTransferFeesInBlock(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer := roleActors["issuer"]
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 100}`))
+	setFees(t, stub, `{"collector": "treasury", "flat": 1}`)
+
+	// each fee has a key of its transaction, so transfers paying fees don't conflict
+	results := stub.MockBlock([]mock.Proposal{
+		transferProposal("tx1", alice, `{"to": "carol", "value": 10}`),
+		transferProposal("tx2", bob, `{"to": "dave", "value": 10}`),
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_VALID)
+	stub.MockCreator(treasury.MspID, treasury.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("collectFees"))
+	if b, _ := balance(stub, "treasury"); b.Value != 2 {
+		t.Errorf("Expected the fees of both transfers, got %d", b.Value)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/mock"
+	"reflect"
+	"testing"
+)
+
+// Run with: go test -run XXX -fuzz FuzzInvoke
+// Panics fail the fuzz target, as do broken ledger invariants.
+
+// a ledger where the issuer holds the supply and allowed alice to spend some of it
+func fuzzLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+
+	tokenBytes, _ := json.Marshal(Token{Name: "FuzzToken", Symbol: "FZ", TotalSupply: invariantSupply})
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", string(tokenBytes))); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	approveData := `{"spender": "alice", "value": 100}`
+	if res := stub.MockInvoke("approve", util.ToChaincodeArgs("approve", approveData)); res.Status != shim.OK {
+		t.Fatal("Approve failed: " + res.Message)
+	}
+	return stub
+}
+
+func FuzzInvoke(f *testing.F) {
+	f.Add(uint8(0), "info", uint8(0), "", "")
+	f.Add(uint8(0), "transfer", uint8(1), `{"to": "bob", "value": 10}`, "")
+	f.Add(uint8(0), "transfer", uint8(1), `{"to": "issuer", "value": 18446744073709551615}`, "")
+	f.Add(uint8(1), "transfer", uint8(1), `{"to": "bob\u0000", "value": 0}`, "")
+	f.Add(uint8(0), "approve", uint8(1), `{"spender": "bob", "value": 5}`, "")
+	f.Add(uint8(1), "transferFrom", uint8(1), `{"from": "issuer", "to": "carol", "value": 50}`, "")
+	f.Add(uint8(1), "transferFrom", uint8(2), `{"from": "issuer"}`, `{}`)
+	f.Add(uint8(2), "balance", uint8(1), `{"user": "issuer"}`, "")
+	f.Add(uint8(2), "balance", uint8(1), `[]`, "")
+	f.Add(uint8(3), "allowances", uint8(1), `{"user": "issuer"}`, "")
+	f.Add(uint8(3), "allowances", uint8(0), "", "")
+	f.Add(uint8(4), "", uint8(2), "null", "null")
+
+	f.Fuzz(func(t *testing.T, caller uint8, function string, nargs uint8, arg1, arg2 string) {
+		stub := fuzzLedger(t)
+		id := invariantActors[int(caller)%len(invariantActors)]
+		stub.MockCreator(id.MspID, id.CertPEM)
+
+		args := []string{function, arg1, arg2}[:1+nargs%3]
+		before, err := readAmounts(stub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stateBefore := len(stub.State)
+
+		res := stub.MockInvoke("fuzz", util.ToChaincodeArgs(args...))
+
+		after, err := readAmounts(stub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != shim.OK && (len(stub.State) != stateBefore || !reflect.DeepEqual(before, after)) {
+			t.Fatalf("Failed call changed the state: %s", res.Message)
+		}
+		if err := checkSupply(after); err != nil {
+			t.Fatal(err)
+		}
+
+		// a successful call parsed its argument the same way
+		transfer, approve := Transfer{}, Approve{}
+		json.Unmarshal([]byte(arg1), &transfer)
+		json.Unmarshal([]byte(arg1), &approve)
+		to, value := transfer.To, transfer.Value
+		if function == "approve" {
+			to, value = approve.Spender, approve.Value
+		}
+		cn := id.Cert.Subject.CommonName
+		if err := checkAllowances(function, cn, transfer.From, to, value, res.Status == shim.OK, before, after); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzInit(f *testing.F) {
+	f.Add(`{"name": "FuzzToken", "symbol": "FZ", "decimals": 2, "totalSupply": 1000}`)
+	f.Add(`{"totalSupply": -1}`)
+	f.Add(`{"decimals": 65536}`)
+	f.Add(`null`)
+	f.Add(``)
+
+	f.Fuzz(func(t *testing.T, tokenJson string) {
+		stub := mock.NewFullMockStub("token", &TokenChaincode{})
+		issuer := invariantActors[0]
+		stub.MockCreator(issuer.MspID, issuer.CertPEM)
+
+		res := stub.MockInit("init", util.ToChaincodeArgs("init", tokenJson))
+		if res.Status != shim.OK {
+			return
+		}
+
+		token := Token{}
+		json.Unmarshal([]byte(tokenJson), &token)
+		b, err := balance(stub, issuer.Cert.Subject.CommonName)
+		if err != nil || b.Value != token.TotalSupply {
+			t.Fatalf("Expected the issuer to hold the total supply %d, got %d", token.TotalSupply, b.Value)
+		}
+	})
+}
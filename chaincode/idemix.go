@@ -0,0 +1,99 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"strings"
+)
+
+// Idemix callers do not reveal who they are. Their account is either their
+// pseudonym, or the organizational unit they reveal, shared by all its members,
+// depending on Token.IdemixAccounts. The account names have reserved prefixes
+// so they cannot be taken by the CN of an X.509 caller.
+
+const IdemixAccountsNym = "nym"
+const IdemixAccountsOU = "ou"
+
+const prefixNym = "nym:"
+const prefixOU = "ou:"
+
+// functions reserved to callers with an X.509 identity, on top of Init:
+// endorsement policies and private collections are bound to known organisations
+var x509Functions = map[string]bool{
+	"setEndorsers":    true,
+	"privateDeposit":  true,
+	"privateWithdraw": true,
+	"privateTransfer": true,
+	"privateMigrate":  true,
+}
+
+func isX509(idBytes []byte) bool {
+	block, _ := pem.Decode(idBytes)
+	return block != nil
+}
+
+func isIdemixAccount(account string) bool {
+	return strings.HasPrefix(account, prefixNym) || strings.HasPrefix(account, prefixOU)
+}
+
+func validIdemixAccounts(accounts string) bool {
+	return accounts == "" || accounts == IdemixAccountsNym || accounts == IdemixAccountsOU
+}
+
+// fails unless the caller has an X.509 identity
+func requireX509(stub shim.ChaincodeStubInterface) error {
+	serializedId, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if !isX509(serializedId.IdBytes) {
+		return errors.New("Anonymous callers are not allowed")
+	}
+	return nil
+}
+
+func idemixAccount(stub shim.ChaincodeStubInterface, serializedId msp.SerializedIdentity) (string, error) {
+	idemixId := msp.SerializedIdemixIdentity{}
+	err := proto.Unmarshal(serializedId.IdBytes, &idemixId)
+	if err != nil || len(idemixId.NymX) == 0 || len(idemixId.NymY) == 0 {
+		return "", errors.New("Creator is neither an X.509 nor an Idemix identity")
+	}
+
+	token, err := tokenData(stub)
+	if err != nil {
+		return "", errors.New("Error getting token data")
+	}
+
+	if token.IdemixAccounts == IdemixAccountsOU {
+		ou := msp.OrganizationUnit{}
+		err = proto.Unmarshal(idemixId.Ou, &ou)
+		if err != nil || ou.OrganizationalUnitIdentifier == "" {
+			return "", errors.New("Idemix identity does not reveal its organizational unit")
+		}
+		return prefixOU + serializedId.Mspid + "/" + ou.OrganizationalUnitIdentifier, nil
+	}
+
+	nym := sha256.Sum256(append(append([]byte{}, idemixId.NymX...), idemixId.NymY...))
+	return prefixNym + hex.EncodeToString(nym[:]), nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+)
+
+func nymAccount(id *testca.IdemixIdentity) string {
+	nym := sha256.Sum256(append(append([]byte{}, id.NymX...), id.NymY...))
+	return "nym:" + hex.EncodeToString(nym[:])
+}
+
+// the issuer holds 1000 tokens, Idemix accounts are set by the token data
+func idemixLedger(t *testing.T, idemixAccounts string) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	res := stub.MockInit("init", util.ToChaincodeArgs("init", `{"totalSupply": 1000, "idemixAccounts": "`+idemixAccounts+`"}`))
+	if res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	return stub
+}
+
+func idemixInvoke(stub *mock.FullMockStub, caller *testca.IdemixIdentity, function, arg string) pb.Response {
+	stub.MockCreator(caller.MspID, string(caller.IdBytes))
+	return stub.MockInvoke("1", util.ToChaincodeArgs(function, arg))
+}
+
+func TestIdemixPseudonymousTransfers(t *testing.T) {
+	stub := idemixLedger(t, "")
+	anon1 := testca.MustNewIdemix("IdemixMSP", "bank")
+	anon2 := testca.MustNewIdemix("IdemixMSP", "bank")
+
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "`+nymAccount(anon1)+`", "value": 100}`))
+	if res := idemixInvoke(stub, anon1, "transfer", `{"to": "`+nymAccount(anon2)+`", "value": 40}`); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if res := idemixInvoke(stub, anon2, "transfer", `{"to": "`+nymAccount(anon1)+`", "value": 41}`); res.Status == shim.OK {
+		t.Error("Expected a transfer above the balance of the pseudonym to fail")
+	}
+
+	balance1, _ := balance(stub, nymAccount(anon1))
+	balance2, _ := balance(stub, nymAccount(anon2))
+	if balance1.Value != 60 || balance2.Value != 40 {
+		t.Errorf("Expected the pseudonyms to hold 60 and 40, got (%d, %d)", balance1.Value, balance2.Value)
+	}
+}
+
+func TestIdemixOrganizationalUnitAccounts(t *testing.T) {
+	stub := idemixLedger(t, "ou")
+	teller1 := testca.MustNewIdemix("IdemixMSP", "branch1")
+	teller2 := testca.MustNewIdemix("IdemixMSP", "branch1")
+
+	// both tellers spend from the account of their branch
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "ou:IdemixMSP/branch1", "value": 100}`))
+	if res := idemixInvoke(stub, teller1, "transfer", `{"to": "ou:IdemixMSP/branch2", "value": 30}`); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if res := idemixInvoke(stub, teller2, "transfer", `{"to": "ou:IdemixMSP/branch2", "value": 30}`); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+
+	branch1, _ := balance(stub, "ou:IdemixMSP/branch1")
+	branch2, _ := balance(stub, "ou:IdemixMSP/branch2")
+	if branch1.Value != 40 || branch2.Value != 60 {
+		t.Errorf("Expected the branches to hold 40 and 60, got (%d, %d)", branch1.Value, branch2.Value)
+	}
+}
+
+func TestIdemixX509OnlyFunctions(t *testing.T) {
+	stub := idemixLedger(t, "")
+	anon := testca.MustNewIdemix("IdemixMSP", "bank")
+
+	for function, arg := range map[string]string{
+		"setEndorsers":    `{"msps": ["IdemixMSP"]}`,
+		"privateTransfer": privateCollection,
+	} {
+		if res := idemixInvoke(stub, anon, function, arg); res.Status == shim.OK {
+			t.Errorf("Expected %s to require an X.509 identity", function)
+		}
+	}
+
+	// approvals are allowed
+	if res := idemixInvoke(stub, anon, "approve", `{"spender": "issuer", "value": 10}`); res.Status != shim.OK {
+		t.Error("Expected an anonymous caller to approve: " + res.Message)
+	}
+
+	other := mock.NewFullMockStub("token", &TokenChaincode{})
+	other.MockCreator(anon.MspID, string(anon.IdBytes))
+	if res := other.MockInit("init", util.ToChaincodeArgs("init", `{"totalSupply": 1000}`)); res.Status == shim.OK {
+		t.Error("Expected Init to require an X.509 identity")
+	}
+}
+
+func TestX509CannotTakeIdemixAccounts(t *testing.T) {
+	stub := idemixLedger(t, "")
+	anon := testca.MustNewIdemix("IdemixMSP", "bank")
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "`+nymAccount(anon)+`", "value": 100}`))
+
+	impostor := testca.MustNew("Org1MSP").MustIssue(nymAccount(anon), testca.Options{})
+	stub.MockCreator(impostor.MspID, impostor.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "impostor", "value": 100}`)); res.Status == shim.OK {
+		t.Error("Expected a CN with the prefix of Idemix accounts to be rejected")
+	}
+}
+
+func TestInitWithInvalidIdemixAccounts(t *testing.T) {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", `{"idemixAccounts": "enrollmentId"}`)); res.Status == shim.OK {
+		t.Error("Expected unknown Idemix accounts to be rejected")
+	}
+}
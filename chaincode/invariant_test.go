@@ -0,0 +1,519 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/confidential"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"math/big"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var invariantSeed = flag.Int64("invariant.seed", defaultInvariantSeed(), "seed of the ledger invariant test, 0 for a random one (default $INVARIANT_SEED or a fixed one)")
+var invariantRuns = flag.Int("invariant.runs", 200, "number of random call sequences checked by the ledger invariant test")
+
+const invariantSupply = 1000
+
+// the collection of the private deposits, shared by the callers' MSP
+const invariantCollection = "invariant"
+
+// the same calls on every run, unless another seed is given
+func defaultInvariantSeed() int64 {
+	if seed, err := strconv.ParseInt(os.Getenv("INVARIANT_SEED"), 10, 64); err == nil {
+		return seed
+	}
+	return 1017
+}
+
+// the issuer is the admin and minter of the invariant token
+var invariantRoles = map[string][]RoleRule{
+	RoleAdmin:  {{Attr: "token.issuer"}},
+	RoleMinter: {{Attr: "token.issuer"}},
+}
+
+// random callers, the first one initializes the token
+var invariantActors = func() []*testca.Identity {
+	ca := testca.MustNew("default")
+	actors := []*testca.Identity{ca.MustIssue("issuer", testca.Options{Attrs: map[string]string{"token.issuer": "true"}})}
+	for _, cn := range []string{"alice", "bob", "carol", "dave"} {
+		actors = append(actors, ca.MustIssue(cn, testca.Options{}))
+	}
+	return actors
+}()
+
+// a generated call, new entry points get a new kind here and a case in args
+type invariantOp struct {
+	// transaction ID, kept when shrinking the sequence
+	ID     int
+	Kind   string
+	Caller int
+	From   int
+	To     int
+	Value  uint64
+	// ID of the call whose stake is unstaked
+	Stake int
+}
+
+func (op invariantOp) cn(i int) string {
+	return invariantActors[i].Cert.Subject.CommonName
+}
+
+func (op invariantOp) String() string {
+	return fmt.Sprintf("%s by %s: from=%s to=%s value=%d stake=%d", op.Kind, op.cn(op.Caller), op.cn(op.From), op.cn(op.To), op.Value, op.Stake)
+}
+
+func (op invariantOp) args() [][]byte {
+	var arg interface{}
+	switch op.Kind {
+	case "transfer":
+		arg = Transfer{To: op.cn(op.To), Value: op.Value}
+	case "approve":
+		arg = Approve{Spender: op.cn(op.To), Value: op.Value}
+	case "transferFrom":
+		arg = Transfer{From: op.cn(op.From), To: op.cn(op.To), Value: op.Value}
+	case "mint":
+		arg = Transfer{To: op.cn(op.To), Value: op.Value}
+	case "burn":
+		arg = Transfer{Value: op.Value}
+	case "privateDeposit", "privateWithdraw":
+		// the amount is in the transient data
+		return util.ToChaincodeArgs(op.Kind, invariantCollection)
+	case "confidentialDeposit":
+		arg = ConfidentialTransfer{Value: op.Value}
+	case "setFees":
+		// fees of the transfers that follow, kept for a random collector
+		arg = FeeSchedule{Collector: op.cn(op.To), Flat: op.Value % 10, BPS: op.Value % 1000, Exempt: []string{op.cn(op.From)}}
+	case "stake":
+		arg = Stake{Amount: op.Value}
+	case "unstake":
+		arg = Stake{ID: fmt.Sprint(op.Stake)}
+	case "setStakingRewards":
+		arg = StakingRewards{Rate: op.Value % 5, Fund: op.Value}
+	case "claimRewards", "claim":
+		arg = struct{}{}
+	case "collectFees":
+		return util.ToChaincodeArgs(op.Kind)
+	case "createDistribution":
+		arg = Distribution{Amount: op.Value}
+	}
+	argBytes, _ := json.Marshal(arg)
+	return util.ToChaincodeArgs(op.Kind, string(argBytes))
+}
+
+func (op invariantOp) transient() map[string][]byte {
+	if op.Kind != "privateDeposit" && op.Kind != "privateWithdraw" {
+		return nil
+	}
+	transferBytes, _ := json.Marshal(Transfer{Value: op.Value})
+	return map[string][]byte{TransientTransfer: transferBytes}
+}
+
+// withdraws from a confidential balance of deposits only, whose blinding is 0;
+// the change of a withdrawal above the balance would be negative, so it has no
+// range proof
+func (op invariantOp) confidentialWithdrawal(balance uint64) [][]byte {
+	change := confidential.Opening{Value: balance - op.Value}
+	transfer := ConfidentialTransfer{Value: op.Value, Change: change.Commitment()}
+	if op.Value <= balance {
+		transfer.ChangeProof, _ = confidential.ProveRange(change)
+	}
+	transferBytes, _ := json.Marshal(transfer)
+	return util.ToChaincodeArgs(op.Kind, string(transferBytes))
+}
+
+func randomValue(r *rand.Rand) uint64 {
+	switch r.Intn(10) {
+	case 0:
+		return 0
+	case 1:
+		// overflow candidates
+		return ^uint64(0) - uint64(r.Intn(invariantSupply))
+	case 2, 3:
+		return uint64(r.Intn(invariantSupply + 1))
+	}
+	return uint64(r.Intn(invariantSupply / 10))
+}
+
+func randomOps(r *rand.Rand, n int) []invariantOp {
+	kinds := []string{
+		"transfer", "approve", "transferFrom", "mint", "burn", "setFees", "collectFees", "stake", "unstake",
+		"setStakingRewards", "claimRewards", "createDistribution", "claim",
+		"privateDeposit", "privateWithdraw", "confidentialDeposit", "confidentialWithdraw",
+	}
+	ops := make([]invariantOp, n)
+	stakes := []int{}
+	collector := -1
+	for i := range ops {
+		ops[i] = invariantOp{
+			ID:     i,
+			Kind:   kinds[r.Intn(len(kinds))],
+			Caller: r.Intn(len(invariantActors)),
+			From:   r.Intn(len(invariantActors)),
+			To:     r.Intn(len(invariantActors)),
+			Value:  randomValue(r),
+		}
+		// unstaking an earlier stake, by its staker
+		if ops[i].Kind == "unstake" && len(stakes) > 0 {
+			j := stakes[r.Intn(len(stakes))]
+			ops[i].Caller, ops[i].Stake = ops[j].Caller, j
+		}
+		if ops[i].Kind == "stake" {
+			stakes = append(stakes, i)
+		}
+		// collecting the fees, by the last collector
+		if ops[i].Kind == "collectFees" && collector >= 0 {
+			ops[i].Caller = collector
+		}
+		if ops[i].Kind == "setFees" {
+			collector = ops[i].To
+		}
+	}
+	return ops
+}
+
+// balances, allowances and the tokens out of the balances, read straight from the ledger state
+type ledgerAmounts struct {
+	supply     uint64
+	balances   map[string]uint64
+	allowances map[string]uint64
+	// distributed and not claimed dividends, staked tokens, the staking pool and rewards,
+	// fees not collected, and the private and confidential balances
+	pools map[string]uint64
+	// confidential balances, adding up the deposits and withdrawals
+	confidential map[string]uint64
+	// the public counts of the private and confidential tokens
+	shielded map[string]uint64
+}
+
+func readAmounts(stub *mock.FullMockStub) (ledgerAmounts, error) {
+	amounts := ledgerAmounts{
+		balances:     map[string]uint64{},
+		allowances:   map[string]uint64{},
+		pools:        map[string]uint64{},
+		confidential: map[string]uint64{},
+		shielded:     map[string]uint64{},
+	}
+
+	token := Token{}
+	if err := json.Unmarshal(stub.State[KeyToken], &token); err != nil {
+		return amounts, fmt.Errorf("Error reading token data: %s", err)
+	}
+	amounts.supply = token.TotalSupply
+	if data := stub.State[KeyStaking]; data != nil {
+		staking := Staking{}
+		if err := json.Unmarshal(data, &staking); err != nil {
+			return amounts, fmt.Errorf("Error reading staking state: %s", err)
+		}
+		amounts.pools["staked"] = staking.TotalStaked
+		amounts.pools["staking pool"] = staking.Pool
+		amounts.pools["staking rewards"] = staking.Rewards
+	}
+	for name, key := range map[string]string{"private": KeyPrivateSupply, "confidential": KeyConfidentialSupply} {
+		if data := stub.State[key]; data != nil {
+			amounts.shielded[name] = binary.LittleEndian.Uint64(data)
+		}
+	}
+
+	// the private balances are only readable through the chaincode
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	for _, actor := range invariantActors {
+		cn := actor.Cert.Subject.CommonName
+		res := stub.MockInvoke("privateBalance", util.ToChaincodeArgs("privateBalance", invariantCollection, `{"user": "`+cn+`"}`))
+		b := Balance{}
+		if err := json.Unmarshal(res.Payload, &b); err != nil {
+			return amounts, fmt.Errorf("Error reading the private balance of %s: %s", cn, res.Message)
+		}
+		amounts.pools["private"] += b.Value
+	}
+
+	commitments := map[string][]byte{}
+	var funded, claimed uint64
+
+	for key, value := range stub.State {
+		// composite keys start with the namespace byte, the others are single records
+		if !strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		index, parts, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return amounts, err
+		}
+		if (index == IndexBalance || index == IndexAllowance || index == IndexFee) && len(value) != 8 {
+			return amounts, fmt.Errorf("Value of %q is %d bytes long", key, len(value))
+		}
+		switch index {
+		case IndexBalance:
+			amounts.balances[parts[0]] = binary.LittleEndian.Uint64(value)
+		case IndexAllowance:
+			amounts.allowances[parts[0]+"/"+parts[1]] = binary.LittleEndian.Uint64(value)
+		case IndexDividends:
+			dividends := DividendSeries{}
+			if err := json.Unmarshal(value, &dividends); err != nil {
+				return amounts, fmt.Errorf("Error reading dividends: %s", err)
+			}
+			if parts[0] == "" {
+				funded = dividends.Funded
+			}
+		case IndexDividendClaim:
+			claim := DividendClaim{}
+			if err := json.Unmarshal(value, &claim); err != nil {
+				return amounts, fmt.Errorf("Error reading dividend claim: %s", err)
+			}
+			if parts[0] == "" {
+				claimed += claim.Claimed
+			}
+		case IndexFee:
+			amounts.pools["fees"] += binary.LittleEndian.Uint64(value)
+		case IndexConfidential:
+			commitments[parts[0]] = value
+		case IndexConfidentialTransfer:
+			record := ConfidentialTransfer{}
+			if err := json.Unmarshal(value, &record); err != nil {
+				return amounts, fmt.Errorf("Error reading confidential transfer: %s", err)
+			}
+			switch record.Kind {
+			case "deposit":
+				amounts.confidential[record.To] += record.Value
+			case "withdraw":
+				amounts.confidential[record.From] -= record.Value
+			default:
+				return amounts, fmt.Errorf("Unexpected confidential %s", record.Kind)
+			}
+		}
+	}
+
+	if claimed > funded {
+		return amounts, fmt.Errorf("Dividends claimed %d above the funded %d", claimed, funded)
+	}
+	amounts.pools["dividends"] = funded - claimed
+
+	// the commitments open to what was deposited and not withdrawn
+	for user, value := range amounts.confidential {
+		if !confidential.Commit(value, new(big.Int)).Equal(mustParseCommitment(commitments[user])) {
+			return amounts, fmt.Errorf("Confidential balance of %s is not %d", user, value)
+		}
+		amounts.pools["confidential"] += value
+	}
+	return amounts, nil
+}
+
+func mustParseCommitment(data []byte) *confidential.Commitment {
+	commitment, err := confidential.ParseCommitment(data)
+	if err != nil {
+		return confidential.Commit(0, new(big.Int))
+	}
+	return commitment
+}
+
+// checks the ledger invariants after op moved the state from before to after
+func checkInvariants(op invariantOp, ok bool, before, after ledgerAmounts) error {
+	if err := checkSupply(after); err != nil {
+		return err
+	}
+	expected := before.supply
+	switch {
+	case ok && op.Kind == "mint":
+		expected += op.Value
+	case ok && op.Kind == "burn":
+		expected -= op.Value
+	}
+	if after.supply != expected {
+		return fmt.Errorf("Total supply changed from %d to %d", before.supply, after.supply)
+	}
+	for _, name := range []string{"private", "confidential"} {
+		if after.shielded[name] != after.pools[name] {
+			return fmt.Errorf("Count of the %s tokens is %d, they add up to %d", name, after.shielded[name], after.pools[name])
+		}
+	}
+	return checkAllowances(op.Kind, op.cn(op.Caller), op.cn(op.From), op.cn(op.To), op.Value, ok, before, after)
+}
+
+// the balances and the pools add up to the total supply, none of them underflowed
+func checkSupply(amounts ledgerAmounts) error {
+	var sum uint64
+	for user, value := range amounts.balances {
+		if value > amounts.supply {
+			return fmt.Errorf("Balance of %s underflowed to %d", user, value)
+		}
+		sum += value
+	}
+	for pool, value := range amounts.pools {
+		if value > amounts.supply {
+			return fmt.Errorf("Pool of the %s underflowed to %d", pool, value)
+		}
+		sum += value
+	}
+	if sum != amounts.supply {
+		return fmt.Errorf("Sum of balances and pools is %d, expected the total supply %d", sum, amounts.supply)
+	}
+	return nil
+}
+
+// allowances only change when approved, or decrease by what was spent;
+// to is the spender of an approve call
+func checkAllowances(kind, caller, from, to string, value uint64, ok bool, before, after ledgerAmounts) error {
+	// tokens taken from the owner by a successful transferFrom, fees included
+	var spent uint64
+	if ok && kind == "transferFrom" && from != to {
+		spent = value
+	}
+
+	keys := map[string]bool{}
+	for key := range before.allowances {
+		keys[key] = true
+	}
+	for key := range after.allowances {
+		keys[key] = true
+	}
+	for key := range keys {
+		oldValue, newValue := before.allowances[key], after.allowances[key]
+		switch {
+		case oldValue == newValue:
+		case ok && kind == "approve" && key == caller+"/"+to && newValue == value:
+		case ok && kind == "transferFrom" && key == from+"/"+caller && oldValue-newValue == spent && newValue < oldValue:
+		default:
+			return fmt.Errorf("Allowance %s changed from %d to %d", key, oldValue, newValue)
+		}
+	}
+
+	return nil
+}
+
+// runs the calls on a fresh ledger, returning the first broken invariant
+func runOps(ops []invariantOp) (int, error) {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	stub.MockCollection(invariantCollection, "default")
+	issuer := invariantActors[0]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	// a fixed time within the certificates' validity, so shrinking replays the same calls
+	stub.MockTime(issuer.Cert.NotBefore.Add(time.Hour))
+	tokenBytes, _ := json.Marshal(Token{Name: "InvariantToken", Symbol: "IT", TotalSupply: invariantSupply, Roles: invariantRoles})
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", string(tokenBytes))); res.Status != shim.OK {
+		return -1, fmt.Errorf("Init failed: %s", res.Message)
+	}
+
+	before, err := readAmounts(stub)
+	if err != nil {
+		return -1, err
+	}
+
+	for i, op := range ops {
+		caller := invariantActors[op.Caller]
+		stub.MockCreator(caller.MspID, caller.CertPEM)
+		// staking rewards accrue between the calls
+		stub.MockTimeAdvance(time.Minute)
+		args := op.args()
+		if op.Kind == "confidentialWithdraw" {
+			args = op.confidentialWithdrawal(before.confidential[op.cn(op.Caller)])
+		}
+		stub.MockTransient(op.transient())
+		res := stub.MockInvoke(fmt.Sprint(op.ID), args)
+		stub.MockTransient(nil)
+
+		after, err := readAmounts(stub)
+		if err == nil {
+			err = checkInvariants(op, res.Status == shim.OK, before, after)
+		}
+		if err != nil {
+			return i, err
+		}
+		before = after
+	}
+	return -1, nil
+}
+
+// reduces a failing call sequence to a minimal one still failing
+func shrinkOps(ops []invariantOp) []invariantOp {
+	fails := func(candidate []invariantOp) bool {
+		_, err := runOps(candidate)
+		return err != nil
+	}
+
+	// calls after the failing one are not needed
+	if i, _ := runOps(ops); i >= 0 {
+		ops = ops[:i+1]
+	}
+
+	// drop chunks of calls, halving the chunk size down to single calls
+	for size := len(ops) / 2; size >= 1; size /= 2 {
+		for start := 0; start+size <= len(ops); {
+			candidate := append(append([]invariantOp{}, ops[:start]...), ops[start+size:]...)
+			if fails(candidate) {
+				ops = candidate
+			} else {
+				start++
+			}
+		}
+	}
+
+	// make the values as small as possible
+	for i := range ops {
+		for _, value := range []uint64{0, 1, ops[i].Value / 2} {
+			if value >= ops[i].Value {
+				continue
+			}
+			candidate := append([]invariantOp{}, ops...)
+			candidate[i].Value = value
+			if fails(candidate) {
+				ops = candidate
+			}
+		}
+	}
+
+	return ops
+}
+
+func TestLedgerInvariants(t *testing.T) {
+	seed := *invariantSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	runs := *invariantRuns
+	if testing.Short() {
+		runs = 20
+	}
+
+	for run := 0; run < runs; run++ {
+		ops := randomOps(r, 1+r.Intn(40))
+		if _, err := runOps(ops); err == nil {
+			continue
+		}
+
+		minimal := shrinkOps(ops)
+		_, err := runOps(minimal)
+		steps := []string{}
+		for _, op := range minimal {
+			steps = append(steps, "  "+op.String())
+		}
+		t.Fatalf("Invariant broken (-invariant.seed=%d): %s\nMinimal sequence:\n%s", seed, err, strings.Join(steps, "\n"))
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"strconv"
+	"testing"
+)
+
+// escrow keeps the tokens deposited by its callers in the "escrow" account
+type escrowChaincode struct {
+	channel string
+}
+
+func (cc *escrowChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *escrowChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function != "deposit" || len(args) != 1 {
+		return shim.Error("Invalid invoke function name")
+	}
+	value, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return shim.Error("Error parsing value")
+	}
+
+	// the token sees the creator of the transaction as the sender
+	transferData := fmt.Sprintf(`{"to": "escrow", "value": %d}`, value)
+	res := stub.InvokeChaincode("token", util.ToChaincodeArgs("transfer", transferData), cc.channel)
+	if res.Status != shim.OK {
+		return shim.Error("Deposit failed: " + res.Message)
+	}
+
+	cn, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller")
+	}
+	deposit := make([]byte, 8)
+	deposited, _ := stub.GetState(cn)
+	if len(deposited) == 8 {
+		value += binary.LittleEndian.Uint64(deposited)
+	}
+	binary.LittleEndian.PutUint64(deposit, value)
+	stub.PutState(cn, deposit)
+	stub.SetEvent("Deposit", deposit)
+
+	return shim.Success(nil)
+}
+
+// alice holds 100 tokens, escrow can call the token on the same channel
+func escrowLedger(t *testing.T, channel string) (token, escrow *mock.FullMockStub) {
+	token, _ = blockLedger(t)
+	escrow = mock.NewFullMockStub("escrow", &escrowChaincode{channel: channel})
+	escrow.MockPeerChaincode("token", token, channel)
+	return token, escrow
+}
+
+func deposited(escrow *mock.FullMockStub, cn string) uint64 {
+	if value := escrow.State[cn]; len(value) == 8 {
+		return binary.LittleEndian.Uint64(value)
+	}
+	return 0
+}
+
+func TestInvokeChaincodeAsCaller(t *testing.T) {
+	token, escrow := escrowLedger(t, "")
+	alice := invariantActors[1]
+	escrow.MockCreator(alice.MspID, alice.CertPEM)
+
+	tokenEvents := len(token.Events)
+	if res := escrow.MockInvoke("deposit1", util.ToChaincodeArgs("deposit", "30")); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	if res := escrow.MockInvoke("deposit2", util.ToChaincodeArgs("deposit", "100")); res.Status == shim.OK {
+		t.Error("Expected a deposit above alice's balance to fail")
+	}
+
+	balanceAlice, _ := balance(token, "alice")
+	balanceEscrow, _ := balance(token, "escrow")
+	if balanceAlice.Value != 70 || balanceEscrow.Value != 30 || deposited(escrow, "alice") != 30 {
+		t.Errorf("Expected alice to have deposited 30: (%d, %d, %d)", balanceAlice.Value, balanceEscrow.Value, deposited(escrow, "alice"))
+	}
+	if len(token.Events) != tokenEvents || len(escrow.Events) != 1 {
+		t.Error("Expected only the event of the invoked chaincode")
+	}
+}
+
+func TestInvokeChaincodeInBlock(t *testing.T) {
+	token, escrow := escrowLedger(t, "")
+	alice := invariantActors[1]
+
+	// both deposits read alice's token balance from the same snapshot
+	deposit := func(txID string) mock.Proposal {
+		return mock.Proposal{TxID: txID, MspID: alice.MspID, Cert: alice.CertPEM, Args: util.ToChaincodeArgs("deposit", "60")}
+	}
+	results := escrow.MockBlock([]mock.Proposal{deposit("tx1"), deposit("tx2")})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT)
+
+	balanceAlice, _ := balance(token, "alice")
+	if balanceAlice.Value != 40 || deposited(escrow, "alice") != 60 {
+		t.Errorf("Expected only the first deposit to be committed: (%d, %d)", balanceAlice.Value, deposited(escrow, "alice"))
+	}
+}
+
+func TestInvokeChaincodeOnOtherChannel(t *testing.T) {
+	token, escrow := escrowLedger(t, "other")
+	alice := invariantActors[1]
+	escrow.MockCreator(alice.MspID, alice.CertPEM)
+
+	if res := escrow.MockInvoke("deposit", util.ToChaincodeArgs("deposit", "30")); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	balanceAlice, _ := balance(token, "alice")
+	if balanceAlice.Value != 100 {
+		t.Errorf("Expected writes on another channel to be discarded: %d", balanceAlice.Value)
+	}
+}
+
+func TestInvokeChaincodeNotFound(t *testing.T) {
+	escrow := mock.NewFullMockStub("escrow", &escrowChaincode{})
+	escrow.MockCreator(invariantActors[1].MspID, invariantActors[1].CertPEM)
+
+	if res := escrow.MockInvoke("deposit", util.ToChaincodeArgs("deposit", "30")); res.Status == shim.OK {
+		t.Fatal("Expected a deposit to fail before the token is registered")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"time"
+)
+
+// Holders on the KYC allowlist, managed by callers with the kyc role. When the
+// token requires a KYC level, both parties of transfers and the receiver of
+// mints need an entry of that level, not expired at the transaction time.
+// Rejected calls have the StatusKYCRequired status instead of shim.ERROR.
+
+const IndexKYC = "cn~kyc"
+
+const StatusKYCRequired = 403
+
+func kycEntry(stub shim.ChaincodeStubInterface, cn string) (*KYC, error) {
+	key, err := stub.CreateCompositeKey(IndexKYC, []string{cn})
+	if err != nil {
+		return nil, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	entry := &KYC{}
+	err = json.Unmarshal(data, entry)
+	return entry, err
+}
+
+// whether the entry has the level and is not expired at the given time
+func (entry *KYC) verified(level uint8, now time.Time) bool {
+	if entry == nil || entry.Level < level {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, entry.Expiry)
+	return err == nil && now.Before(expiry)
+}
+
+func parseKYC(args []string) (KYC, error) {
+	entry := KYC{}
+	if len(args) != 1 {
+		return entry, errors.New("Expected 1 argument")
+	}
+	err := json.Unmarshal([]byte(args[0]), &entry)
+	if err != nil {
+		return entry, errors.New("Error parsing KYC json")
+	}
+	if entry.User == "" {
+		return entry, errors.New("Expected the user")
+	}
+	return entry, nil
+}
+
+// adds or updates the allowlist entry of a holder, callers need the kyc role
+func (t *TokenChaincode) setKYC(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	entry, err := parseKYC(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if entry.Level == 0 {
+		return shim.Error("Expected a level above 0")
+	}
+	if _, err := time.Parse(time.RFC3339, entry.Expiry); err != nil {
+		return shim.Error("Invalid expiry: " + entry.Expiry)
+	}
+
+	err = requireRole(stub, RoleKYC)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entry.Provider, err = CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+
+	key, err := stub.CreateCompositeKey(IndexKYC, []string{entry.User})
+	if err != nil {
+		return shim.Error("Error creating KYC key")
+	}
+	entryBytes, _ := json.Marshal(entry)
+	err = stub.PutState(key, entryBytes)
+	if err != nil {
+		return shim.Error("Error saving KYC entry")
+	}
+
+	stub.SetEvent("KYCUpdated", entryBytes)
+	return shim.Success(nil)
+}
+
+// removes a holder from the allowlist, callers need the kyc role
+func (t *TokenChaincode) removeKYC(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	entry, err := parseKYC(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleKYC)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(IndexKYC, []string{entry.User})
+	if err != nil {
+		return shim.Error("Error creating KYC key")
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error("Error deleting KYC entry")
+	}
+
+	entryBytes, _ := json.Marshal(KYC{User: entry.User})
+	stub.SetEvent("KYCRemoved", entryBytes)
+	return shim.Success(nil)
+}
+
+// the allowlist entry of the user, verified against the level required by the token
+func (t *TokenChaincode) kycStatusAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	statusRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &statusRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	token, err := tokenData(stub)
+	if err != nil {
+		return shim.Error("Error getting token data")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entry, err := kycEntry(stub, statusRq.User)
+	if err != nil {
+		return shim.Error("Error getting KYC entry")
+	}
+
+	status := KYCStatus{KYC: KYC{User: statusRq.User}}
+	if entry != nil {
+		status.KYC = *entry
+	}
+	status.Verified = token.KYCLevel == 0 || entry.verified(token.KYCLevel, now)
+	result, _ := json.Marshal(status)
+	return shim.Success(result)
+}
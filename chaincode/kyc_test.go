@@ -0,0 +1,191 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+	"time"
+)
+
+const kycToken = `{"name": "KYC", "totalSupply": 1000, "kycLevel": 2, "roles": {
+	"admin": [{"mspId": "Org1MSP", "ou": "admins"}],
+	"kyc": [{"ou": "kyc"}],
+	"minter": [{"attr": "token.minter"}]
+}}`
+
+var kycProvider = rolesCA.MustIssue("provider", testca.Options{OUs: []string{"client", "kyc"}})
+
+func kycLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", kycToken)); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	return stub
+}
+
+func setKYC(t *testing.T, stub *mock.FullMockStub, user string, level int, expiry time.Time) {
+	stub.MockCreator(kycProvider.MspID, kycProvider.CertPEM)
+	entry := fmt.Sprintf(`{"user": "%s", "level": %d, "expiry": "%s"}`, user, level, expiry.Format(time.RFC3339))
+	if res := stub.MockInvoke("kyc", util.ToChaincodeArgs("setKYC", entry)); res.Status != shim.OK {
+		t.Fatal("SetKYC failed: " + res.Message)
+	}
+}
+
+func expectKYCRequired(t *testing.T, res pb.Response, call string) {
+	if res.Status != StatusKYCRequired {
+		t.Errorf("Expected %s to be rejected with status %d, got %d (%s)", call, StatusKYCRequired, res.Status, res.Message)
+	}
+}
+
+func TestKYCTransfer(t *testing.T) {
+	stub := kycLedger(t)
+	issuer := roleActors["issuer"]
+	expiry := time.Now().Add(time.Hour)
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setKYC", `{"user": "issuer", "level": 2, "expiry": "2100-01-01T00:00:00Z"}`))
+	if res.Status == shim.OK {
+		t.Error("Expected only KYC providers to set entries")
+	}
+	expectKYCRequired(t, stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 10}`)), "an unverified sender")
+
+	setKYC(t, stub, "issuer", 3, expiry)
+	setKYC(t, stub, "alice", 1, expiry)
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	expectKYCRequired(t, stub.MockInvoke("3", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 10}`)), "a receiver below the level")
+
+	setKYC(t, stub, "alice", 2, expiry)
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 10}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+
+	status := KYCStatus{}
+	json.Unmarshal(stub.MockInvoke("5", util.ToChaincodeArgs("kycStatus", `{"user": "alice"}`)).Payload, &status)
+	if !status.Verified || status.Level != 2 || status.Provider != "provider" {
+		t.Errorf("Unexpected KYC status: %+v", status)
+	}
+
+	// entries expire at the transaction time
+	stub.MockTime(expiry.Add(time.Minute))
+	expectKYCRequired(t, stub.MockInvoke("6", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 10}`)), "an expired entry")
+	json.Unmarshal(stub.MockInvoke("7", util.ToChaincodeArgs("kycStatus", `{"user": "alice"}`)).Payload, &status)
+	if status.Verified {
+		t.Error("Expected the expired entry not to be verified")
+	}
+	stub.MockTime(time.Now())
+
+	stub.MockCreator(kycProvider.MspID, kycProvider.CertPEM)
+	if res := stub.MockInvoke("8", util.ToChaincodeArgs("removeKYC", `{"user": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("RemoveKYC failed: " + res.Message)
+	}
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	expectKYCRequired(t, stub.MockInvoke("9", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 10}`)), "a removed receiver")
+}
+
+func TestKYCTransferFromAndMint(t *testing.T) {
+	stub := kycLedger(t)
+	issuer, minter := roleActors["issuer"], roleActors["minter"]
+	expiry := time.Now().Add(time.Hour)
+	setKYC(t, stub, "issuer", 2, expiry)
+	setKYC(t, stub, "alice", 2, expiry)
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 100}`))
+	alice := recoveryActors["alice"]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectKYCRequired(t, stub.MockInvoke("2", util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "bob", "value": 10}`)), "transferFrom to an unverified receiver")
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "alice", "value": 10}`)); res.Status != shim.OK {
+		t.Error("TransferFrom failed: " + res.Message)
+	}
+
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	expectKYCRequired(t, stub.MockInvoke("4", util.ToChaincodeArgs("mint", `{"to": "bob", "value": 10}`)), "mint to an unverified receiver")
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("mint", `{"to": "alice", "value": 10}`)); res.Status != shim.OK {
+		t.Error("Mint failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 20 {
+		t.Errorf("Expected alice to hold 20, got %d", b.Value)
+	}
+}
+
+func TestKYCPayouts(t *testing.T) {
+	stub := kycLedger(t)
+	stub.MockCollection(privateCollection, "Org1MSP", "Org2MSP")
+	issuer, admin, alice := roleActors["issuer"], roleActors["admin"], recoveryActors["alice"]
+	expiry := time.Now().Add(time.Hour)
+	for _, user := range []string{"issuer", "admin", "alice"} {
+		setKYC(t, stub, user, 2, expiry)
+	}
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 300}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "admin", "value": 200}`))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("stake", `{"amount": 100}`)); res.Status != shim.OK {
+		t.Fatal("Stake failed: " + res.Message)
+	}
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("setStakingRewards", `{"rate": 1, "fund": 100}`)); res.Status != shim.OK {
+		t.Fatal("SetStakingRewards failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("createDistribution", `{"amount": 50}`)); res.Status != shim.OK {
+		t.Fatal("CreateDistribution failed: " + res.Message)
+	}
+	stub.MockTimeAdvance(10 * time.Second)
+
+	// dividends and rewards are credited like mints, once alice is verified
+	stub.MockCreator(kycProvider.MspID, kycProvider.CertPEM)
+	stub.MockInvoke("6", util.ToChaincodeArgs("removeKYC", `{"user": "alice"}`))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectKYCRequired(t, stub.MockInvoke("7", util.ToChaincodeArgs("claim", `{}`)), "a claim of an unverified holder")
+	expectKYCRequired(t, stub.MockInvoke("8", util.ToChaincodeArgs("claimRewards")), "a reward claim of an unverified holder")
+	setKYC(t, stub, "alice", 2, expiry)
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("9", util.ToChaincodeArgs("claim", `{}`)); res.Status != shim.OK {
+		t.Error("Claim failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("10", util.ToChaincodeArgs("claimRewards")); res.Status != shim.OK {
+		t.Error("ClaimRewards failed: " + res.Message)
+	}
+
+	// private transfers check the receiver's KYC
+	if res := privateInvoke(stub, issuer, "privateDeposit", `{"value": 100}`); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	expectKYCRequired(t, privateInvoke(stub, issuer, "privateTransfer", `{"to": "bob", "value": 10}`), "a private transfer to an unverified receiver")
+	if res := privateInvoke(stub, issuer, "privateTransfer", `{"to": "alice", "value": 10}`); res.Status != shim.OK {
+		t.Error("Private transfer failed: " + res.Message)
+	}
+}
+
+func TestKYCNotRequired(t *testing.T) {
+	stub := rolesLedger(t)
+	status := KYCStatus{}
+	json.Unmarshal(stub.MockInvoke("1", util.ToChaincodeArgs("kycStatus", `{"user": "alice"}`)).Payload, &status)
+	if !status.Verified || status.Level != 0 {
+		t.Errorf("Expected holders to be verified without a KYC level, got %+v", status)
+	}
+}
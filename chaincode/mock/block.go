@@ -0,0 +1,317 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"sort"
+)
+
+// A block is simulated the way Fabric processes it: every proposal is endorsed
+// against the same committed state, recording its read/write set, then the
+// transactions are validated in order and the ones reading keys changed
+// since their endorsement are marked invalid instead of being committed.
+
+// a transaction proposal, invoked by the given identity
+type Proposal struct {
+	TxID      string
+	MspID     string
+	Cert      string
+	Args      [][]byte
+	Transient map[string][]byte
+	// transaction timestamp set by the client, defaults to the time of the endorsement
+	Timestamp *timestamp.Timestamp
+}
+
+// Collection is empty for the public state,
+// version 0 stands for a key missing from the state
+type KVRead struct {
+	Collection string
+	Key        string
+	Version    uint64
+}
+
+type KVWrite struct {
+	Collection string
+	Key        string
+	IsDelete   bool
+	Value      []byte
+}
+
+// key-level endorsement policy set on a key, nil when removed
+type KVMetadataWrite struct {
+	Collection string
+	Key        string
+	Policy     []byte
+}
+
+// keys returned by a range query, checked again for phantom reads
+type RangeQueryInfo struct {
+	Collection string
+	StartKey   string
+	EndKey     string
+	Reads      []KVRead
+}
+
+type RWSet struct {
+	Reads          []KVRead
+	Writes         []KVWrite
+	MetadataWrites []KVMetadataWrite
+	RangeQueries   []RangeQueryInfo
+}
+
+type TxResult struct {
+	TxID      string
+	Timestamp *timestamp.Timestamp
+	Response  pb.Response
+	RWSet     *RWSet
+	// events are emitted on the stub only if the transaction is valid
+	Events         []*pb.ChaincodeEvent
+	ValidationCode pb.TxValidationCode
+
+	// read/write sets of the chaincodes taking part in the transaction,
+	// including the invoked one
+	namespaces map[*FullMockStub]*RWSet
+}
+
+// a failed simulation is not endorsed, so it is never valid
+func (r *TxResult) Endorsed() bool {
+	return r.Response.Status < shim.ERRORTHRESHOLD
+}
+
+func (r *TxResult) Valid() bool {
+	return r.ValidationCode == pb.TxValidationCode_VALID
+}
+
+type simulation struct {
+	reads    map[stateKey]uint64
+	writes   map[stateKey]KVWrite
+	metadata map[stateKey][]byte
+	ranges   []RangeQueryInfo
+	events   []*pb.ChaincodeEvent
+
+	// simulations of every chaincode called in the same transaction
+	namespaces map[*FullMockStub]*simulation
+}
+
+func newSimulation(stub *FullMockStub) *simulation {
+	sim := &simulation{
+		reads:      map[stateKey]uint64{},
+		writes:     map[stateKey]KVWrite{},
+		metadata:   map[stateKey][]byte{},
+		namespaces: map[*FullMockStub]*simulation{},
+	}
+	sim.namespaces[stub] = sim
+	return sim
+}
+
+// simulation of a chaincode called in the same transaction
+func (sim *simulation) namespace(stub *FullMockStub) *simulation {
+	if ns, ok := sim.namespaces[stub]; ok {
+		return ns
+	}
+	ns := newSimulation(stub)
+	ns.namespaces = sim.namespaces
+	sim.namespaces[stub] = ns
+	return ns
+}
+
+// a simulated transaction reads the committed state, not its own writes
+func (sim *simulation) read(stub *FullMockStub, collection, key string) {
+	if _, ok := sim.reads[stateKey{collection, key}]; !ok {
+		sim.reads[stateKey{collection, key}] = stub.versions[stateKey{collection, key}]
+	}
+}
+
+func (sim *simulation) write(write KVWrite) {
+	sim.writes[stateKey{write.Collection, write.Key}] = write
+}
+
+// read/write set sorted by collection and key, as built by the peer
+func (sim *simulation) rwset() *RWSet {
+	rwset := &RWSet{RangeQueries: sim.ranges}
+	for key, version := range sim.reads {
+		rwset.Reads = append(rwset.Reads, KVRead{Collection: key.collection, Key: key.key, Version: version})
+	}
+	for _, write := range sim.writes {
+		rwset.Writes = append(rwset.Writes, write)
+	}
+	for key, policy := range sim.metadata {
+		rwset.MetadataWrites = append(rwset.MetadataWrites, KVMetadataWrite{Collection: key.collection, Key: key.key, Policy: policy})
+	}
+	sort.Slice(rwset.Reads, func(i, j int) bool {
+		return stateKey{rwset.Reads[i].Collection, rwset.Reads[i].Key}.less(stateKey{rwset.Reads[j].Collection, rwset.Reads[j].Key})
+	})
+	sort.Slice(rwset.Writes, func(i, j int) bool {
+		return stateKey{rwset.Writes[i].Collection, rwset.Writes[i].Key}.less(stateKey{rwset.Writes[j].Collection, rwset.Writes[j].Key})
+	})
+	sort.Slice(rwset.MetadataWrites, func(i, j int) bool {
+		return stateKey{rwset.MetadataWrites[i].Collection, rwset.MetadataWrites[i].Key}.less(stateKey{rwset.MetadataWrites[j].Collection, rwset.MetadataWrites[j].Key})
+	})
+	return rwset
+}
+
+// endorses and commits the proposals as one block
+func (stub *FullMockStub) MockBlock(proposals []Proposal) []*TxResult {
+	results := make([]*TxResult, len(proposals))
+	for i, proposal := range proposals {
+		results[i] = stub.MockEndorse(proposal)
+	}
+	stub.MockCommit(results)
+	return results
+}
+
+// simulates the proposal against the committed state without changing it
+func (stub *FullMockStub) MockEndorse(proposal Proposal) *TxResult {
+	stub.MockCreator(proposal.MspID, proposal.Cert)
+	stub.sim = newSimulation(stub)
+	transient := stub.transient
+	stub.transient = proposal.Transient
+	defer func() {
+		stub.sim = nil
+		stub.transient = transient
+	}()
+
+	res := stub.mockCall(proposal.TxID, proposal.Args, proposal.Timestamp, stub.cc.Invoke)
+	result := &TxResult{
+		TxID:       proposal.TxID,
+		Timestamp:  stub.txTimestamp,
+		Response:   res,
+		Events:     stub.sim.events,
+		namespaces: map[*FullMockStub]*RWSet{},
+	}
+	for ns, sim := range stub.sim.namespaces {
+		result.namespaces[ns] = sim.rwset()
+	}
+	result.RWSet = result.namespaces[stub]
+	return result
+}
+
+// validates the endorsed transactions in order, applying the valid ones
+func (stub *FullMockStub) MockCommit(results []*TxResult) {
+	for _, result := range results {
+		result.ValidationCode = validate(result)
+		if !result.Valid() {
+			continue
+		}
+
+		for ns, rwset := range result.namespaces {
+			ns.apply(result, rwset)
+		}
+		stub.Events = append(stub.Events, result.Events...)
+	}
+}
+
+func (stub *FullMockStub) apply(result *TxResult, rwset *RWSet) {
+	stub.mockTransactionStart(result.TxID, result.Timestamp)
+	for _, write := range rwset.Writes {
+		switch {
+		case write.Collection != "" && write.IsDelete:
+			stub.DelPrivateData(write.Collection, write.Key)
+		case write.Collection != "":
+			stub.PutPrivateData(write.Collection, write.Key, write.Value)
+		case write.IsDelete:
+			stub.DelState(write.Key)
+		default:
+			stub.PutState(write.Key, write.Value)
+		}
+	}
+	for _, write := range rwset.MetadataWrites {
+		stub.SetPrivateDataValidationParameter(write.Collection, write.Key, write.Policy)
+	}
+	stub.MockTransactionEnd(result.TxID)
+}
+
+func validate(result *TxResult) pb.TxValidationCode {
+	if !result.Endorsed() {
+		return pb.TxValidationCode_ENDORSEMENT_POLICY_FAILURE
+	}
+
+	for ns, rwset := range result.namespaces {
+		for _, read := range rwset.Reads {
+			if ns.versions[stateKey{read.Collection, read.Key}] != read.Version {
+				return pb.TxValidationCode_MVCC_READ_CONFLICT
+			}
+		}
+	}
+
+	for ns, rwset := range result.namespaces {
+		for _, query := range rwset.RangeQueries {
+			current := ns.committedRange(query.Collection, query.StartKey, query.EndKey)
+			if len(current) != len(query.Reads) {
+				return pb.TxValidationCode_PHANTOM_READ_CONFLICT
+			}
+			for i := range current {
+				if current[i] != query.Reads[i] {
+					return pb.TxValidationCode_PHANTOM_READ_CONFLICT
+				}
+			}
+		}
+	}
+
+	return pb.TxValidationCode_VALID
+}
+
+// keys of the public state or of a collection within [startKey, endKey),
+// an empty endKey meaning no upper bound
+func (stub *FullMockStub) committedRange(collection, startKey, endKey string) []KVRead {
+	keys := []string{}
+	if collection == "" {
+		iterator := shim.NewMockStateRangeQueryIterator(&stub.MockStub, startKey, endKey)
+		for iterator.HasNext() {
+			kv, _ := iterator.Next()
+			keys = append(keys, kv.Key)
+		}
+	} else {
+		for key := range stub.private[collection] {
+			if key >= startKey && (endKey == "" || key < endKey) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+
+	reads := []KVRead{}
+	for _, key := range keys {
+		reads = append(reads, KVRead{Collection: collection, Key: key, Version: stub.versions[stateKey{collection, key}]})
+	}
+	return reads
+}
+
+// the whole range is recorded for phantom read checks, even if the
+// chaincode does not iterate over all of it
+func (stub *FullMockStub) simulatedRange(collection, startKey, endKey string) shim.StateQueryIteratorInterface {
+	reads := stub.committedRange(collection, startKey, endKey)
+	stub.sim.ranges = append(stub.sim.ranges, RangeQueryInfo{Collection: collection, StartKey: startKey, EndKey: endKey, Reads: reads})
+	return stub.rangeIterator(reads)
+}
+
+// iterator over the committed values of the keys read
+func (stub *FullMockStub) rangeIterator(reads []KVRead) shim.StateQueryIteratorInterface {
+	iterator := &sliceIterator{}
+	for _, read := range reads {
+		value := stub.State[read.Key]
+		if read.Collection != "" {
+			value = stub.private[read.Collection][read.Key]
+		}
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: read.Key, Value: value})
+	}
+	return iterator
+}
@@ -0,0 +1,137 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"strings"
+)
+
+// Chaincode has to be deterministic: every endorsing peer must produce the
+// same read/write set, events and response for a proposal, or the endorsements
+// do not match and the transaction cannot be committed.
+
+// endorses the proposal on several peers, each one a new chaincode instance
+// on a copy of the state of stub, and reports how their endorsements differ
+func CheckDeterminism(stub *FullMockStub, newChaincode func() shim.Chaincode, proposal Proposal, peers int) error {
+	// the client sets the timestamp, all peers see the same one
+	if proposal.Timestamp == nil {
+		proposal.Timestamp = util.CreateUtcTimestamp()
+	}
+
+	results := make([]*TxResult, peers)
+	for i := range results {
+		results[i] = stub.peerCopy(newChaincode()).MockEndorse(proposal)
+	}
+
+	differences := []string{}
+	for i := 1; i < peers; i++ {
+		for _, difference := range compareEndorsements(results[0], results[i]) {
+			differences = append(differences, fmt.Sprintf("peer %d: %s", i, difference))
+		}
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("Endorsements of %s differ from peer 0:\n%s", proposal.TxID, strings.Join(differences, "\n"))
+	}
+	return nil
+}
+
+// a stub holding the same committed state, key versions and history
+func (stub *FullMockStub) peerCopy(cc shim.Chaincode) *FullMockStub {
+	peer := NewFullMockStub(stub.Name, cc)
+	peer.MockTransactionStart("copy")
+	for key, value := range stub.State {
+		peer.PutState(key, append([]byte{}, value...))
+	}
+	for collection, data := range stub.private {
+		for key, value := range data {
+			peer.PutPrivateData(collection, key, append([]byte{}, value...))
+		}
+	}
+	peer.MockTransactionEnd("copy")
+
+	for collection, members := range stub.collections {
+		peer.collections[collection] = members
+	}
+	for key, history := range stub.history {
+		peer.history[key] = append([]*queryresult.KeyModification{}, history...)
+	}
+	for collection, policies := range stub.EndorsementPolicies {
+		for key, policy := range policies {
+			peer.SetPrivateDataValidationParameter(collection, key, policy)
+		}
+	}
+	for key, version := range stub.versions {
+		peer.versions[key] = version
+	}
+	peer.height = stub.height
+	peer.invokables = stub.invokables
+	return peer
+}
+
+func compareEndorsements(expected, actual *TxResult) []string {
+	differences := []string{}
+	differ := func(format string, args ...interface{}) {
+		differences = append(differences, fmt.Sprintf(format, args...))
+	}
+
+	if expected.Response.Status != actual.Response.Status || expected.Response.Message != actual.Response.Message {
+		differ("response %d %q, expected %d %q", actual.Response.Status, actual.Response.Message, expected.Response.Status, expected.Response.Message)
+	}
+	if !bytes.Equal(expected.Response.Payload, actual.Response.Payload) {
+		differ("payload %q, expected %q", actual.Response.Payload, expected.Response.Payload)
+	}
+
+	if fmt.Sprint(expected.RWSet.Reads) != fmt.Sprint(actual.RWSet.Reads) {
+		differ("reads %v, expected %v", actual.RWSet.Reads, expected.RWSet.Reads)
+	}
+	if fmt.Sprint(expected.RWSet.RangeQueries) != fmt.Sprint(actual.RWSet.RangeQueries) {
+		differ("range queries %v, expected %v", actual.RWSet.RangeQueries, expected.RWSet.RangeQueries)
+	}
+
+	if len(expected.RWSet.Writes) != len(actual.RWSet.Writes) {
+		differ("%d writes, expected %d", len(actual.RWSet.Writes), len(expected.RWSet.Writes))
+	} else {
+		for i, write := range expected.RWSet.Writes {
+			other := actual.RWSet.Writes[i]
+			if write.Key != other.Key || write.IsDelete != other.IsDelete || !bytes.Equal(write.Value, other.Value) {
+				differ("write %q=%q (delete %t), expected %q=%q (delete %t)", other.Key, other.Value, other.IsDelete, write.Key, write.Value, write.IsDelete)
+			}
+		}
+	}
+
+	if fmt.Sprint(expected.RWSet.MetadataWrites) != fmt.Sprint(actual.RWSet.MetadataWrites) {
+		differ("metadata writes %v, expected %v", actual.RWSet.MetadataWrites, expected.RWSet.MetadataWrites)
+	}
+
+	if len(expected.Events) != len(actual.Events) {
+		differ("%d events, expected %d", len(actual.Events), len(expected.Events))
+	} else {
+		for i, event := range expected.Events {
+			other := actual.Events[i]
+			if event.EventName != other.EventName || !bytes.Equal(event.Payload, other.Payload) {
+				differ("event %s %q, expected %s %q", other.EventName, other.Payload, event.EventName, event.Payload)
+			}
+		}
+	}
+
+	return differences
+}
@@ -0,0 +1,80 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writes the keys of the state in map order, or the wall-clock time
+type nondeterministicChaincode struct {
+}
+
+func (cc *nondeterministicChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *nondeterministicChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, _ := stub.GetFunctionAndParameters()
+	switch function {
+	case "keys":
+		keys := []string{}
+		for key := range stub.(*FullMockStub).State {
+			keys = append(keys, key)
+		}
+		stub.PutState("keys", []byte(strings.Join(keys, ",")))
+	case "now":
+		stub.SetEvent("Now", []byte(time.Now().String()))
+	case "txTime":
+		ts, _ := stub.GetTxTimestamp()
+		stub.PutState("time", []byte(ts.String()))
+	}
+	return shim.Success(nil)
+}
+
+func nondeterministicStub() *FullMockStub {
+	stub := NewFullMockStub("cc", &nondeterministicChaincode{})
+	stub.MockTransactionStart("init")
+	for i := 0; i < 20; i++ {
+		stub.PutState(fmt.Sprint("key", i), []byte{byte(i)})
+	}
+	stub.MockTransactionEnd("init")
+	return stub
+}
+
+func TestCheckDeterminism(t *testing.T) {
+	stub := nondeterministicStub()
+	newChaincode := func() shim.Chaincode { return &nondeterministicChaincode{} }
+
+	for _, function := range []string{"keys", "now"} {
+		proposal := Proposal{TxID: function, Args: util.ToChaincodeArgs(function)}
+		if err := CheckDeterminism(stub, newChaincode, proposal, 3); err == nil {
+			t.Errorf("Expected %s to be reported as non-deterministic", function)
+		}
+	}
+
+	proposal := Proposal{TxID: "txTime", Args: util.ToChaincodeArgs("txTime")}
+	if err := CheckDeterminism(stub, newChaincode, proposal, 3); err != nil {
+		t.Errorf("Expected the transaction timestamp to be the same on all peers: %s", err)
+	}
+}
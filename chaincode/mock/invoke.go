@@ -0,0 +1,102 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the transaction a chaincode is running, replaced while it is called by another one
+type callContext struct {
+	txID        string
+	args        [][]byte
+	creator     []byte
+	transient   map[string][]byte
+	txTimestamp *timestamp.Timestamp
+	sim         *simulation
+	called      int
+}
+
+// registers a chaincode that can be called through InvokeChaincode, on the
+// same channel or, with a non empty channel, on another one
+func (stub *FullMockStub) MockPeerChaincode(name string, other *FullMockStub, channel string) {
+	if channel != "" {
+		name = name + "/" + channel
+	}
+	stub.invokables[name] = other
+}
+
+// runs the registered chaincode in the transaction of the caller, as its creator.
+// Writes on another channel are discarded and events of called chaincodes are
+// dropped, like Fabric does
+func (stub *FullMockStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	if channel == stub.GetChannelID() {
+		channel = ""
+	}
+	name := chaincodeName
+	if channel != "" {
+		name = chaincodeName + "/" + channel
+	}
+	other, ok := stub.invokables[name]
+	if !ok {
+		return shim.Error("Chaincode " + name + " not found")
+	}
+
+	saved := other.context()
+	defer other.restore(saved)
+
+	other.TxID = stub.TxID
+	other.args = args
+	other.mockCreator = stub.mockCreator
+	other.transient = stub.transient
+	other.txTimestamp = stub.txTimestamp
+	other.called++
+	switch {
+	case channel != "":
+		other.sim = newSimulation(other)
+	case stub.sim != nil:
+		other.sim = stub.sim.namespace(other)
+	default:
+		other.sim = nil
+	}
+
+	return other.cc.Invoke(other)
+}
+
+func (stub *FullMockStub) context() callContext {
+	return callContext{
+		txID:        stub.TxID,
+		args:        stub.args,
+		creator:     stub.mockCreator,
+		transient:   stub.transient,
+		txTimestamp: stub.txTimestamp,
+		sim:         stub.sim,
+		called:      stub.called,
+	}
+}
+
+func (stub *FullMockStub) restore(ctx callContext) {
+	stub.TxID = ctx.txID
+	stub.args = ctx.args
+	stub.mockCreator = ctx.creator
+	stub.transient = ctx.transient
+	stub.txTimestamp = ctx.txTimestamp
+	stub.sim = ctx.sim
+	stub.called = ctx.called
+}
@@ -17,16 +17,47 @@ limitations under the License.
 package mock
 
 import (
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/msp"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"time"
 )
 
 type FullMockStub struct {
 	shim.MockStub
 
 	cc          shim.Chaincode
+	args        [][]byte
 	mockCreator []byte
+
+	transient   map[string][]byte
+	clock       *time.Time
+	txTimestamp *timestamp.Timestamp
+
+	// private data collections, their members and the history of public
+	// keys, see state.go and private.go
+	private     map[string]map[string][]byte
+	collections map[string][]string
+	history     map[string][]*queryresult.KeyModification
+
+	// committed version of each key, and the transaction being simulated
+	// by MockEndorse, see block.go
+	versions map[stateKey]uint64
+	height   uint64
+	sim      *simulation
+
+	// chaincodes callable through InvokeChaincode and the depth of the
+	// calls this stub is currently serving, see invoke.go
+	invokables map[string]*FullMockStub
+	called     int
+
+	// Events holds every chaincode event set through the stub, in order
+	Events []*pb.ChaincodeEvent
 }
 
 func NewFullMockStub(name string, cc shim.Chaincode) *FullMockStub {
@@ -34,6 +65,11 @@ func NewFullMockStub(name string, cc shim.Chaincode) *FullMockStub {
 	fs := new(FullMockStub)
 	fs.MockStub = *s
 	fs.cc = cc
+	fs.private = map[string]map[string][]byte{}
+	fs.collections = map[string][]string{}
+	fs.history = map[string][]*queryresult.KeyModification{}
+	fs.versions = map[stateKey]uint64{}
+	fs.invokables = map[string]*FullMockStub{}
 	return fs
 }
 
@@ -42,28 +78,109 @@ func (stub *FullMockStub) MockCreator(mspID string, cert string) {
 }
 
 func (stub *FullMockStub) MockInit(uuid string, args [][]byte) pb.Response {
-	// this is a hack here to set MockStub.args, because its not accessible otherwise
-	stub.MockStub.MockInvoke(uuid, args)
+	return stub.mockCall(uuid, args, nil, stub.cc.Init)
+}
 
-	stub.MockTransactionStart(uuid)
-	res := stub.cc.Init(stub)
+func (stub *FullMockStub) MockInvoke(uuid string, args [][]byte) pb.Response {
+	return stub.mockCall(uuid, args, nil, stub.cc.Invoke)
+}
+
+func (stub *FullMockStub) mockCall(uuid string, args [][]byte, ts *timestamp.Timestamp, call func(shim.ChaincodeStubInterface) pb.Response) pb.Response {
+	stub.args = args
+	stub.mockTransactionStart(uuid, ts)
+	res := call(stub)
 	stub.MockTransactionEnd(uuid)
 
 	return res
 }
 
-func (stub *FullMockStub) MockInvoke(uuid string, args [][]byte) pb.Response {
-	// this is a hack here to set MockStub.args, because its not accessible otherwise
-	stub.MockStub.MockInvoke(uuid, args)
-
-	// now do the invoke with the correct stub
+// the transaction timestamp is the given one, the mocked time or the current time
+func (stub *FullMockStub) mockTransactionStart(uuid string, ts *timestamp.Timestamp) {
 	stub.MockTransactionStart(uuid)
-	res := stub.cc.Invoke(stub)
-	stub.MockTransactionEnd(uuid)
+	switch {
+	case ts != nil:
+		stub.txTimestamp = ts
+	case stub.clock != nil:
+		stub.txTimestamp = &timestamp.Timestamp{Seconds: stub.clock.Unix(), Nanos: int32(stub.clock.Nanosecond())}
+	default:
+		stub.txTimestamp = util.CreateUtcTimestamp()
+	}
+}
 
-	return res
+// sets the timestamp of the following transactions
+func (stub *FullMockStub) MockTime(t time.Time) {
+	stub.clock = &t
+}
+
+// moves the mocked time forward, starting from now if it was not set
+func (stub *FullMockStub) MockTimeAdvance(d time.Duration) {
+	if stub.clock == nil {
+		stub.MockTime(time.Now())
+	}
+	stub.MockTime(stub.clock.Add(d))
+}
+
+func (stub *FullMockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if stub.txTimestamp == nil {
+		return nil, errors.New("TxTimestamp not set")
+	}
+	return stub.txTimestamp, nil
+}
+
+// sets the transient data of the following transactions
+func (stub *FullMockStub) MockTransient(transient map[string][]byte) {
+	stub.transient = transient
+}
+
+func (stub *FullMockStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+// the args are kept here, since MockStub.args cannot be set otherwise
+func (stub *FullMockStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *FullMockStub) GetStringArgs() []string {
+	args := make([]string, len(stub.args))
+	for i, arg := range stub.args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+func (stub *FullMockStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (stub *FullMockStub) GetArgsSlice() ([]byte, error) {
+	return bytes.Join(stub.args, nil), nil
 }
 
 func (stub *FullMockStub) GetCreator() ([]byte, error) {
 	return stub.mockCreator, nil
 }
+
+func (stub *FullMockStub) SetEvent(name string, payload []byte) error {
+	if stub.called > 0 {
+		return nil
+	}
+
+	event := &pb.ChaincodeEvent{
+		TxId:      stub.TxID,
+		EventName: name,
+		Payload:   payload,
+	}
+
+	// events of a simulated transaction are only emitted once it is committed
+	if stub.sim != nil {
+		stub.sim.events = append(stub.sim.events, event)
+	} else {
+		stub.Events = append(stub.Events, event)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaincode running the function set by the test
+type scriptChaincode struct {
+	run func(stub shim.ChaincodeStubInterface) pb.Response
+}
+
+func (cc *scriptChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return cc.run(stub)
+}
+
+func (cc *scriptChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return cc.run(stub)
+}
+
+func scriptStub() (*FullMockStub, *scriptChaincode) {
+	cc := &scriptChaincode{}
+	return NewFullMockStub("cc", cc), cc
+}
+
+func TestHistoryAndClock(t *testing.T) {
+	stub, cc := scriptStub()
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	stub.MockTime(start)
+
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		_, args := stub.GetFunctionAndParameters()
+		if args[0] == "delete" {
+			stub.DelState("key")
+		} else {
+			stub.PutState("key", []byte("ignored"))
+			stub.PutState("key", []byte(args[0]))
+		}
+		return shim.Success(nil)
+	}
+	stub.MockInvoke("tx1", util.ToChaincodeArgs("put", "a"))
+	stub.MockTimeAdvance(time.Hour)
+	stub.MockInvoke("tx2", util.ToChaincodeArgs("put", "b"))
+	stub.MockTimeAdvance(time.Hour)
+	stub.MockInvoke("tx3", util.ToChaincodeArgs("put", "delete"))
+
+	var modifications []string
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		iterator, err := stub.GetHistoryForKey("key")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer iterator.Close()
+		for iterator.HasNext() {
+			modification, _ := iterator.Next()
+			ts := time.Unix(modification.Timestamp.Seconds, 0).UTC()
+			modifications = append(modifications, modification.TxId+" "+ts.Format("15:04")+" "+string(modification.Value))
+			if modification.IsDelete {
+				modifications[len(modifications)-1] += "deleted"
+			}
+		}
+		return shim.Success(nil)
+	}
+	stub.MockInvoke("query", util.ToChaincodeArgs("history"))
+
+	expected := []string{"tx1 12:00 a", "tx2 13:00 b", "tx3 14:00 deleted"}
+	if len(modifications) != len(expected) {
+		t.Fatalf("Unexpected history: %v", modifications)
+	}
+	for i := range expected {
+		if modifications[i] != expected[i] {
+			t.Errorf("Expected modification %q, got %q", expected[i], modifications[i])
+		}
+	}
+}
+
+func TestTransientAndPrivateData(t *testing.T) {
+	stub, cc := scriptStub()
+
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		transient, _ := stub.GetTransient()
+		for key, value := range transient {
+			if err := stub.PutPrivateData("secrets", key, value); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		return shim.Success(nil)
+	}
+	stub.MockTransient(map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	if res := stub.MockInvoke("tx1", util.ToChaincodeArgs("put")); res.Status != shim.OK {
+		t.Fatal(res.Message)
+	}
+	stub.MockTransient(nil)
+
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		if err := stub.PutPrivateData("", "a", nil); err == nil {
+			return shim.Error("Expected an error for an empty collection")
+		}
+		value, _ := stub.GetPrivateData("secrets", "a")
+		iterator, err := stub.GetPrivateDataByRange("secrets", "", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for iterator.HasNext() {
+			kv, _ := iterator.Next()
+			value = append(value, kv.Value...)
+		}
+		return shim.Success(value)
+	}
+	res := stub.MockInvoke("tx2", util.ToChaincodeArgs("get"))
+	if string(res.Payload) != "112" || len(stub.State) != 0 {
+		t.Errorf("Unexpected private data %q: %s", res.Payload, res.Message)
+	}
+
+	// private writes of a simulated transaction wait for its commit
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		value, _ := stub.GetPrivateData("secrets", "a")
+		stub.PutPrivateData("secrets", "a", append(value, '+'))
+		return shim.Success(nil)
+	}
+	results := []*TxResult{
+		stub.MockEndorse(Proposal{TxID: "tx3"}),
+		stub.MockEndorse(Proposal{TxID: "tx4"}),
+	}
+	if value := stub.private["secrets"]["a"]; string(value) != "1" {
+		t.Errorf("Endorsement changed private data to %q", value)
+	}
+	stub.MockCommit(results)
+	if !results[0].Valid() || results[1].ValidationCode != pb.TxValidationCode_MVCC_READ_CONFLICT {
+		t.Errorf("Unexpected validation: %s, %s", results[0].ValidationCode, results[1].ValidationCode)
+	}
+	if value := stub.private["secrets"]["a"]; string(value) != "1+" {
+		t.Errorf("Expected the valid private write to be committed, got %q", value)
+	}
+}
+
+func TestInvokeChaincodeRestoresContext(t *testing.T) {
+	stub, cc := scriptStub()
+	other, otherCC := scriptStub()
+	stub.MockPeerChaincode("other", other, "")
+	other.MockPeerChaincode("cc", stub, "")
+	stub.MockCreator("Org1MSP", "creator")
+
+	// cc calls other, which calls cc back
+	var calls []string
+	cc.run = func(s shim.ChaincodeStubInterface) pb.Response {
+		function, _ := s.GetFunctionAndParameters()
+		creator, _ := s.GetCreator()
+		calls = append(calls, s.GetTxID()+" "+function+" "+string(creator[len(creator)-7:]))
+		if function == "outer" {
+			res := s.InvokeChaincode("other", util.ToChaincodeArgs("middle"), "")
+			function, _ = s.GetFunctionAndParameters()
+			calls = append(calls, "back in "+function+" "+string(res.Payload))
+		}
+		return shim.Success([]byte(function))
+	}
+	otherCC.run = func(s shim.ChaincodeStubInterface) pb.Response {
+		calls = append(calls, s.GetTxID()+" middle")
+		return s.InvokeChaincode("cc", util.ToChaincodeArgs("inner"), "")
+	}
+
+	stub.MockInvoke("tx1", util.ToChaincodeArgs("outer"))
+	expected := []string{"tx1 outer creator", "tx1 middle", "tx1 inner creator", "back in outer inner"}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestCollectionReadAccess(t *testing.T) {
+	stub, cc := scriptStub()
+	stub.MockCollection("org1", "Org1MSP")
+
+	cc.run = func(stub shim.ChaincodeStubInterface) pb.Response {
+		if err := stub.PutPrivateData("org1", "key", []byte("value")); err != nil {
+			return shim.Error(err.Error())
+		}
+		if _, err := stub.GetPrivateData("org1", "key"); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}
+
+	stub.MockCreator("Org1MSP", "member")
+	if res := stub.MockInvoke("tx1", nil); res.Status != shim.OK {
+		t.Error("Expected a member to read the collection: " + res.Message)
+	}
+	stub.MockCreator("Org2MSP", "other")
+	if res := stub.MockInvoke("tx2", nil); res.Status == shim.OK {
+		t.Error("Expected a client of another org not to read the collection")
+	}
+}
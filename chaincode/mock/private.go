@@ -0,0 +1,137 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	"unicode/utf8"
+)
+
+// Private data is kept per collection, every collection being available on
+// the mocked peer; like public state it is versioned for block simulation.
+// Collections registered with MockCollection are only readable by clients
+// of their member organisations, as with memberOnlyRead.
+
+// restricts reading the collection to clients of the given MSPs
+func (stub *FullMockStub) MockCollection(collection string, memberMSPs ...string) {
+	stub.collections[collection] = memberMSPs
+}
+
+func (stub *FullMockStub) checkReadAccess(collection string) error {
+	members, ok := stub.collections[collection]
+	if !ok {
+		return nil
+	}
+
+	creator := msp.SerializedIdentity{}
+	if err := proto.Unmarshal(stub.mockCreator, &creator); err == nil {
+		for _, member := range members {
+			if creator.Mspid == member {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("tx creator does not have read access permission on privatedata in chaincodeName:%s collectionName: %s", stub.Name, collection)
+}
+
+func validatePrivateKey(collection, key string) error {
+	if collection == "" {
+		return errors.New("collection must not be an empty string")
+	}
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	return nil
+}
+
+func (stub *FullMockStub) GetPrivateData(collection, key string) ([]byte, error) {
+	if err := validatePrivateKey(collection, key); err != nil {
+		return nil, err
+	}
+	if err := stub.checkReadAccess(collection); err != nil {
+		return nil, err
+	}
+	if stub.sim != nil {
+		stub.sim.read(stub, collection, key)
+	}
+	return stub.private[collection][key], nil
+}
+
+func (stub *FullMockStub) PutPrivateData(collection, key string, value []byte) error {
+	if err := validatePrivateKey(collection, key); err != nil {
+		return err
+	}
+	if stub.sim != nil {
+		stub.sim.write(KVWrite{Collection: collection, Key: key, Value: value})
+		return nil
+	}
+
+	if stub.private[collection] == nil {
+		stub.private[collection] = map[string][]byte{}
+	}
+	stub.private[collection][key] = value
+	stub.committed(collection, key, false)
+	return nil
+}
+
+func (stub *FullMockStub) DelPrivateData(collection, key string) error {
+	if err := validatePrivateKey(collection, key); err != nil {
+		return err
+	}
+	if stub.sim != nil {
+		stub.sim.write(KVWrite{Collection: collection, Key: key, IsDelete: true})
+		return nil
+	}
+
+	delete(stub.private[collection], key)
+	stub.committed(collection, key, true)
+	return nil
+}
+
+// a simulated policy change is only set once the transaction is committed
+func (stub *FullMockStub) SetPrivateDataValidationParameter(collection, key string, ep []byte) error {
+	if stub.sim != nil {
+		stub.sim.metadata[stateKey{collection, key}] = ep
+		return nil
+	}
+	return stub.MockStub.SetPrivateDataValidationParameter(collection, key, ep)
+}
+
+func (stub *FullMockStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if collection == "" {
+		return nil, errors.New("collection must not be an empty string")
+	}
+	if err := stub.checkReadAccess(collection); err != nil {
+		return nil, err
+	}
+	if stub.sim != nil {
+		return stub.simulatedRange(collection, startKey, endKey), nil
+	}
+	return stub.rangeIterator(stub.committedRange(collection, startKey, endKey)), nil
+}
+
+func (stub *FullMockStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	partialKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetPrivateDataByRange(collection, partialKey, partialKey+string(utf8.MaxRune))
+}
@@ -0,0 +1,429 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rich queries are evaluated like CouchDB Mango queries over the JSON object
+// values of the state, supporting selector, fields, sort, skip and limit.
+// As on a peer, their results are not checked again at validation.
+
+type mangoQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Fields   []string               `json:"fields"`
+	Sort     []interface{}          `json:"sort"`
+	Skip     int                    `json:"skip"`
+	Limit    int                    `json:"limit"`
+}
+
+type mangoSort struct {
+	field      string
+	descending bool
+}
+
+func (stub *FullMockStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	kvs := []*queryresult.KV{}
+	iterator := shim.NewMockStateRangeQueryIterator(&stub.MockStub, "", "")
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		kvs = append(kvs, kv)
+	}
+	return runQuery(query, kvs)
+}
+
+func (stub *FullMockStub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	if collection == "" {
+		return nil, errors.New("collection must not be an empty string")
+	}
+	if err := stub.checkReadAccess(collection); err != nil {
+		return nil, err
+	}
+	kvs := []*queryresult.KV{}
+	iterator := stub.rangeIterator(stub.committedRange(collection, "", ""))
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		kvs = append(kvs, kv)
+	}
+	return runQuery(query, kvs)
+}
+
+func runQuery(query string, kvs []*queryresult.KV) (shim.StateQueryIteratorInterface, error) {
+	q := mangoQuery{}
+	decoder := json.NewDecoder(strings.NewReader(query))
+	decoder.UseNumber()
+	if err := decoder.Decode(&q); err != nil {
+		return nil, errors.New("Invalid query: " + err.Error())
+	}
+	if q.Selector == nil {
+		return nil, errors.New("Invalid query: selector is missing")
+	}
+
+	sorts := []mangoSort{}
+	for _, s := range q.Sort {
+		switch s := s.(type) {
+		case string:
+			sorts = append(sorts, mangoSort{field: s})
+		case map[string]interface{}:
+			for field, direction := range s {
+				sorts = append(sorts, mangoSort{field: field, descending: direction == "desc"})
+			}
+		default:
+			return nil, fmt.Errorf("Invalid sort: %v", s)
+		}
+	}
+
+	type match struct {
+		kv  *queryresult.KV
+		doc interface{}
+	}
+	matches := []match{}
+	for _, kv := range kvs {
+		doc, ok := parseDocument(kv.Value)
+		if !ok {
+			continue
+		}
+		matched, err := matchSelector(doc, q.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, match{kv, doc})
+		}
+	}
+
+	// documents come ordered by key, then by the sort fields
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, s := range sorts {
+			a, _ := lookupField(matches[i].doc, s.field)
+			b, _ := lookupField(matches[j].doc, s.field)
+			if c := compareValues(a, b); c != 0 {
+				return (c < 0) != s.descending
+			}
+		}
+		return false
+	})
+
+	if q.Skip > len(matches) {
+		q.Skip = len(matches)
+	}
+	matches = matches[q.Skip:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+
+	iterator := &sliceIterator{}
+	for _, m := range matches {
+		value := m.kv.Value
+		if len(q.Fields) > 0 {
+			value, _ = json.Marshal(projectFields(m.doc, q.Fields))
+		}
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: m.kv.Key, Value: value})
+	}
+	return iterator, nil
+}
+
+// only JSON objects are documents, other values are stored as attachments
+func parseDocument(value []byte) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false
+	}
+	_, ok := doc.(map[string]interface{})
+	return doc, ok
+}
+
+// looks up a field by its dotted path
+func lookupField(doc interface{}, path string) (interface{}, bool) {
+	value := doc
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func projectFields(doc interface{}, fields []string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, field := range fields {
+		value, ok := lookupField(doc, field)
+		if !ok {
+			continue
+		}
+		names := strings.Split(field, ".")
+		object := result
+		for _, name := range names[:len(names)-1] {
+			if _, ok := object[name].(map[string]interface{}); !ok {
+				object[name] = map[string]interface{}{}
+			}
+			object = object[name].(map[string]interface{})
+		}
+		object[names[len(names)-1]] = value
+	}
+	return result
+}
+
+func matchSelector(doc interface{}, selector map[string]interface{}) (bool, error) {
+	for field, condition := range selector {
+		var matched bool
+		var err error
+		if strings.HasPrefix(field, "$") {
+			matched, err = matchCombination(doc, field, condition)
+		} else {
+			value, exists := lookupField(doc, field)
+			matched, err = matchCondition(value, exists, condition)
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchCombination(doc interface{}, operator string, argument interface{}) (bool, error) {
+	if operator == "$not" {
+		selector, ok := argument.(map[string]interface{})
+		if !ok {
+			return false, errors.New("$not expects a selector")
+		}
+		matched, err := matchSelector(doc, selector)
+		return !matched, err
+	}
+
+	selectors, ok := argument.([]interface{})
+	if !ok {
+		return false, fmt.Errorf("%s expects an array of selectors", operator)
+	}
+	matches := 0
+	for _, s := range selectors {
+		selector, ok := s.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array of selectors", operator)
+		}
+		matched, err := matchSelector(doc, selector)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			matches++
+		}
+	}
+
+	switch operator {
+	case "$and":
+		return matches == len(selectors), nil
+	case "$or":
+		return matches > 0, nil
+	case "$nor":
+		return matches == 0, nil
+	}
+	return false, errors.New("Unknown operator " + operator)
+}
+
+// a condition is a value to equal, operators, or a selector of sub-fields
+func matchCondition(value interface{}, exists bool, condition interface{}) (bool, error) {
+	operators, ok := condition.(map[string]interface{})
+	if !ok {
+		return exists && compareValues(value, condition) == 0, nil
+	}
+
+	for operator, argument := range operators {
+		if !strings.HasPrefix(operator, "$") {
+			// implicit selector on a sub-object
+			return matchSelector(value, operators)
+		}
+		matched, err := matchOperator(value, exists, operator, argument)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(value interface{}, exists bool, operator string, argument interface{}) (bool, error) {
+	if operator == "$exists" {
+		expected, ok := argument.(bool)
+		if !ok {
+			return false, errors.New("$exists expects a boolean")
+		}
+		return exists == expected, nil
+	}
+	if operator == "$not" {
+		matched, err := matchCondition(value, exists, argument)
+		return exists && !matched, err
+	}
+	if !exists {
+		return false, nil
+	}
+
+	switch operator {
+	case "$eq":
+		return compareValues(value, argument) == 0, nil
+	case "$ne":
+		return compareValues(value, argument) != 0, nil
+	case "$gt":
+		return compareValues(value, argument) > 0, nil
+	case "$gte":
+		return compareValues(value, argument) >= 0, nil
+	case "$lt":
+		return compareValues(value, argument) < 0, nil
+	case "$lte":
+		return compareValues(value, argument) <= 0, nil
+	case "$in", "$nin":
+		values, ok := argument.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", operator)
+		}
+		found := false
+		for _, v := range values {
+			if compareValues(value, v) == 0 {
+				found = true
+			}
+		}
+		return found == (operator == "$in"), nil
+	case "$regex":
+		pattern, ok := argument.(string)
+		if !ok {
+			return false, errors.New("$regex expects a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		str, ok := value.(string)
+		return ok && re.MatchString(str), nil
+	case "$size":
+		array, ok := value.([]interface{})
+		return ok && compareValues(json.Number(fmt.Sprint(len(array))), argument) == 0, nil
+	case "$all":
+		array, ok := value.([]interface{})
+		values, isArray := argument.([]interface{})
+		if !isArray {
+			return false, errors.New("$all expects an array")
+		}
+		if !ok {
+			return false, nil
+		}
+		for _, v := range values {
+			found := false
+			for _, element := range array {
+				if compareValues(element, v) == 0 {
+					found = true
+				}
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$elemMatch":
+		array, ok := value.([]interface{})
+		if !ok {
+			return false, nil
+		}
+		for _, element := range array {
+			matched, err := matchCondition(element, true, argument)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	}
+
+	return false, errors.New("Unknown operator " + operator)
+}
+
+// CouchDB collation: null < false < true < numbers < strings < arrays < objects
+func collationRank(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 2
+		}
+		return 1
+	case json.Number, float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func compareValues(a, b interface{}) int {
+	rankA, rankB := collationRank(a), collationRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+
+	switch a := a.(type) {
+	case json.Number, float64:
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case map[string]interface{}:
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		return bytes.Compare(ja, jb)
+	}
+	return 0
+}
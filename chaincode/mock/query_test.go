@@ -0,0 +1,100 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"strings"
+	"testing"
+)
+
+func queryKeys(stub *FullMockStub, query string) (string, error) {
+	iterator, err := stub.GetQueryResult(query)
+	if err != nil {
+		return "", err
+	}
+	keys := []string{}
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		keys = append(keys, kv.Key)
+	}
+	return strings.Join(keys, ","), nil
+}
+
+func TestGetQueryResult(t *testing.T) {
+	stub := NewFullMockStub("cc", nil)
+	stub.MockTransactionStart("init")
+	stub.PutState("alice", []byte(`{"type": "holder", "balance": 100, "country": "CH", "tags": ["kyc", "vip"], "address": {"city": "Bern"}}`))
+	stub.PutState("bob", []byte(`{"type": "holder", "balance": 20, "country": "DE", "tags": ["kyc"]}`))
+	stub.PutState("carol", []byte(`{"type": "holder", "balance": 60, "country": "CH"}`))
+	stub.PutState("token", []byte(`{"type": "token", "name": "FabricToken"}`))
+	stub.PutState("binary", []byte{0, 1, 2})
+	stub.PutState("number", []byte(`42`))
+	stub.MockTransactionEnd("init")
+
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{`{"selector": {"type": "holder"}}`, "alice,bob,carol"},
+		{`{"selector": {"type": "holder", "country": "CH"}}`, "alice,carol"},
+		{`{"selector": {"balance": {"$gt": 20, "$lte": 100}}}`, "alice,carol"},
+		{`{"selector": {"balance": {"$gte": 0}}, "sort": [{"balance": "desc"}]}`, "alice,carol,bob"},
+		{`{"selector": {"type": "holder"}, "sort": ["balance"], "skip": 1, "limit": 1}`, "carol"},
+		{`{"selector": {"country": {"$in": ["DE", "FR"]}}}`, "bob"},
+		{`{"selector": {"country": {"$nin": ["DE"]}, "type": {"$ne": "token"}}}`, "alice,carol"},
+		{`{"selector": {"tags": {"$exists": false}}}`, "carol,token"},
+		{`{"selector": {"tags": {"$all": ["kyc", "vip"]}}}`, "alice"},
+		{`{"selector": {"tags": {"$elemMatch": {"$eq": "kyc"}}}}`, "alice,bob"},
+		{`{"selector": {"tags": {"$size": 1}}}`, "bob"},
+		{`{"selector": {"address.city": "Bern"}}`, "alice"},
+		{`{"selector": {"address": {"city": {"$regex": "^B"}}}}`, "alice"},
+		{`{"selector": {"$or": [{"balance": 20}, {"name": "FabricToken"}]}}`, "bob,token"},
+		{`{"selector": {"$and": [{"type": "holder"}, {"$not": {"country": "CH"}}]}}`, "bob"},
+		{`{"selector": {"$nor": [{"type": "holder"}]}}`, "token"},
+	}
+
+	for _, c := range cases {
+		keys, err := queryKeys(stub, c.query)
+		if err != nil {
+			t.Errorf("Query %s failed: %s", c.query, err)
+		} else if keys != c.expected {
+			t.Errorf("Query %s returned %q, expected %q", c.query, keys, c.expected)
+		}
+	}
+
+	for _, query := range []string{`{}`, `not json`, `{"selector": {"balance": {"$unknown": 1}}}`, `{"selector": {"$or": {}}}`} {
+		if _, err := queryKeys(stub, query); err == nil {
+			t.Errorf("Expected query %s to fail", query)
+		}
+	}
+}
+
+func TestGetQueryResultFields(t *testing.T) {
+	stub := NewFullMockStub("cc", nil)
+	stub.MockTransactionStart("init")
+	stub.PutState("alice", []byte(`{"balance": 100, "address": {"city": "Bern", "zip": "3000"}}`))
+	stub.MockTransactionEnd("init")
+
+	iterator, err := stub.GetQueryResult(`{"selector": {"balance": 100}, "fields": ["address.city"]}`)
+	if err != nil || !iterator.HasNext() {
+		t.Fatal("Expected a result")
+	}
+	kv, _ := iterator.Next()
+	if string(kv.Value) != `{"address":{"city":"Bern"}}` {
+		t.Errorf("Unexpected projection %s", kv.Value)
+	}
+}
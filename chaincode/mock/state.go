@@ -0,0 +1,177 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"unicode/utf8"
+)
+
+// key of the public state, with an empty collection, or of private data
+type stateKey struct {
+	collection string
+	key        string
+}
+
+func (k stateKey) less(other stateKey) bool {
+	if k.collection != other.collection {
+		return k.collection < other.collection
+	}
+	return k.key < other.key
+}
+
+// updates the version of a committed key, a deleted key has no version
+func (stub *FullMockStub) committed(collection, key string, deleted bool) {
+	if deleted {
+		delete(stub.versions, stateKey{collection, key})
+		return
+	}
+	stub.height++
+	stub.versions[stateKey{collection, key}] = stub.height
+}
+
+func (stub *FullMockStub) GetState(key string) ([]byte, error) {
+	if stub.sim != nil {
+		stub.sim.read(stub, "", key)
+	}
+	return stub.MockStub.GetState(key)
+}
+
+func (stub *FullMockStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if stub.sim != nil {
+		stub.sim.write(KVWrite{Key: key, Value: value})
+		return nil
+	}
+
+	if err := stub.MockStub.PutState(key, value); err != nil {
+		return err
+	}
+	stub.committed("", key, false)
+	stub.recordHistory(key, value, false)
+	return nil
+}
+
+func (stub *FullMockStub) DelState(key string) error {
+	if stub.sim != nil {
+		stub.sim.write(KVWrite{Key: key, IsDelete: true})
+		return nil
+	}
+
+	if err := stub.MockStub.DelState(key); err != nil {
+		return err
+	}
+	stub.committed("", key, true)
+	stub.recordHistory(key, nil, true)
+	return nil
+}
+
+func (stub *FullMockStub) SetStateValidationParameter(key string, ep []byte) error {
+	return stub.SetPrivateDataValidationParameter("", key, ep)
+}
+
+func (stub *FullMockStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if stub.sim == nil {
+		return stub.MockStub.GetStateByRange(startKey, endKey)
+	}
+	if _, err := stub.MockStub.GetStateByRange(startKey, endKey); err != nil {
+		return nil, err
+	}
+	return stub.simulatedRange("", startKey, endKey), nil
+}
+
+func (stub *FullMockStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	if stub.sim == nil {
+		return stub.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+	}
+	partialKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.simulatedRange("", partialKey, partialKey+string(utf8.MaxRune)), nil
+}
+
+// only the last write of a transaction to a key is kept in its history
+func (stub *FullMockStub) recordHistory(key string, value []byte, isDelete bool) {
+	modification := &queryresult.KeyModification{
+		TxId:      stub.TxID,
+		Value:     value,
+		Timestamp: stub.txTimestamp,
+		IsDelete:  isDelete,
+	}
+
+	history := stub.history[key]
+	if len(history) > 0 && history[len(history)-1].TxId == stub.TxID {
+		history[len(history)-1] = modification
+		return
+	}
+	stub.history[key] = append(history, modification)
+}
+
+// history of the key from its oldest modification, as Fabric 1.x returns it
+func (stub *FullMockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	if key == "" {
+		return nil, errors.New("key must not be an empty string")
+	}
+	return &historyIterator{modifications: append([]*queryresult.KeyModification{}, stub.history[key]...)}, nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (iter *historyIterator) HasNext() bool {
+	return len(iter.modifications) > 0
+}
+
+func (iter *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if len(iter.modifications) == 0 {
+		return nil, errors.New("Iterator has no more results")
+	}
+	modification := iter.modifications[0]
+	iter.modifications = iter.modifications[1:]
+	return modification, nil
+}
+
+func (iter *historyIterator) Close() error {
+	return nil
+}
+
+type sliceIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (iter *sliceIterator) HasNext() bool {
+	return len(iter.kvs) > 0
+}
+
+func (iter *sliceIterator) Next() (*queryresult.KV, error) {
+	if len(iter.kvs) == 0 {
+		return nil, errors.New("Iterator has no more results")
+	}
+	kv := iter.kvs[0]
+	iter.kvs = iter.kvs[1:]
+	return kv, nil
+}
+
+func (iter *sliceIterator) Close() error {
+	return nil
+}
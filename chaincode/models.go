@@ -16,12 +16,24 @@ limitations under the License.
 
 package main
 
+import (
+	"github.com/token/chaincode/confidential"
+)
+
 type Token struct {
 	Standard    string `json:"standard"`
 	Name        string `json:"name"`
 	Symbol      string `json:"symbol"`
 	Decimals    uint16 `json:"decimals"`
 	TotalSupply uint64 `json:"totalSupply"`
+	// PEM public key of the auditor opening confidential amounts
+	AuditorKey string `json:"auditorKey,omitempty"`
+	// account of Idemix callers, their pseudonym ("nym", default) or organizational unit ("ou")
+	IdemixAccounts string `json:"idemixAccounts,omitempty"`
+	// rules granting the roles to callers, see roles.go
+	Roles map[string][]RoleRule `json:"roles,omitempty"`
+	// minimum KYC level of holders receiving or sending tokens, 0 for no KYC
+	KYCLevel uint8 `json:"kycLevel,omitempty"`
 }
 
 type Balance struct {
@@ -35,7 +47,294 @@ type Transfer struct {
 	Value uint64 `json:"value"`
 }
 
+// Transfer event, Value being the gross amount of which the receiver gets Net
+type TransferEvent struct {
+	Transfer
+	Fee        uint64 `json:"fee"`
+	Net        uint64 `json:"net"`
+	FeeVersion uint64 `json:"feeVersion,omitempty"`
+	Collector  string `json:"collector,omitempty"`
+}
+
 type Approve struct {
 	Spender string `json:"spender"`
 	Value   uint64 `json:"value"`
 }
+
+type Endorsers struct {
+	User string   `json:"user"`
+	MSPs []string `json:"msps"`
+}
+
+// confidential deposit, transfer or withdrawal, Value is set for the public
+// amount of deposits and withdrawals
+type ConfidentialTransfer struct {
+	Kind        string                   `json:"kind"`
+	From        string                   `json:"from"`
+	To          string                   `json:"to"`
+	Value       uint64                   `json:"value,omitempty"`
+	Output      *confidential.Commitment `json:"output,omitempty"`
+	Change      *confidential.Commitment `json:"change,omitempty"`
+	OutputProof *confidential.RangeProof `json:"outputProof,omitempty"`
+	ChangeProof *confidential.RangeProof `json:"changeProof,omitempty"`
+	// openings sealed for the auditor, and the output opening for the receiver
+	OutputAudit []byte `json:"outputAudit,omitempty"`
+	ChangeAudit []byte `json:"changeAudit,omitempty"`
+	Memo        []byte `json:"memo,omitempty"`
+}
+
+type ConfidentialBalance struct {
+	User       string                   `json:"user"`
+	Commitment *confidential.Commitment `json:"commitment"`
+}
+
+// certificate on the revocation list, by serial number of its MSP or subject key ID (hex)
+type Revocation struct {
+	MspID  string `json:"mspId,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	SKI    string `json:"ski,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// guardians approving the recovery of the user's account, Threshold of them are needed
+type Guardians struct {
+	User      string   `json:"user"`
+	Guardians []string `json:"guardians"`
+	Threshold int      `json:"threshold"`
+}
+
+// approvals to migrate the account From to the account To
+type Recovery struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Approvals []string `json:"approvals,omitempty"`
+	// approved by an admin, or by the holder of From rotating its certificate
+	Approved bool `json:"approved,omitempty"`
+	// private data collections whose balances the migration moves
+	Collections []string `json:"collections,omitempty"`
+}
+
+// account From moved to To, From is no longer usable
+type Migration struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Value      uint64 `json:"value"`
+	Allowances int    `json:"allowances"`
+	TxID       string `json:"txId"`
+	Timestamp  string `json:"timestamp"`
+}
+
+// entry of the KYC allowlist, verified up to Expiry (RFC 3339)
+type KYC struct {
+	User     string `json:"user"`
+	Level    uint8  `json:"level"`
+	Expiry   string `json:"expiry"`
+	Provider string `json:"provider,omitempty"`
+	// ISO 3166 code of the holder, checked by the country restrictions
+	Country string `json:"country,omitempty"`
+}
+
+type KYCStatus struct {
+	KYC
+	// the level is enough and not expired at the transaction time
+	Verified bool `json:"verified"`
+}
+
+// transfer restrictions configured on the ledger, zero values disable a rule
+type TransferRules struct {
+	MaxHolders uint64 `json:"maxHolders,omitempty"`
+	MaxBalance uint64 `json:"maxBalance,omitempty"`
+	// countries of the KYC entries, holders need one of the allowed ones if any
+	AllowedCountries []string `json:"allowedCountries,omitempty"`
+	BlockedCountries []string `json:"blockedCountries,omitempty"`
+}
+
+// tokens of the user can't be sent before Until (RFC 3339)
+type LockUp struct {
+	User  string `json:"user"`
+	Until string `json:"until"`
+}
+
+type Restriction struct {
+	Code    uint8  `json:"code"`
+	Message string `json:"message"`
+}
+
+// spending limits of an account, or of a tier when User is empty; zero limits
+// of an account are the ones of its tier, zero limits of a tier are no limits
+type VelocityLimits struct {
+	User        string `json:"user,omitempty"`
+	Tier        string `json:"tier,omitempty"`
+	PerTransfer uint64 `json:"perTransfer,omitempty"`
+	Daily       uint64 `json:"daily,omitempty"`
+}
+
+// limits applying to the user, with what it sent in the last 24 hours; the
+// remaining amounts are only set when limited
+type VelocityStatus struct {
+	VelocityLimits
+	Spent          uint64  `json:"spent"`
+	RemainingDaily *uint64 `json:"remainingDaily,omitempty"`
+	MaxTransfer    *uint64 `json:"maxTransfer,omitempty"`
+}
+
+// party of the sanctions list, by the hex SHA-256 of its CN, or by its MSP
+// and CN; List is the list it comes from
+type Sanction struct {
+	Hash  string `json:"hash,omitempty"`
+	MspID string `json:"mspId,omitempty"`
+	CN    string `json:"cn,omitempty"`
+	List  string `json:"list,omitempty"`
+}
+
+// chunk Chunk of Chunks of a sanctions list import or removal
+type SanctionsBatch struct {
+	List string `json:"list"`
+	// chosen by the client to tell the chunks of an import from earlier ones
+	Import  string     `json:"import,omitempty"`
+	Chunk   int        `json:"chunk"`
+	Chunks  int        `json:"chunks"`
+	Entries []Sanction `json:"entries"`
+	// entries added or removed by the chunk, set in the event
+	Changed int `json:"changed"`
+}
+
+// call blocked because Party is sanctioned, From is empty for mints
+type SanctionsHit struct {
+	TxID     string `json:"txId"`
+	Function string `json:"function"`
+	Caller   string `json:"caller"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Value    uint64 `json:"value"`
+	Party    string `json:"party"`
+	List     string `json:"list,omitempty"`
+}
+
+// chunks of an import received so far, complete when none is missing
+type SanctionsImport struct {
+	List     string `json:"list"`
+	Import   string `json:"import,omitempty"`
+	Chunks   int    `json:"chunks"`
+	Received []int  `json:"received"`
+	Missing  []int  `json:"missing"`
+	Complete bool   `json:"complete"`
+}
+
+type SanctionStatus struct {
+	User       string `json:"user"`
+	MspID      string `json:"mspId,omitempty"`
+	Sanctioned bool   `json:"sanctioned"`
+	List       string `json:"list,omitempty"`
+}
+
+// fee of transfers from Min, instead of the flat part and basis points of the schedule
+type FeeTier struct {
+	Min  uint64 `json:"min"`
+	Flat uint64 `json:"flat,omitempty"`
+	BPS  uint64 `json:"bps,omitempty"`
+}
+
+// fees of transfers, credited to Collector; transfers from or to an exempt
+// account have no fee. The version is set by the chaincode
+type FeeSchedule struct {
+	Version   uint64    `json:"version"`
+	Collector string    `json:"collector,omitempty"`
+	Flat      uint64    `json:"flat,omitempty"`
+	BPS       uint64    `json:"bps,omitempty"`
+	Tiers     []FeeTier `json:"tiers,omitempty"`
+	Exempt    []string  `json:"exempt,omitempty"`
+}
+
+// balances and the total supply are recorded as of the snapshot Time (RFC 3339)
+type Snapshot struct {
+	ID   uint64 `json:"id"`
+	Time string `json:"time"`
+}
+
+type SnapshotBalance struct {
+	User       string `json:"user"`
+	SnapshotID uint64 `json:"snapshotId"`
+	Value      uint64 `json:"value"`
+}
+
+type SnapshotSupply struct {
+	SnapshotID  uint64 `json:"snapshotId"`
+	TotalSupply uint64 `json:"totalSupply"`
+}
+
+// payout of Amount in this token, or in the Token chaincode, to the holders at the snapshot.
+// PerUnit and Cumulative are scaled by 10^18, Dust is carried to the next distribution
+type Distribution struct {
+	ID         uint64 `json:"id"`
+	Token      string `json:"token,omitempty"`
+	Payer      string `json:"payer,omitempty"`
+	Amount     uint64 `json:"amount"`
+	SnapshotID uint64 `json:"snapshotId"`
+	Time       string `json:"time"`
+	PerUnit    string `json:"perUnit"`
+	Cumulative string `json:"cumulative"`
+	Dust       uint64 `json:"dust"`
+}
+
+// distributions of a token by a payer, Funded being what left the balances,
+// what was paid back to them is in the holders' claims
+type DividendSeries struct {
+	LastID     uint64 `json:"lastId"`
+	Funded     uint64 `json:"funded"`
+	Cumulative string `json:"cumulative"`
+	Dust       uint64 `json:"dust"`
+}
+
+// Value paid to the user for the distributions up to LastID, Claimed adding up every
+// claim and Remainder (scaled by 10^18) being left for the next one
+type DividendClaim struct {
+	User      string `json:"user"`
+	Token     string `json:"token,omitempty"`
+	Payer     string `json:"payer,omitempty"`
+	LastID    uint64 `json:"lastId"`
+	Value     uint64 `json:"value"`
+	Claimed   uint64 `json:"claimed"`
+	Remainder string `json:"remainder"`
+}
+
+// Rate is paid per second out of the Pool to the TotalStaked tokens, Rewards being
+// allocated and not claimed yet. RewardPerToken is scaled by 10^18
+type Staking struct {
+	Rate           uint64 `json:"rate"`
+	Pool           uint64 `json:"pool"`
+	TotalStaked    uint64 `json:"totalStaked"`
+	Rewards        uint64 `json:"rewards"`
+	RewardPerToken string `json:"rewardPerToken"`
+	LastUpdate     string `json:"lastUpdate"`
+}
+
+// rewards per second, and the amount the admin adds to the pool
+type StakingRewards struct {
+	Rate uint64 `json:"rate"`
+	Fund uint64 `json:"fund"`
+}
+
+type StakingAccount struct {
+	User               string `json:"user"`
+	Staked             uint64 `json:"staked"`
+	RewardPerTokenPaid string `json:"rewardPerTokenPaid"`
+	Rewards            uint64 `json:"rewards"`
+}
+
+// Amount locked for LockPeriod seconds, from Start to Maturity (RFC 3339)
+type Stake struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Amount     uint64 `json:"amount"`
+	LockPeriod uint64 `json:"lockPeriod"`
+	Start      string `json:"start"`
+	Maturity   string `json:"maturity"`
+}
+
+type StakedBalance struct {
+	User    string  `json:"user"`
+	Value   uint64  `json:"value"`
+	Rewards uint64  `json:"rewards"`
+	Stakes  []Stake `json:"stakes"`
+}
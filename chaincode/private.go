@@ -0,0 +1,374 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Confidential balances are kept in private data collections, usually one per
+// pair of organisations (see collections.go). Only the hashes of the private
+// writes reach the channel, and the amounts are passed in the transient map
+// under TransientTransfer so they are not recorded in the transaction either.
+// Deposits and withdrawals are checked like public transfers of the holder to
+// itself and like mints, and deposits pay the transfer fee. Transfers within a
+// collection only check the sender and the KYC of the receiver: reading its
+// other public entries would reveal more of it, and its tokens are checked
+// when they leave the collection.
+// A migration moves the private balances in the collections it lists, which
+// its endorsers must be able to read, and the ones in other collections are
+// moved afterwards, one collection at a time.
+// The tokens in all collections are counted in public, as the amounts of the
+// deposits and withdrawals already are, so dividends leave them out.
+
+const TransientTransfer = "transfer"
+const KeyPrivateSupply = "__private"
+
+// tokens out of the public balances, in the collections or in confidential balances
+func shieldedSupply(stub shim.ChaincodeStubInterface, key string) (uint64, error) {
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+func updateShieldedSupply(stub shim.ChaincodeStubInterface, key string, added, removed uint64) error {
+	supply, err := shieldedSupply(stub, key)
+	if err != nil {
+		return err
+	}
+	if supply+added < supply || supply+added < removed {
+		return errors.New("Shielded supply overflow")
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, supply+added-removed)
+	return stub.PutState(key, data)
+}
+
+func (t *TokenChaincode) setPrivateBalance(stub shim.ChaincodeStubInterface, collection, cn string, balance uint64) error {
+	key, err := stub.CreateCompositeKey(IndexBalance, []string{cn})
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, balance)
+	return stub.PutPrivateData(collection, key, data)
+}
+
+func (t *TokenChaincode) privateBalance(stub shim.ChaincodeStubInterface, collection, cn string) (uint64, error) {
+	key, err := stub.CreateCompositeKey(IndexBalance, []string{cn})
+	if err != nil {
+		return 0, err
+	}
+	data, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// if the user cn is not in the collection, then the balance is 0
+	if data == nil {
+		return 0, nil
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// the collection from the args and the transfer from the transient map
+func privateTransferArgs(stub shim.ChaincodeStubInterface, args []string) (string, Transfer, error) {
+	transfer := Transfer{}
+	if len(args) != 1 || args[0] == "" {
+		return "", transfer, errors.New("Expected the collection name")
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return "", transfer, errors.New("Error getting transient data")
+	}
+	transferBytes, ok := transient[TransientTransfer]
+	if !ok {
+		return "", transfer, errors.New("Expected the transfer in the transient data")
+	}
+	err = json.Unmarshal(transferBytes, &transfer)
+	if err != nil {
+		return "", transfer, errors.New("Error parsing transfer json")
+	}
+	return args[0], transfer, nil
+}
+
+// moves tokens of the caller from the public state to the collection
+func (t *TokenChaincode) privateDeposit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	collection, transfer, err := privateTransferArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	deposit := Transfer{From: caller, To: caller, Value: transfer.Value}
+	if res := checkSanctions(stub, "privateDeposit", deposit); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, deposit); res != nil {
+		return *res
+	}
+	event, err := transferFee(stub, deposit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	publicBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	privateBalance, err := t.privateBalance(stub, collection, caller)
+	if err != nil {
+		return shim.Error("Error getting private balance: " + err.Error())
+	}
+
+	if publicBalance < transfer.Value {
+		return shim.Error("Not enough balance")
+	}
+	if privateBalance+event.Net < privateBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	err = t.setBalance(stub, caller, publicBalance-transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting balance")
+	}
+	err = recordFee(stub, event)
+	if err != nil {
+		return shim.Error("Error recording fee")
+	}
+	err = t.setPrivateBalance(stub, collection, caller, privateBalance+event.Net)
+	if err != nil {
+		return shim.Error("Error setting private balance")
+	}
+	err = updateShieldedSupply(stub, KeyPrivateSupply, event.Net, 0)
+	if err != nil {
+		return shim.Error("Error updating private supply: " + err.Error())
+	}
+	err = recordSpending(stub, caller, transfer.Value)
+	if err != nil {
+		return shim.Error("Error recording spending")
+	}
+
+	return shim.Success(nil)
+}
+
+// moves tokens of the caller from the collection back to the public state
+func (t *TokenChaincode) privateWithdraw(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	collection, transfer, err := privateTransferArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	// the tokens enter the public state as if they were minted to the caller
+	withdrawal := Transfer{To: caller, Value: transfer.Value}
+	if res := checkSanctions(stub, "privateWithdraw", withdrawal); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, withdrawal); res != nil {
+		return *res
+	}
+
+	privateBalance, err := t.privateBalance(stub, collection, caller)
+	if err != nil {
+		return shim.Error("Error getting private balance: " + err.Error())
+	}
+	publicBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+
+	if privateBalance < transfer.Value {
+		return shim.Error("Not enough balance")
+	}
+	if publicBalance+transfer.Value < publicBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	err = t.setPrivateBalance(stub, collection, caller, privateBalance-transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting private balance")
+	}
+	err = t.setBalance(stub, caller, publicBalance+transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting balance")
+	}
+	err = updateShieldedSupply(stub, KeyPrivateSupply, 0, transfer.Value)
+	if err != nil {
+		return shim.Error("Error updating private supply: " + err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// transfer within a collection, no event is set since it would be public
+func (t *TokenChaincode) privateTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	collection, transfer, err := privateTransferArgs(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	from, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting from data")
+	}
+
+	// to prevent "generating" tokens because of
+	// committed state reading
+	if from == transfer.To {
+		return shim.Success(nil)
+	}
+	if err := checkNotMigrated(stub, from, transfer.To); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "privateTransfer", Transfer{From: from}); res != nil {
+		return *res
+	}
+	if res := t.checkKYC(stub, Transfer{From: from, To: transfer.To}); res != nil {
+		return *res
+	}
+
+	fromBalance, err := t.privateBalance(stub, collection, from)
+	if err != nil {
+		return shim.Error("Error getting private balance: " + err.Error())
+	}
+	toBalance, err := t.privateBalance(stub, collection, transfer.To)
+	if err != nil {
+		return shim.Error("Error getting private balance: " + err.Error())
+	}
+
+	if fromBalance < transfer.Value {
+		return shim.Error("Not enough balance")
+	}
+	if toBalance+transfer.Value < toBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	err = t.setPrivateBalance(stub, collection, from, fromBalance-transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting to or from balance")
+	}
+	err = t.setPrivateBalance(stub, collection, transfer.To, toBalance+transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting to or from balance")
+	}
+
+	return shim.Success(nil)
+}
+
+// moves the private balance of a predecessor of the caller to its account
+func (t *TokenChaincode) privateMigrate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 || args[0] == "" {
+		return shim.Error("Expected the collection and the migrated account")
+	}
+	collection := args[0]
+	rq := Recovery{}
+	if err := json.Unmarshal([]byte(args[1]), &rq); err != nil {
+		return shim.Error("Error parsing recovery json")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	found, err := getJson(stub, IndexPredecessor, []string{caller, rq.From}, &Migration{})
+	if err != nil {
+		return shim.Error("Error getting migration")
+	}
+	if !found {
+		return shim.Error("Account " + rq.From + " was not migrated to " + caller)
+	}
+	if res := checkSanctions(stub, "privateMigrate", Transfer{From: rq.From, To: caller}); res != nil {
+		return *res
+	}
+
+	if err := t.movePrivateBalance(stub, collection, rq.From, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// moves the whole private balance in the collection, failing if there is none
+func (t *TokenChaincode) movePrivateBalance(stub shim.ChaincodeStubInterface, collection, from, to string) error {
+	fromBalance, err := t.privateBalance(stub, collection, from)
+	if err != nil {
+		return errors.New("Error getting private balance: " + err.Error())
+	}
+	toBalance, err := t.privateBalance(stub, collection, to)
+	if err != nil {
+		return errors.New("Error getting private balance: " + err.Error())
+	}
+	if fromBalance == 0 {
+		return errors.New("No private balance to migrate")
+	}
+	if toBalance+fromBalance < toBalance {
+		return errors.New("Receiver balance overflow")
+	}
+
+	err = t.setPrivateBalance(stub, collection, from, 0)
+	if err != nil {
+		return errors.New("Error setting to or from balance")
+	}
+	err = t.setPrivateBalance(stub, collection, to, toBalance+fromBalance)
+	if err != nil {
+		return errors.New("Error setting to or from balance")
+	}
+	return nil
+}
+
+// readable by the clients of the collection members only
+func (t *TokenChaincode) privateBalanceAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Expected collection and user to query")
+	}
+	balanceRq := Balance{}
+	if err := json.Unmarshal([]byte(args[1]), &balanceRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	balance, err := t.privateBalance(stub, args[0], balanceRq.User)
+	if err != nil {
+		return shim.Error("Error getting private balance: " + err.Error())
+	}
+
+	result, _ := json.Marshal(Balance{User: balanceRq.User, Value: balance})
+	return shim.Success(result)
+}
@@ -0,0 +1,276 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var privateBanks = []*testca.Identity{
+	testca.MustNew("Org1MSP").MustIssue("bank1", testca.Options{}),
+	testca.MustNew("Org2MSP").MustIssue("bank2", testca.Options{}),
+	testca.MustNew("Org3MSP").MustIssue("bank3", testca.Options{}),
+}
+
+var privateCollection = BilateralCollectionName("Org2MSP", "Org1MSP")
+
+// bank1 holds 1000 public tokens, the collection of bank1 and bank2 is empty
+func privateLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	stub.MockCollection(privateCollection, "Org1MSP", "Org2MSP")
+
+	bank1 := privateBanks[0]
+	stub.MockCreator(bank1.MspID, bank1.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", `{"name": "Settlement", "totalSupply": 1000}`)); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	return stub
+}
+
+func privateInvoke(stub *mock.FullMockStub, caller *testca.Identity, function, transferData string) pb.Response {
+	stub.MockCreator(caller.MspID, caller.CertPEM)
+	stub.MockTransient(map[string][]byte{TransientTransfer: []byte(transferData)})
+	defer stub.MockTransient(nil)
+	return stub.MockInvoke(function, util.ToChaincodeArgs(function, privateCollection))
+}
+
+func queryPrivateBalance(stub *mock.FullMockStub, caller *testca.Identity, cn string) (uint64, error) {
+	stub.MockCreator(caller.MspID, caller.CertPEM)
+	res := stub.MockInvoke("privateBalance", util.ToChaincodeArgs("privateBalance", privateCollection, `{"user": "`+cn+`"}`))
+	if res.Status != shim.OK {
+		return 0, errors.New(res.Message)
+	}
+	b := Balance{}
+	err := json.Unmarshal(res.Payload, &b)
+	return b.Value, err
+}
+
+func TestPrivateTransfers(t *testing.T) {
+	stub := privateLedger(t)
+	bank1, bank2 := privateBanks[0], privateBanks[1]
+
+	if res := privateInvoke(stub, bank1, "privateDeposit", `{"value": 300}`); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "bank1"); b.Value != 700 {
+		t.Errorf("Expected 700 public tokens after the deposit, got %d", b.Value)
+	}
+
+	// the transfer only changes the collection
+	public := map[string][]byte{}
+	for key, value := range stub.State {
+		public[key] = value
+	}
+	events := len(stub.Events)
+	if res := privateInvoke(stub, bank1, "privateTransfer", `{"to": "bank2", "value": 100}`); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if !reflect.DeepEqual(public, stub.State) || len(stub.Events) != events {
+		t.Error("Expected a private transfer to leave the public state and events unchanged")
+	}
+	if res := privateInvoke(stub, bank1, "privateTransfer", `{"to": "bank2", "value": 201}`); res.Status == shim.OK {
+		t.Error("Expected a transfer above the private balance to fail")
+	}
+
+	for _, expected := range []struct {
+		cn    string
+		value uint64
+	}{{"bank1", 200}, {"bank2", 100}} {
+		value, err := queryPrivateBalance(stub, bank2, expected.cn)
+		if err != nil || value != expected.value {
+			t.Errorf("Expected %s to hold %d private tokens, got %d (%v)", expected.cn, expected.value, value, err)
+		}
+	}
+
+	if res := privateInvoke(stub, bank2, "privateWithdraw", `{"value": 60}`); res.Status != shim.OK {
+		t.Fatal("Withdraw failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "bank2"); b.Value != 60 {
+		t.Errorf("Expected 60 public tokens after the withdrawal, got %d", b.Value)
+	}
+	if value, _ := queryPrivateBalance(stub, bank2, "bank2"); value != 40 {
+		t.Errorf("Expected 40 private tokens after the withdrawal, got %d", value)
+	}
+}
+
+func TestPrivateMigrate(t *testing.T) {
+	stub := privateLedger(t)
+	bank1, bank2 := privateBanks[0], privateBanks[1]
+	privateInvoke(stub, bank1, "privateDeposit", `{"value": 300}`)
+	privateInvoke(stub, bank1, "privateTransfer", `{"to": "bank2", "value": 100}`)
+
+	migrate := func(caller *testca.Identity) pb.Response {
+		stub.MockCreator(caller.MspID, caller.CertPEM)
+		return stub.MockInvoke("migrate", util.ToChaincodeArgs("privateMigrate", privateCollection, `{"from": "bank1"}`))
+	}
+	if res := migrate(bank2); res.Status == shim.OK {
+		t.Error("Expected only the new holder of a migrated account to move its private balance")
+	}
+	stub.MockCreator(bank1.MspID, bank1.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approveRecovery", `{"from": "bank1", "to": "bank2"}`))
+	stub.MockCreator(bank2.MspID, bank2.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("migrateAccount", `{"from": "bank1"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	if res := migrate(bank2); res.Status != shim.OK {
+		t.Fatal("PrivateMigrate failed: " + res.Message)
+	}
+	b1, _ := queryPrivateBalance(stub, bank2, "bank1")
+	b2, _ := queryPrivateBalance(stub, bank2, "bank2")
+	if b1 != 0 || b2 != 300 {
+		t.Errorf("Expected the private balances to add up to 300, got (%d, %d)", b1, b2)
+	}
+	if res := migrate(bank2); res.Status == shim.OK {
+		t.Error("Expected nothing left to migrate")
+	}
+}
+
+func TestMigrateAccountWithCollections(t *testing.T) {
+	stub := privateLedger(t)
+	bank1, bank2 := privateBanks[0], privateBanks[1]
+	privateInvoke(stub, bank1, "privateDeposit", `{"value": 300}`)
+
+	stub.MockCreator(bank1.MspID, bank1.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approveRecovery", `{"from": "bank1", "to": "bank2"}`))
+	stub.MockCreator(bank2.MspID, bank2.CertPEM)
+	migration := fmt.Sprintf(`{"from": "bank1", "collections": ["%s"]}`, privateCollection)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("migrateAccount", migration)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	b1, _ := queryPrivateBalance(stub, bank2, "bank1")
+	b2, _ := queryPrivateBalance(stub, bank2, "bank2")
+	if b1 != 0 || b2 != 300 {
+		t.Errorf("Expected the private balance to move with the account, got (%d, %d)", b1, b2)
+	}
+
+	// the tombstone receives no private tokens either
+	if res := privateInvoke(stub, bank2, "privateTransfer", `{"to": "bank1", "value": 100}`); res.Status == shim.OK {
+		t.Error("Expected a private transfer to a migrated account to fail")
+	}
+}
+
+func TestPrivateCompliance(t *testing.T) {
+	stub := rolesLedger(t)
+	stub.MockCollection(privateCollection, "Org1MSP", "Org2MSP")
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	alice, carol := recoveryActors["alice"], recoveryActors["carol"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 100}`))
+	setFees(t, stub, `{"collector": "treasury", "flat": 1}`)
+
+	// deposits pay the fee
+	if res := privateInvoke(stub, alice, "privateDeposit", `{"value": 50}`); res.Status != shim.OK {
+		t.Fatal("Deposit failed: " + res.Message)
+	}
+	public, _ := balance(stub, "alice")
+	collected, _, _ := pendingFees(stub, "treasury")
+	private, _ := queryPrivateBalance(stub, alice, "alice")
+	if public.Value != 50 || private != 49 || collected != 1 {
+		t.Errorf("Expected 50 public, 49 private and a fee of 1, got (%d, %d, %d)", public.Value, private, collected)
+	}
+
+	// locked up tokens don't enter a collection
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	lockUp := fmt.Sprintf(`{"user": "carol", "until": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("setLockUp", lockUp)); res.Status != shim.OK {
+		t.Fatal("SetLockUp failed: " + res.Message)
+	}
+	if res := privateInvoke(stub, carol, "privateDeposit", `{"value": 10}`); res.Status != StatusRestricted {
+		t.Errorf("Expected the deposit to be restricted, got %d %s", res.Status, res.Message)
+	}
+
+	// sanctioned holders neither enter, move within nor leave a collection
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("importSanctions", `{"list": "OFAC", "chunk": 0, "chunks": 1, "entries": [{"mspId": "Org1MSP", "cn": "alice"}]}`)); res.Status != shim.OK {
+		t.Fatal("ImportSanctions failed: " + res.Message)
+	}
+	for _, call := range []string{"privateDeposit", "privateTransfer", "privateWithdraw"} {
+		if res := privateInvoke(stub, alice, call, `{"to": "carol", "value": 1}`); res.Status != StatusSanctioned {
+			t.Errorf("Expected %s to be blocked, got %d %s", call, res.Status, res.Message)
+		}
+	}
+}
+
+func TestPrivateBalanceOfOtherOrg(t *testing.T) {
+	stub := privateLedger(t)
+	privateInvoke(stub, privateBanks[0], "privateDeposit", `{"value": 300}`)
+
+	if _, err := queryPrivateBalance(stub, privateBanks[2], "bank1"); err == nil {
+		t.Error("Expected an org outside the collection not to read the balance")
+	}
+	if res := privateInvoke(stub, privateBanks[2], "privateTransfer", `{"to": "bank2", "value": 0}`); res.Status == shim.OK {
+		t.Error("Expected an org outside the collection not to transfer")
+	}
+}
+
+func TestPrivateTransferAmountInTransient(t *testing.T) {
+	stub := privateLedger(t)
+	bank1 := privateBanks[0]
+	privateInvoke(stub, bank1, "privateDeposit", `{"value": 300}`)
+
+	stub.MockCreator(bank1.MspID, bank1.CertPEM)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("privateTransfer", privateCollection, `{"to": "bank2", "value": 100}`))
+	if res.Status == shim.OK {
+		t.Error("Expected a transfer without transient data to fail")
+	}
+
+	// only the private writes carry the amounts, Fabric puts their hashes on the channel
+	result := stub.MockEndorse(mock.Proposal{
+		TxID:      "tx1",
+		MspID:     bank1.MspID,
+		Cert:      bank1.CertPEM,
+		Args:      util.ToChaincodeArgs("privateTransfer", privateCollection),
+		Transient: map[string][]byte{TransientTransfer: []byte(`{"to": "bank2", "value": 100}`)},
+	})
+	if !result.Endorsed() {
+		t.Fatal("Transfer failed: " + result.Response.Message)
+	}
+	for _, write := range result.RWSet.Writes {
+		if write.Collection != privateCollection {
+			t.Errorf("Expected only private writes, got %q", write.Key)
+		}
+	}
+}
+
+func TestBilateralCollections(t *testing.T) {
+	configs := BilateralCollections([]string{"Org3MSP", "Org1MSP", "Org2MSP"})
+	names := []string{}
+	for _, config := range configs {
+		names = append(names, config.Name)
+		if !config.MemberOnlyRead || config.RequiredPeerCount < 1 {
+			t.Errorf("Expected %s to be readable by members only and disseminated", config.Name)
+		}
+	}
+	expected := []string{"Org1MSP-Org2MSP", "Org1MSP-Org3MSP", "Org2MSP-Org3MSP"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected collections %v, got %v", expected, names)
+	}
+	if configs[0].Policy != "OR('Org1MSP.member','Org2MSP.member')" {
+		t.Errorf("Unexpected policy %s", configs[0].Policy)
+	}
+}
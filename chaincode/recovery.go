@@ -0,0 +1,531 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/confidential"
+	"time"
+)
+
+// Recovery of an account whose certificate was re-issued under another CN.
+// The new identity gets approvals to take over the old account, from the old
+// holder itself, from an admin, or from enough of the guardians registered
+// by the old holder. Migrating is checked like a transfer of the balance to
+// the new account, then moves the balances, stakes, allowances and compliance
+// entries and tombstones the old account, which keeps pointing to the new one.
+
+const IndexGuardians = "cn~guardians"
+const IndexRecovery = "from~to~recovery"
+const IndexMigrated = "cn~migrated"
+const IndexPredecessor = "cn~from~predecessor"
+
+// the migration of the account, nil if it was not migrated
+func accountMigration(stub shim.ChaincodeStubInterface, cn string) (*Migration, error) {
+	key, err := stub.CreateCompositeKey(IndexMigrated, []string{cn})
+	if err != nil {
+		return nil, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	migration := &Migration{}
+	err = json.Unmarshal(data, migration)
+	return migration, err
+}
+
+// fails if one of the accounts was migrated
+func checkNotMigrated(stub shim.ChaincodeStubInterface, accounts ...string) error {
+	for _, cn := range accounts {
+		migration, err := accountMigration(stub, cn)
+		if err != nil {
+			return errors.New("Error getting migration")
+		}
+		if migration != nil {
+			return errors.New("Account " + cn + " was migrated to " + migration.To)
+		}
+	}
+	return nil
+}
+
+func guardians(stub shim.ChaincodeStubInterface, cn string) (Guardians, error) {
+	guardians := Guardians{User: cn, Guardians: []string{}}
+	key, err := stub.CreateCompositeKey(IndexGuardians, []string{cn})
+	if err != nil {
+		return guardians, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return guardians, err
+	}
+	err = json.Unmarshal(data, &guardians)
+	return guardians, err
+}
+
+func putJson(stub shim.ChaincodeStubInterface, index string, attributes []string, value interface{}) error {
+	key, err := stub.CreateCompositeKey(index, attributes)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(value)
+	return stub.PutState(key, data)
+}
+
+// moves the JSON entry of the migrated account to the new one, which keeps its
+// own entry if it has one
+func moveEntry(stub shim.ChaincodeStubInterface, index, from, to string) error {
+	fromKey, err := stub.CreateCompositeKey(index, []string{from})
+	if err != nil {
+		return err
+	}
+	data, err := stub.GetState(fromKey)
+	if err != nil || data == nil {
+		return err
+	}
+	if err := stub.DelState(fromKey); err != nil {
+		return err
+	}
+	toKey, err := stub.CreateCompositeKey(index, []string{to})
+	if err != nil {
+		return err
+	}
+	toData, err := stub.GetState(toKey)
+	if err != nil || toData != nil {
+		return err
+	}
+
+	// numbers are kept as they are, amounts may not fit a float64
+	entry := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		return err
+	}
+	entry["user"] = to
+	return putJson(stub, index, []string{to}, entry)
+}
+
+// sets the guardians of the caller's account, no guardians remove them
+func (t *TokenChaincode) setGuardians(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetGuardians expected 1 argument")
+	}
+
+	config := Guardians{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return shim.Error("Error parsing guardians json")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if config.User != "" && config.User != caller {
+		return shim.Error("Only the holder can set the guardians of an account")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	seen := map[string]bool{}
+	for _, guardian := range config.Guardians {
+		if guardian == "" || guardian == caller || seen[guardian] {
+			return shim.Error("Guardians must be distinct other accounts")
+		}
+		seen[guardian] = true
+	}
+	if len(config.Guardians) > 0 && (config.Threshold < 1 || config.Threshold > len(config.Guardians)) {
+		return shim.Error("Threshold must be between 1 and the number of guardians")
+	}
+
+	key, err := stub.CreateCompositeKey(IndexGuardians, []string{caller})
+	if err != nil {
+		return shim.Error("Error creating guardians key")
+	}
+	if len(config.Guardians) == 0 {
+		err = stub.DelState(key)
+	} else {
+		config.User = caller
+		err = putJson(stub, IndexGuardians, []string{caller}, config)
+	}
+	if err != nil {
+		return shim.Error("Error saving guardians")
+	}
+
+	return shim.Success(nil)
+}
+
+func (t *TokenChaincode) guardiansAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	guardiansRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &guardiansRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	guardians, err := guardians(stub, guardiansRq.User)
+	if err != nil {
+		return shim.Error("Error getting guardians")
+	}
+	result, _ := json.Marshal(guardians)
+	return shim.Success(result)
+}
+
+func recovery(stub shim.ChaincodeStubInterface, from, to string) (Recovery, error) {
+	recovery := Recovery{From: from, To: to}
+	key, err := stub.CreateCompositeKey(IndexRecovery, []string{from, to})
+	if err != nil {
+		return recovery, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return recovery, err
+	}
+	err = json.Unmarshal(data, &recovery)
+	return recovery, err
+}
+
+// approves the migration of an account to another one, callers are the holder
+// of the account, an admin, or one of the account guardians
+func (t *TokenChaincode) approveRecovery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("ApproveRecovery expected 1 argument")
+	}
+
+	rq := Recovery{}
+	err := json.Unmarshal([]byte(args[0]), &rq)
+	if err != nil {
+		return shim.Error("Error parsing recovery json")
+	}
+	if rq.From == "" || rq.To == "" || rq.From == rq.To {
+		return shim.Error("Expected distinct accounts to migrate from and to")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, rq.From, rq.To); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recovery, err := recovery(stub, rq.From, rq.To)
+	if err != nil {
+		return shim.Error("Error getting recovery")
+	}
+	config, err := guardians(stub, rq.From)
+	if err != nil {
+		return shim.Error("Error getting guardians")
+	}
+
+	isGuardian := false
+	for _, guardian := range config.Guardians {
+		isGuardian = isGuardian || guardian == caller
+	}
+	switch {
+	case caller == rq.From:
+		recovery.Approved = true
+	case requireRole(stub, RoleAdmin) == nil:
+		recovery.Approved = true
+	case isGuardian:
+		for _, approval := range recovery.Approvals {
+			if approval == caller {
+				return shim.Error("Recovery already approved by " + caller)
+			}
+		}
+		recovery.Approvals = append(recovery.Approvals, caller)
+	default:
+		return shim.Error("Only the holder, an admin or a guardian can approve the recovery")
+	}
+
+	err = putJson(stub, IndexRecovery, []string{rq.From, rq.To}, recovery)
+	if err != nil {
+		return shim.Error("Error saving recovery")
+	}
+
+	evtData, _ := json.Marshal(Recovery{From: rq.From, To: rq.To, Approvals: []string{caller}})
+	stub.SetEvent("RecoveryApproved", evtData)
+	return shim.Success(nil)
+}
+
+// approvals of guardians which are still guardians of the account
+func guardianApprovals(config Guardians, recovery Recovery) int {
+	approvals := 0
+	for _, approval := range recovery.Approvals {
+		for _, guardian := range config.Guardians {
+			if approval == guardian {
+				approvals++
+			}
+		}
+	}
+	return approvals
+}
+
+// moves the approved account to the caller and tombstones it
+func (t *TokenChaincode) migrateAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("MigrateAccount expected 1 argument")
+	}
+
+	rq := Recovery{}
+	err := json.Unmarshal([]byte(args[0]), &rq)
+	if err != nil {
+		return shim.Error("Error parsing recovery json")
+	}
+
+	to, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if rq.To != "" && rq.To != to {
+		return shim.Error("Only the new holder can migrate an account")
+	}
+	if rq.From == "" || rq.From == to {
+		return shim.Error("Expected the account to migrate from")
+	}
+	if err := checkNotMigrated(stub, rq.From, to); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recovery, err := recovery(stub, rq.From, to)
+	if err != nil {
+		return shim.Error("Error getting recovery")
+	}
+	config, err := guardians(stub, rq.From)
+	if err != nil {
+		return shim.Error("Error getting guardians")
+	}
+	if !recovery.Approved && (config.Threshold == 0 || guardianApprovals(config, recovery) < config.Threshold) {
+		return shim.Error("Recovery of " + rq.From + " is not approved")
+	}
+
+	// balances
+	fromBalance, err := t.balance(stub, rq.From)
+	if err != nil {
+		return shim.Error("Error getting to or from balance")
+	}
+	toBalance, err := t.balance(stub, to)
+	if err != nil {
+		return shim.Error("Error getting to or from balance")
+	}
+	if toBalance+fromBalance < toBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	// the balance moves like a transfer, but the velocity limits move with it
+	migrated := Transfer{From: rq.From, To: to, Value: fromBalance}
+	if res := checkSanctions(stub, "migrateAccount", migrated); res != nil {
+		return *res
+	}
+	if res := t.checkMigrationRestrictions(stub, migrated); res != nil {
+		return *res
+	}
+	err = t.setBalances(stub, Balance{User: to, Value: toBalance + fromBalance}, Balance{User: rq.From, Value: 0})
+	if err != nil {
+		return shim.Error("Error setting balance")
+	}
+
+	// the confidential balance, whose commitments add up
+	confidentialKey, err := stub.CreateCompositeKey(IndexConfidential, []string{rq.From})
+	if err != nil {
+		return shim.Error("Error getting confidential balance")
+	}
+	confidentialBytes, err := stub.GetState(confidentialKey)
+	if err != nil {
+		return shim.Error("Error getting confidential balance")
+	}
+	if confidentialBytes != nil {
+		fromCommitment, err := confidential.ParseCommitment(confidentialBytes)
+		if err != nil {
+			return shim.Error("Error parsing confidential balance")
+		}
+		toCommitment, err := t.confidentialBalance(stub, to)
+		if err != nil {
+			return shim.Error("Error getting confidential balance")
+		}
+		if err := t.setConfidentialBalance(stub, to, toCommitment.Add(fromCommitment)); err != nil {
+			return shim.Error("Error moving confidential balance")
+		}
+		if err := stub.DelState(confidentialKey); err != nil {
+			return shim.Error("Error moving confidential balance")
+		}
+	}
+
+	// allowances granted by the old account, added to the ones of the new account
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexAllowance, []string{rq.From})
+	if err != nil {
+		return shim.Error("Error getting allowances")
+	}
+	allowances := map[string]uint64{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return shim.Error("Error getting allowances")
+		}
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 2 {
+			iterator.Close()
+			return shim.Error("Invalid allowance key: " + kv.Key)
+		}
+		allowances[parts[1]] = binary.LittleEndian.Uint64(kv.Value)
+		if err := stub.DelState(kv.Key); err != nil {
+			iterator.Close()
+			return shim.Error("Error removing allowance")
+		}
+	}
+	iterator.Close()
+	for spender, value := range allowances {
+		allowance, err := t.allowance(stub, to, spender)
+		if err != nil {
+			return shim.Error("Error getting allowance")
+		}
+		// saturates rather than failing the migration
+		if allowance+value < allowance {
+			allowance, value = ^uint64(0), 0
+		}
+		err = t.setAllowance(stub, to, spender, allowance+value)
+		if err != nil {
+			return shim.Error("Error setting allowance")
+		}
+	}
+
+	if err := t.migrateStakes(stub, rq.From, to); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := t.migrateDividends(stub, rq.From, to); err != nil {
+		return shim.Error("Error moving dividends: " + err.Error())
+	}
+
+	// the private balances in the collections the caller listed
+	for _, collection := range rq.Collections {
+		if err := t.movePrivateBalance(stub, collection, rq.From, to); err != nil {
+			return shim.Error(collection + ": " + err.Error())
+		}
+	}
+
+	// the KYC entry, the lock-up and the velocity limits and spending follow the
+	// account too
+	for _, index := range []string{IndexKYC, IndexLockUp, IndexLimits} {
+		if err := moveEntry(stub, index, rq.From, to); err != nil {
+			return shim.Error("Error moving compliance entries")
+		}
+	}
+	if err := moveSpending(stub, rq.From, to); err != nil {
+		return shim.Error("Error moving spending")
+	}
+	if err := moveFees(stub, rq.From, to); err != nil {
+		return shim.Error("Error moving fees")
+	}
+
+	// guardians follow the account, the approvals are consumed
+	if len(config.Guardians) > 0 {
+		key, err := stub.CreateCompositeKey(IndexGuardians, []string{rq.From})
+		if err == nil {
+			err = stub.DelState(key)
+		}
+		if err != nil {
+			return shim.Error("Error removing guardians")
+		}
+		config.User = to
+		err = putJson(stub, IndexGuardians, []string{to}, config)
+		if err != nil {
+			return shim.Error("Error saving guardians")
+		}
+	}
+	recoveryKey, err := stub.CreateCompositeKey(IndexRecovery, []string{rq.From, to})
+	if err == nil {
+		err = stub.DelState(recoveryKey)
+	}
+	if err != nil {
+		return shim.Error("Error removing recovery")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	migration := Migration{
+		From:       rq.From,
+		To:         to,
+		Value:      fromBalance,
+		Allowances: len(allowances),
+		TxID:       stub.GetTxID(),
+		Timestamp:  now.Format(time.RFC3339),
+	}
+
+	// the tombstone of the old account, and the pointer back from the new one
+	err = putJson(stub, IndexMigrated, []string{rq.From}, migration)
+	if err == nil {
+		err = putJson(stub, IndexPredecessor, []string{to, rq.From}, migration)
+	}
+	if err != nil {
+		return shim.Error("Error saving migration")
+	}
+
+	evtData, _ := json.Marshal(migration)
+	stub.SetEvent("AccountMigrated", evtData)
+	return shim.Success(evtData)
+}
+
+// migrations into and out of the user's account, to follow its history
+func (t *TokenChaincode) migrationsAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	migrationsRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &migrationsRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	migrations := []Migration{}
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexPredecessor, []string{migrationsRq.User})
+	if err != nil {
+		return shim.Error("Error getting migrations")
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error("Error getting migrations")
+		}
+		migration := Migration{}
+		if err := json.Unmarshal(kv.Value, &migration); err != nil {
+			return shim.Error("Error parsing migration")
+		}
+		migrations = append(migrations, migration)
+	}
+
+	out, err := accountMigration(stub, migrationsRq.User)
+	if err != nil {
+		return shim.Error("Error getting migration")
+	}
+	if out != nil {
+		migrations = append(migrations, *out)
+	}
+
+	result, _ := json.Marshal(migrations)
+	return shim.Success(result)
+}
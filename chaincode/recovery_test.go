@@ -0,0 +1,221 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/testca"
+	"testing"
+	"time"
+)
+
+var recoveryActors = map[string]*testca.Identity{
+	"alice":  rolesCA.MustIssue("alice", testca.Options{}),
+	"alice2": rolesCA.MustIssue("alice2", testca.Options{}),
+	"bob":    rolesCA.MustIssue("bob", testca.Options{}),
+	"carol":  rolesCA.MustIssue("carol", testca.Options{}),
+	"dave":   rolesCA.MustIssue("dave", testca.Options{}),
+}
+
+func TestMigrateWithGuardians(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+
+	alice, alice2 := recoveryActors["alice"], recoveryActors["alice2"]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("2", util.ToChaincodeArgs("approve", `{"spender": "dave", "value": 30}`))
+	for _, invalid := range []string{`{"guardians": ["bob", "bob"], "threshold": 1}`, `{"guardians": ["bob"], "threshold": 2}`, `{"guardians": ["alice"], "threshold": 1}`} {
+		if res := stub.MockInvoke("3", util.ToChaincodeArgs("setGuardians", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected guardians %s to be rejected", invalid)
+		}
+	}
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("setGuardians", `{"guardians": ["bob", "carol"], "threshold": 2}`)); res.Status != shim.OK {
+		t.Fatal("SetGuardians failed: " + res.Message)
+	}
+
+	recovery := `{"from": "alice", "to": "alice2"}`
+	dave := recoveryActors["dave"]
+	stub.MockCreator(dave.MspID, dave.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("approveRecovery", recovery)); res.Status == shim.OK {
+		t.Error("Expected only guardians to approve the recovery")
+	}
+
+	bob := recoveryActors["bob"]
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("approveRecovery", recovery)); res.Status != shim.OK {
+		t.Fatal("ApproveRecovery failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("6", util.ToChaincodeArgs("approveRecovery", recovery)); res.Status == shim.OK {
+		t.Error("Expected a guardian to approve only once")
+	}
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("7", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status == shim.OK {
+		t.Fatal("Expected the migration to need 2 approvals")
+	}
+
+	carol := recoveryActors["carol"]
+	stub.MockCreator(carol.MspID, carol.CertPEM)
+	stub.MockInvoke("8", util.ToChaincodeArgs("approveRecovery", recovery))
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	res := stub.MockInvoke("9", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`))
+	if res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	if event := stub.Events[len(stub.Events)-1]; event.EventName != "AccountMigrated" || string(event.Payload) != string(res.Payload) {
+		t.Errorf("Expected an AccountMigrated event, got %s", event.EventName)
+	}
+
+	b1, _ := balance(stub, "alice")
+	b2, _ := balance(stub, "alice2")
+	allowances, _ := allAllowances(stub, "alice2")
+	if b1.Value != 0 || b2.Value != 100 || len(allowances) != 1 || allowances[0].Spender != "dave" || allowances[0].Value != 30 {
+		t.Errorf("Expected the balance and allowances to move, got (%d, %d, %+v)", b1.Value, b2.Value, allowances)
+	}
+	if allowances, _ := allAllowances(stub, "alice"); len(allowances) != 0 {
+		t.Errorf("Expected the old allowances to be removed, got %+v", allowances)
+	}
+
+	guardians := Guardians{}
+	json.Unmarshal(stub.MockInvoke("10", util.ToChaincodeArgs("guardians", `{"user": "alice2"}`)).Payload, &guardians)
+	if len(guardians.Guardians) != 2 || guardians.Threshold != 2 {
+		t.Errorf("Expected the guardians to move, got %+v", guardians)
+	}
+
+	migrations := []Migration{}
+	json.Unmarshal(stub.MockInvoke("11", util.ToChaincodeArgs("migrations", `{"user": "alice2"}`)).Payload, &migrations)
+	if len(migrations) != 1 || migrations[0].From != "alice" || migrations[0].Value != 100 || migrations[0].Allowances != 1 || migrations[0].TxID != "9" {
+		t.Errorf("Unexpected migrations: %+v", migrations)
+	}
+
+	// the old account is a tombstone
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	for _, call := range [][]string{
+		{"transfer", `{"to": "bob", "value": 0}`},
+		{"approve", `{"spender": "bob", "value": 1}`},
+	} {
+		if res := stub.MockInvoke("12", util.ToChaincodeArgs(call...)); res.Message != "Account alice was migrated to alice2" {
+			t.Errorf("Expected %s to fail on the old account, got %q", call[0], res.Message)
+		}
+	}
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("13", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 1}`)); res.Status == shim.OK {
+		t.Error("Expected transfers to the old account to fail")
+	}
+	stub.MockCreator(dave.MspID, dave.CertPEM)
+	if res := stub.MockInvoke("14", util.ToChaincodeArgs("transferFrom", `{"from": "alice2", "to": "dave", "value": 30}`)); res.Status != shim.OK {
+		t.Error("Expected the spender to use the migrated allowance: " + res.Message)
+	}
+}
+
+func TestMigrateWithApproval(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer, admin := roleActors["issuer"], roleActors["admin"]
+	alice2, bob := recoveryActors["alice2"], recoveryActors["bob"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "alice2", "value": 5}`))
+
+	// without guardians an account is only recovered through an admin
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "bob"}`)); res.Status == shim.OK {
+		t.Error("Expected a caller without role to be rejected")
+	}
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`)); res.Status != shim.OK {
+		t.Fatal("ApproveRecovery failed: " + res.Message)
+	}
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status == shim.OK {
+		t.Error("Expected only the approved account to migrate")
+	}
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("6", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice2"); b.Value != 105 {
+		t.Errorf("Expected the balances to add up to 105, got %d", b.Value)
+	}
+	if res := stub.MockInvoke("7", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status == shim.OK {
+		t.Error("Expected an account to migrate only once")
+	}
+
+	// the holder rotating its certificate approves the migration itself
+	stub.MockInvoke("8", util.ToChaincodeArgs("approveRecovery", `{"from": "alice2", "to": "bob"}`))
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("9", util.ToChaincodeArgs("migrateAccount", `{"from": "alice2"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	migrations := []Migration{}
+	json.Unmarshal(stub.MockInvoke("10", util.ToChaincodeArgs("migrations", `{"user": "alice2"}`)).Payload, &migrations)
+	if len(migrations) != 2 || migrations[0].To != "alice2" || migrations[1].To != "bob" {
+		t.Errorf("Expected the migrations into and out of alice2, got %+v", migrations)
+	}
+}
+
+func TestMigrateCompliance(t *testing.T) {
+	stub := sanctionsLedger(t)
+	alice, alice2, bob := recoveryActors["alice"], recoveryActors["alice2"], recoveryActors["bob"]
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approveRecovery", `{"from": "bob", "to": "alice2"}`))
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	expectSanctioned(t, stub, "migrateAccount", `{"from": "bob"}`, "bob")
+
+	stub = restrictedLedger(t, `{}`)
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	until := time.Now().Add(time.Hour)
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	stub.MockInvoke("2", util.ToChaincodeArgs("setLockUp", fmt.Sprintf(`{"user": "alice", "until": "%s"}`, until.Format(time.RFC3339))))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`))
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	expectRestricted(t, stub, "migrateAccount", `{"from": "alice"}`, RestrictionLockUp)
+	stub.MockTime(until.Add(time.Second))
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("Expected the migration after the lock-up: " + res.Message)
+	}
+}
+
+func TestMigrateVelocity(t *testing.T) {
+	stub := velocityLedger(t)
+	alice, alice2 := recoveryActors["alice"], recoveryActors["alice2"]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 30}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`))
+
+	// the whole balance moves beyond the limits, which move with it
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	if status := limits(stub, "alice2"); status.Tier != "retail" || status.Spent != 30 {
+		t.Errorf("Expected the limits and spending to move, got %+v", status)
+	}
+	if status := limits(stub, "alice"); status.Tier != TierDefault || status.Spent != 0 {
+		t.Errorf("Expected the old account to keep no limits, got %+v", status)
+	}
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 50}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "bob", "value": 30}`, RestrictionDailyLimit)
+}
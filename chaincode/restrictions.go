@@ -0,0 +1,510 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"time"
+)
+
+// Transfers are checked by the TransferRule of every enabled restriction, in
+// the spirit of ERC-1404: the first rule restricting a transfer gives its code,
+// which messageForRestriction explains. The rules are configured on the ledger
+// by callers with the compliance role, KYC being required by the token data.
+
+const (
+	RestrictionNone uint8 = iota
+	RestrictionKYC
+	RestrictionMaxHolders
+	RestrictionCountry
+	RestrictionLockUp
+	RestrictionMaxBalance
+	RestrictionTransferLimit
+	RestrictionDailyLimit
+	RestrictionSanctioned
+)
+
+var restrictionMessages = map[uint8]string{
+	RestrictionNone:          "No restriction",
+	RestrictionKYC:           "A holder is not KYC verified",
+	RestrictionMaxHolders:    "The token reached its maximum number of holders",
+	RestrictionCountry:       "The country of a holder is restricted",
+	RestrictionLockUp:        "The tokens of the sender are locked up",
+	RestrictionMaxBalance:    "The receiver would exceed the maximum balance",
+	RestrictionTransferLimit: "The transfer exceeds the limit of the sender",
+	RestrictionDailyLimit:    "The sender would exceed its limit over 24 hours",
+	RestrictionSanctioned:    "A holder is sanctioned",
+}
+
+// status of calls rejected by a restriction other than KYC
+const StatusRestricted = 451
+
+const KeyTransferRules = "__rules"
+const KeyHolders = "__holders"
+const IndexLockUp = "cn~lockup"
+
+// checks moving value from one holder to another, From is empty for mints and To for burns
+type TransferRule interface {
+	Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error)
+}
+
+type kycRule struct {
+	level uint8
+	now   time.Time
+}
+
+func (rule kycRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	for _, cn := range []string{transfer.From, transfer.To} {
+		if cn == "" {
+			continue
+		}
+		entry, err := kycEntry(stub, cn)
+		if err != nil {
+			return 0, err
+		}
+		if !entry.verified(rule.level, rule.now) {
+			return RestrictionKYC, nil
+		}
+	}
+	return RestrictionNone, nil
+}
+
+// the holder count is only kept while the rule is enabled
+type maxHoldersRule struct {
+	t   *TokenChaincode
+	max uint64
+}
+
+func (rule maxHoldersRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	// burns have no receiver, and fee collectors join when they collect
+	if transfer.Value == 0 || transfer.To == "" {
+		return RestrictionNone, nil
+	}
+	toBalance, err := rule.t.balance(stub, transfer.To)
+	if err != nil || toBalance > 0 {
+		return RestrictionNone, err
+	}
+	holders, err := holderCount(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	// the sender leaving makes room for the receiver
+	if transfer.From != "" {
+		fromBalance, err := rule.t.balance(stub, transfer.From)
+		if err != nil {
+			return 0, err
+		}
+		if fromBalance == transfer.Value {
+			holders--
+		}
+	}
+	if holders >= rule.max {
+		return RestrictionMaxHolders, nil
+	}
+	return RestrictionNone, nil
+}
+
+type countryRule struct {
+	allowed map[string]bool
+	blocked map[string]bool
+}
+
+func (rule countryRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	for _, cn := range []string{transfer.From, transfer.To} {
+		if cn == "" {
+			continue
+		}
+		entry, err := kycEntry(stub, cn)
+		if err != nil {
+			return 0, err
+		}
+		country := ""
+		if entry != nil {
+			country = entry.Country
+		}
+		if rule.blocked[country] || (len(rule.allowed) > 0 && !rule.allowed[country]) {
+			return RestrictionCountry, nil
+		}
+	}
+	return RestrictionNone, nil
+}
+
+type lockUpRule struct {
+	now time.Time
+}
+
+func (rule lockUpRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	if transfer.From == "" {
+		return RestrictionNone, nil
+	}
+	key, err := stub.CreateCompositeKey(IndexLockUp, []string{transfer.From})
+	if err != nil {
+		return 0, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return RestrictionNone, err
+	}
+	lockUp := LockUp{}
+	if err := json.Unmarshal(data, &lockUp); err != nil {
+		return 0, err
+	}
+	until, err := time.Parse(time.RFC3339, lockUp.Until)
+	if err != nil {
+		return 0, err
+	}
+	if rule.now.Before(until) {
+		return RestrictionLockUp, nil
+	}
+	return RestrictionNone, nil
+}
+
+type maxBalanceRule struct {
+	t   *TokenChaincode
+	max uint64
+}
+
+func (rule maxBalanceRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	// deposits into a collection move tokens of the holder to itself, burns
+	// have no receiver
+	if transfer.From == transfer.To || transfer.To == "" {
+		return RestrictionNone, nil
+	}
+	toBalance, err := rule.t.balance(stub, transfer.To)
+	if err != nil {
+		return 0, err
+	}
+	// the receiver is credited the value net of the fee, minted tokens have none
+	value := transfer.Value
+	if transfer.From != "" {
+		event, err := transferFee(stub, transfer)
+		if err != nil {
+			return 0, err
+		}
+		value = event.Net
+	}
+	if toBalance+value < toBalance || toBalance+value > rule.max {
+		return RestrictionMaxBalance, nil
+	}
+	return RestrictionNone, nil
+}
+
+func transferRulesConfig(stub shim.ChaincodeStubInterface) (TransferRules, error) {
+	rules := TransferRules{}
+	data, err := stub.GetState(KeyTransferRules)
+	if err != nil || data == nil {
+		return rules, err
+	}
+	err = json.Unmarshal(data, &rules)
+	return rules, err
+}
+
+// the rules enabled on the ledger, the lock-ups and limits being always checked
+func (t *TokenChaincode) transferRules(stub shim.ChaincodeStubInterface) ([]TransferRule, error) {
+	token, err := tokenData(stub)
+	if err != nil {
+		return nil, err
+	}
+	config, err := transferRulesConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// sanctioned transfers are blocked before the rules, which only report them
+	rules := []TransferRule{sanctionsRule{}}
+	if token.KYCLevel > 0 {
+		rules = append(rules, kycRule{token.KYCLevel, now})
+	}
+	if len(config.AllowedCountries) > 0 || len(config.BlockedCountries) > 0 {
+		rule := countryRule{map[string]bool{}, map[string]bool{}}
+		for _, country := range config.AllowedCountries {
+			rule.allowed[country] = true
+		}
+		for _, country := range config.BlockedCountries {
+			rule.blocked[country] = true
+		}
+		rules = append(rules, rule)
+	}
+	rules = append(rules, lockUpRule{now}, velocityRule{now})
+	if config.MaxHolders > 0 {
+		rules = append(rules, maxHoldersRule{t, config.MaxHolders})
+	}
+	if config.MaxBalance > 0 {
+		rules = append(rules, maxBalanceRule{t, config.MaxBalance})
+	}
+	return rules, nil
+}
+
+func (t *TokenChaincode) detectRestriction(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	rules, err := t.transferRules(stub)
+	if err != nil {
+		return 0, err
+	}
+	return detectWith(stub, rules, transfer)
+}
+
+func detectWith(stub shim.ChaincodeStubInterface, rules []TransferRule, transfer Transfer) (uint8, error) {
+	for _, rule := range rules {
+		code, err := rule.Detect(stub, transfer)
+		if err != nil || code != RestrictionNone {
+			return code, err
+		}
+	}
+	return RestrictionNone, nil
+}
+
+// nil if no rule restricts the transfer, the response rejecting it otherwise
+func (t *TokenChaincode) checkRestrictions(stub shim.ChaincodeStubInterface, transfer Transfer) *pb.Response {
+	code, err := t.detectRestriction(stub, transfer)
+	return restrictionResponse(code, err)
+}
+
+// checks the migration of an account like a transfer, except for the velocity
+// limits which move with the account: a migration spends nothing
+func (t *TokenChaincode) checkMigrationRestrictions(stub shim.ChaincodeStubInterface, transfer Transfer) *pb.Response {
+	rules, err := t.transferRules(stub)
+	if err != nil {
+		return restrictionResponse(0, err)
+	}
+	migrationRules := []TransferRule{}
+	for _, rule := range rules {
+		if _, velocity := rule.(velocityRule); !velocity {
+			migrationRules = append(migrationRules, rule)
+		}
+	}
+	code, err := detectWith(stub, migrationRules, transfer)
+	return restrictionResponse(code, err)
+}
+
+// checks the KYC of the holders only, for calls where the other rules would
+// reveal them
+func (t *TokenChaincode) checkKYC(stub shim.ChaincodeStubInterface, transfer Transfer) *pb.Response {
+	token, err := tokenData(stub)
+	if err != nil || token.KYCLevel == 0 {
+		return restrictionResponse(RestrictionNone, err)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return restrictionResponse(RestrictionNone, err)
+	}
+	code, err := kycRule{token.KYCLevel, now}.Detect(stub, transfer)
+	return restrictionResponse(code, err)
+}
+
+func restrictionResponse(code uint8, err error) *pb.Response {
+	if err != nil {
+		res := shim.Error("Error checking transfer restrictions")
+		return &res
+	}
+	switch code {
+	case RestrictionNone:
+		return nil
+	case RestrictionKYC:
+		return &pb.Response{Status: StatusKYCRequired, Message: restrictionMessages[code]}
+	}
+	return &pb.Response{Status: StatusRestricted, Message: restrictionMessages[code]}
+}
+
+func holderCount(stub shim.ChaincodeStubInterface) (uint64, error) {
+	data, err := stub.GetState(KeyHolders)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+func setHolderCount(stub shim.ChaincodeStubInterface, holders uint64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, holders)
+	return stub.PutState(KeyHolders, data)
+}
+
+// keeps the holder count while it is tracked, with the holders joining and
+// leaving in a transaction; called at most once per transaction
+func updateHolderCount(stub shim.ChaincodeStubInterface, joined, left uint64) error {
+	if joined == left {
+		return nil
+	}
+	data, err := stub.GetState(KeyHolders)
+	if err != nil || data == nil {
+		return err
+	}
+	holders := binary.LittleEndian.Uint64(data)
+	if holders+joined < left {
+		return errors.New("Holder count underflow")
+	}
+	return setHolderCount(stub, holders+joined-left)
+}
+
+// counts the holders with a balance, to start tracking them
+func countHolders(stub shim.ChaincodeStubInterface) (uint64, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBalance, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	var holders uint64
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		if len(kv.Value) == 8 && binary.LittleEndian.Uint64(kv.Value) > 0 {
+			holders++
+		}
+	}
+	return holders, nil
+}
+
+// replaces the transfer rules, callers need the compliance role
+func (t *TokenChaincode) setTransferRules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetTransferRules expected 1 argument")
+	}
+	config := TransferRules{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return shim.Error("Error parsing transfer rules json")
+	}
+	err = requireRole(stub, RoleCompliance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the holders are counted when the rule is enabled
+	current, err := transferRulesConfig(stub)
+	if err != nil {
+		return shim.Error("Error getting transfer rules")
+	}
+	if current.MaxHolders == 0 && config.MaxHolders > 0 {
+		holders, err := countHolders(stub)
+		if err == nil {
+			err = setHolderCount(stub, holders)
+		}
+		if err != nil {
+			return shim.Error("Error counting holders")
+		}
+	}
+	if current.MaxHolders > 0 && config.MaxHolders == 0 {
+		err = stub.DelState(KeyHolders)
+		if err != nil {
+			return shim.Error("Error deleting holder count")
+		}
+	}
+
+	configBytes, _ := json.Marshal(config)
+	err = stub.PutState(KeyTransferRules, configBytes)
+	if err != nil {
+		return shim.Error("Error saving transfer rules")
+	}
+	stub.SetEvent("TransferRulesUpdated", configBytes)
+	return shim.Success(nil)
+}
+
+func (t *TokenChaincode) transferRulesAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	config, err := transferRulesConfig(stub)
+	if err != nil {
+		return shim.Error("Error getting transfer rules")
+	}
+	result, _ := json.Marshal(config)
+	return shim.Success(result)
+}
+
+// locks the tokens of a holder until the given time, an empty time unlocks
+// them; callers need the compliance role
+func (t *TokenChaincode) setLockUp(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetLockUp expected 1 argument")
+	}
+	lockUp := LockUp{}
+	err := json.Unmarshal([]byte(args[0]), &lockUp)
+	if err != nil {
+		return shim.Error("Error parsing lock-up json")
+	}
+	if lockUp.User == "" {
+		return shim.Error("Expected the user")
+	}
+	if _, err := time.Parse(time.RFC3339, lockUp.Until); lockUp.Until != "" && err != nil {
+		return shim.Error("Invalid lock-up time: " + lockUp.Until)
+	}
+	err = requireRole(stub, RoleCompliance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(IndexLockUp, []string{lockUp.User})
+	if err != nil {
+		return shim.Error("Error creating lock-up key")
+	}
+	lockUpBytes, _ := json.Marshal(lockUp)
+	if lockUp.Until == "" {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, lockUpBytes)
+	}
+	if err != nil {
+		return shim.Error("Error saving lock-up")
+	}
+	stub.SetEvent("LockUp", lockUpBytes)
+	return shim.Success(nil)
+}
+
+// ERC-1404 detectTransferRestriction, the code and message restricting the transfer
+func (t *TokenChaincode) detectTransferRestriction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected transfer to check")
+	}
+	transfer := Transfer{}
+	err := json.Unmarshal([]byte(args[0]), &transfer)
+	if err != nil {
+		return shim.Error("Error parsing transfer json")
+	}
+
+	code, err := t.detectRestriction(stub, transfer)
+	if err != nil {
+		return shim.Error("Error checking transfer restrictions")
+	}
+	result, _ := json.Marshal(Restriction{Code: code, Message: restrictionMessages[code]})
+	return shim.Success(result)
+}
+
+// ERC-1404 messageForRestriction, the code is given as a number
+func (t *TokenChaincode) messageForRestriction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected restriction code")
+	}
+	code, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil {
+		return shim.Error("Invalid restriction code: " + args[0])
+	}
+	message, ok := restrictionMessages[uint8(code)]
+	if !ok {
+		return shim.Error("Unknown restriction code: " + args[0])
+	}
+	return shim.Success([]byte(message))
+}
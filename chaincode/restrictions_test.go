@@ -0,0 +1,283 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"testing"
+	"time"
+)
+
+const restrictedToken = `{"name": "Restricted", "totalSupply": 1000, "roles": {
+	"compliance": [{"attr": "hf.Type", "value": "compliance"}],
+	"kyc": [{"ou": "kyc"}],
+	"minter": [{"attr": "token.minter"}]
+}}`
+
+func restrictedLedger(t *testing.T, rules string) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", restrictedToken)); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	if res := stub.MockInvoke("rules", util.ToChaincodeArgs("setTransferRules", rules)); res.Status != shim.OK {
+		t.Fatal("SetTransferRules failed: " + res.Message)
+	}
+	return stub
+}
+
+func detectRestriction(t *testing.T, stub *mock.FullMockStub, transfer string) uint8 {
+	res := stub.MockInvoke("detect", util.ToChaincodeArgs("detectTransferRestriction", transfer))
+	restriction := Restriction{}
+	if err := json.Unmarshal(res.Payload, &restriction); err != nil {
+		t.Fatal("DetectTransferRestriction failed: " + res.Message)
+	}
+	if restriction.Message != restrictionMessages[restriction.Code] {
+		t.Errorf("Unexpected message for code %d: %s", restriction.Code, restriction.Message)
+	}
+	return restriction.Code
+}
+
+func expectRestricted(t *testing.T, stub *mock.FullMockStub, call, transfer string, code uint8) {
+	res := stub.MockInvoke("restricted", util.ToChaincodeArgs(call, transfer))
+	if res.Status != StatusRestricted || res.Message != restrictionMessages[code] {
+		t.Errorf("Expected %s %s to be restricted with %d, got %d (%s)", call, transfer, code, res.Status, res.Message)
+	}
+}
+
+func TestSetTransferRules(t *testing.T) {
+	stub := restrictedLedger(t, `{"maxBalance": 10}`)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setTransferRules", `{}`)); res.Status == shim.OK {
+		t.Error("Expected only compliance officers to set the rules")
+	}
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("transferRules")); string(res.Payload) != `{"maxBalance":10}` {
+		t.Errorf("Unexpected transfer rules: %s", res.Payload)
+	}
+
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("messageForRestriction", "4")); string(res.Payload) != restrictionMessages[RestrictionLockUp] {
+		t.Errorf("Unexpected message for the lock-up: %s", res.Payload)
+	}
+	for _, code := range []string{"42", "-1", "lockup"} {
+		if res := stub.MockInvoke("4", util.ToChaincodeArgs("messageForRestriction", code)); res.Status == shim.OK {
+			t.Errorf("Expected no message for code %s", code)
+		}
+	}
+}
+
+func TestMaxHolders(t *testing.T) {
+	stub := restrictedLedger(t, `{"maxHolders": 2}`)
+	issuer, officer, minter := roleActors["issuer"], roleActors["officer"], roleActors["minter"]
+	alice := recoveryActors["alice"]
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if code := detectRestriction(t, stub, `{"from": "issuer", "to": "bob", "value": 1}`); code != RestrictionMaxHolders {
+		t.Errorf("Expected a third holder to be restricted, got %d", code)
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "bob", "value": 1}`, RestrictionMaxHolders)
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	expectRestricted(t, stub, "mint", `{"to": "bob", "value": 1}`, RestrictionMaxHolders)
+
+	// existing holders, and a holder replacing another, are not restricted
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 1}`)); res.Status != shim.OK {
+		t.Error("Transfer to a holder failed: " + res.Message)
+	}
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 101}`)); res.Status != shim.OK {
+		t.Error("Transfer of the whole balance failed: " + res.Message)
+	}
+	if holders, _ := holderCount(stub); holders != 2 {
+		t.Errorf("Expected 2 holders, got %d", holders)
+	}
+
+	// the holders are not counted without the rule
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	stub.MockInvoke("4", util.ToChaincodeArgs("setTransferRules", `{}`))
+	if _, ok := stub.State[KeyHolders]; ok {
+		t.Error("Expected the holder count to be removed")
+	}
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 1}`)); res.Status != shim.OK {
+		t.Error("Transfer failed: " + res.Message)
+	}
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	stub.MockInvoke("6", util.ToChaincodeArgs("setTransferRules", `{"maxHolders": 5}`))
+	if holders, _ := holderCount(stub); holders != 3 {
+		t.Errorf("Expected the 3 holders to be counted, got %d", holders)
+	}
+}
+
+// a transaction reads the committed holder count, not its own writes
+func TestMaxHoldersWithFeeCollector(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	setFees(t, stub, `{"collector": "treasury", "flat": 1}`)
+	setRules := func(rules string) {
+		stub.MockCreator(officer.MspID, officer.CertPEM)
+		if res := stub.MockInvoke("rules", util.ToChaincodeArgs("setTransferRules", rules)); res.Status != shim.OK {
+			t.Fatal("SetTransferRules failed: " + res.Message)
+		}
+	}
+	setRules(`{"maxHolders": 2}`)
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+
+	// the collector joins the holders when it collects its first fees
+	stub.MockCreator(treasury.MspID, treasury.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("collectFees")); res.Status != StatusRestricted || res.Message != restrictionMessages[RestrictionMaxHolders] {
+		t.Errorf("Expected the collector to be restricted, got %d %s", res.Status, res.Message)
+	}
+	setRules(`{"maxHolders": 3}`)
+	stub.MockCreator(treasury.MspID, treasury.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("collectFees")); res.Status != shim.OK {
+		t.Fatal("CollectFees failed: " + res.Message)
+	}
+	if holders, _ := holderCount(stub); holders != 3 {
+		t.Errorf("Expected 3 holders, got %d", holders)
+	}
+}
+
+func TestHolderCountInBlock(t *testing.T) {
+	stub := restrictedLedger(t, `{"maxHolders": 5}`)
+	issuer, alice, alice2 := roleActors["issuer"], recoveryActors["alice"], recoveryActors["alice2"]
+	expectHolders := func(expected uint64) {
+		if holders, _ := holderCount(stub); holders != expected {
+			t.Errorf("Expected %d holders, got %d", expected, holders)
+		}
+	}
+
+	// the sender leaves and the receiver joins
+	results := stub.MockBlock([]mock.Proposal{transferProposal("tx1", issuer, `{"to": "alice", "value": 1000}`)})
+	expectValidation(t, results, pb.TxValidationCode_VALID)
+	expectHolders(1)
+
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`))
+	results = stub.MockBlock([]mock.Proposal{
+		{TxID: "tx4", MspID: alice2.MspID, Cert: alice2.CertPEM, Args: util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)},
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID)
+	expectHolders(1)
+
+	bob := recoveryActors["bob"]
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	stub.MockInvoke("5", util.ToChaincodeArgs("approve", `{"spender": "bob", "value": 1000}`))
+	results = stub.MockBlock([]mock.Proposal{
+		{TxID: "tx6", MspID: bob.MspID, Cert: bob.CertPEM, Args: util.ToChaincodeArgs("transferFrom", `{"from": "alice2", "to": "carol", "value": 1000}`)},
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID)
+	expectHolders(1)
+}
+
+func TestCountryRestriction(t *testing.T) {
+	stub := restrictedLedger(t, `{"allowedCountries": ["CH", "DE"], "blockedCountries": ["DE"]}`)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(kycProvider.MspID, kycProvider.CertPEM)
+	for user, country := range map[string]string{"issuer": "CH", "alice": "CH", "bob": "DE", "carol": "US"} {
+		entry := fmt.Sprintf(`{"user": "%s", "level": 1, "expiry": "2100-01-01T00:00:00Z", "country": "%s"}`, user, country)
+		if res := stub.MockInvoke("1", util.ToChaincodeArgs("setKYC", entry)); res.Status != shim.OK {
+			t.Fatal("SetKYC failed: " + res.Message)
+		}
+	}
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	for to, expected := range map[string]uint8{"alice": RestrictionNone, "bob": RestrictionCountry, "carol": RestrictionCountry, "dave": RestrictionCountry} {
+		transfer := fmt.Sprintf(`{"from": "issuer", "to": "%s", "value": 1}`, to)
+		if code := detectRestriction(t, stub, transfer); code != expected {
+			t.Errorf("Expected the transfer to %s to have restriction %d, got %d", to, expected, code)
+		}
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "bob", "value": 1}`, RestrictionCountry)
+}
+
+func TestLockUp(t *testing.T) {
+	stub := restrictedLedger(t, `{}`)
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	until := time.Now().Add(time.Hour)
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	lockUp := fmt.Sprintf(`{"user": "issuer", "until": "%s"}`, until.Format(time.RFC3339))
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setLockUp", lockUp)); res.Status == shim.OK {
+		t.Error("Expected only compliance officers to lock up tokens")
+	}
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("setLockUp", lockUp)); res.Status != shim.OK {
+		t.Fatal("SetLockUp failed: " + res.Message)
+	}
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	expectRestricted(t, stub, "transfer", `{"to": "alice", "value": 1}`, RestrictionLockUp)
+	stub.MockInvoke("3", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 10}`))
+	alice := recoveryActors["alice"]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectRestricted(t, stub, "transferFrom", `{"from": "issuer", "to": "alice", "value": 1}`, RestrictionLockUp)
+
+	// the lock-up ends at its time
+	stub.MockTime(until.Add(time.Second))
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 1}`)); res.Status != shim.OK {
+		t.Error("Transfer after the lock-up failed: " + res.Message)
+	}
+}
+
+func TestMaxBalance(t *testing.T) {
+	stub := restrictedLedger(t, `{"maxBalance": 50}`)
+	issuer, minter := roleActors["issuer"], roleActors["minter"]
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 50}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "alice", "value": 1}`, RestrictionMaxBalance)
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	expectRestricted(t, stub, "mint", `{"to": "bob", "value": 51}`, RestrictionMaxBalance)
+	if code := detectRestriction(t, stub, `{"to": "bob", "value": 18446744073709551615}`); code != RestrictionMaxBalance {
+		t.Errorf("Expected an overflowing mint to be restricted, got %d", code)
+	}
+}
+
+func TestMaxBalanceNetOfFee(t *testing.T) {
+	stub := rolesLedger(t)
+	officer := roleActors["officer"]
+	setFees(t, stub, `{"collector": "treasury", "flat": 5}`)
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	if res := stub.MockInvoke("rules", util.ToChaincodeArgs("setTransferRules", `{"maxBalance": 50}`)); res.Status != shim.OK {
+		t.Fatal("SetTransferRules failed: " + res.Message)
+	}
+
+	// alice receives 50 out of 55
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 55}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "alice", "value": 6}`, RestrictionMaxBalance)
+}
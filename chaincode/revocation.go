@@ -0,0 +1,192 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"strings"
+)
+
+// Certificates revoked by an admin, so a compromised identity is stopped before
+// the CRL of its MSP reaches the peers. A certificate is listed by the serial
+// number given by its MSP, or by its subject key ID.
+
+const IndexRevokedSerial = "msp~serial~revoked"
+const IndexRevokedSKI = "ski~revoked"
+
+// normalizes a hex serial number, which may have colons and leading zeros
+func normalizeSerial(serial string) (string, error) {
+	n, ok := new(big.Int).SetString(strings.Replace(serial, ":", "", -1), 16)
+	if !ok || n.Sign() < 0 {
+		return "", errors.New("Invalid serial number: " + serial)
+	}
+	return n.Text(16), nil
+}
+
+func normalizeSKI(ski string) (string, error) {
+	skiBytes, err := hex.DecodeString(strings.Replace(ski, ":", "", -1))
+	if err != nil || len(skiBytes) == 0 {
+		return "", errors.New("Invalid subject key ID: " + ski)
+	}
+	return hex.EncodeToString(skiBytes), nil
+}
+
+// state key of the revocation, with its fields normalized
+func revocationKey(stub shim.ChaincodeStubInterface, revocation *Revocation) (string, error) {
+	var err error
+	switch {
+	case revocation.Serial != "" && revocation.SKI == "":
+		if revocation.MspID == "" {
+			return "", errors.New("Expected the MSP ID of the serial number")
+		}
+		revocation.Serial, err = normalizeSerial(revocation.Serial)
+		if err != nil {
+			return "", err
+		}
+		return stub.CreateCompositeKey(IndexRevokedSerial, []string{revocation.MspID, revocation.Serial})
+	case revocation.SKI != "" && revocation.Serial == "":
+		revocation.MspID = ""
+		revocation.SKI, err = normalizeSKI(revocation.SKI)
+		if err != nil {
+			return "", err
+		}
+		return stub.CreateCompositeKey(IndexRevokedSKI, []string{revocation.SKI})
+	}
+	return "", errors.New("Expected either a serial number or a subject key ID")
+}
+
+func isRevoked(stub shim.ChaincodeStubInterface, mspID string, cert *x509.Certificate) (bool, error) {
+	keys := []string{}
+	key, err := stub.CreateCompositeKey(IndexRevokedSerial, []string{mspID, cert.SerialNumber.Text(16)})
+	if err != nil {
+		return false, err
+	}
+	keys = append(keys, key)
+	if len(cert.SubjectKeyId) > 0 {
+		key, err = stub.CreateCompositeKey(IndexRevokedSKI, []string{hex.EncodeToString(cert.SubjectKeyId)})
+		if err != nil {
+			return false, err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		data, err := stub.GetState(key)
+		if err != nil {
+			return false, errors.New("Error getting revocation")
+		}
+		if data != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseRevocation(args []string) (Revocation, error) {
+	revocation := Revocation{}
+	if len(args) != 1 {
+		return revocation, errors.New("Expected 1 argument")
+	}
+	err := json.Unmarshal([]byte(args[0]), &revocation)
+	if err != nil {
+		return revocation, errors.New("Error parsing revocation json")
+	}
+	return revocation, nil
+}
+
+// adds a certificate to the revocation list, callers need the admin role
+func (t *TokenChaincode) revoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	revocation, err := parseRevocation(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := revocationKey(stub, &revocation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revocationBytes, _ := json.Marshal(revocation)
+	err = stub.PutState(key, revocationBytes)
+	if err != nil {
+		return shim.Error("Error saving revocation")
+	}
+
+	stub.SetEvent("Revoked", revocationBytes)
+	return shim.Success(nil)
+}
+
+// removes a certificate from the revocation list, callers need the admin role
+func (t *TokenChaincode) unrevoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	revocation, err := parseRevocation(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := revocationKey(stub, &revocation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error("Error deleting revocation")
+	}
+
+	revocationBytes, _ := json.Marshal(revocation)
+	stub.SetEvent("Unrevoked", revocationBytes)
+	return shim.Success(nil)
+}
+
+func (t *TokenChaincode) revocationsAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	revocations := []Revocation{}
+	for _, index := range []string{IndexRevokedSerial, IndexRevokedSKI} {
+		iterator, err := stub.GetStateByPartialCompositeKey(index, []string{})
+		if err != nil {
+			return shim.Error("Error getting revocations")
+		}
+		for iterator.HasNext() {
+			kv, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return shim.Error("Error getting revocations")
+			}
+			revocation := Revocation{}
+			if err := json.Unmarshal(kv.Value, &revocation); err != nil {
+				iterator.Close()
+				return shim.Error("Error parsing revocation")
+			}
+			revocations = append(revocations, revocation)
+		}
+		iterator.Close()
+	}
+
+	result, _ := json.Marshal(revocations)
+	return shim.Success(result)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/testca"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateValidity(t *testing.T) {
+	stub := rolesLedger(t)
+	now := time.Now()
+
+	for name, opts := range map[string]testca.Options{
+		"expired":  {NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-24 * time.Hour)},
+		"upcoming": {NotBefore: now.Add(24 * time.Hour), NotAfter: now.Add(48 * time.Hour)},
+	} {
+		id := rolesCA.MustIssue(name, opts)
+		stub.MockCreator(id.MspID, id.CertPEM)
+		res := stub.MockInvoke("1", util.ToChaincodeArgs("roles"))
+		if res.Status == shim.OK || !strings.HasPrefix(res.Message, "Certificate is not valid at") {
+			t.Errorf("Expected the %s certificate to be rejected, got %q", name, res.Message)
+		}
+	}
+
+	// validity is checked against the transaction time, not the clock of the peer
+	id := rolesCA.MustIssue("expired", testca.Options{NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-24 * time.Hour)})
+	stub.MockTime(now.Add(-36 * time.Hour))
+	stub.MockCreator(id.MspID, id.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("roles")); res.Status != shim.OK {
+		t.Error("Expected the certificate to be valid at the transaction time: " + res.Message)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	stub := rolesLedger(t)
+	admin, issuer := roleActors["admin"], roleActors["issuer"]
+	alice := rolesCA.MustIssue("alice", testca.Options{})
+	bob := rolesCA.MustIssue("bob", testca.Options{})
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 100}`))
+
+	bySerial := fmt.Sprintf(`{"mspId": "%s", "serial": "%X", "reason": "key compromise"}`, alice.MspID, alice.Cert.SerialNumber)
+	bySKI := fmt.Sprintf(`{"ski": "%s"}`, hex.EncodeToString(bob.Cert.SubjectKeyId))
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("revoke", bySerial)); res.Status == shim.OK {
+		t.Error("Expected only admins to revoke certificates")
+	}
+
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	for _, revocation := range []string{bySerial, bySKI} {
+		if res := stub.MockInvoke("4", util.ToChaincodeArgs("revoke", revocation)); res.Status != shim.OK {
+			t.Fatal("Revoke failed: " + res.Message)
+		}
+	}
+	for _, invalid := range []string{`{"serial": "01"}`, `{"mspId": "Org1MSP", "serial": "01", "ski": "01"}`, `{"ski": "xyz"}`, `{}`} {
+		if res := stub.MockInvoke("5", util.ToChaincodeArgs("revoke", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected revocation %s to be rejected", invalid)
+		}
+	}
+
+	for _, id := range []*testca.Identity{alice, bob} {
+		stub.MockCreator(id.MspID, id.CertPEM)
+		res := stub.MockInvoke("6", util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 10}`))
+		if res.Message != "Certificate is revoked" {
+			t.Errorf("Expected the certificate of %s to be revoked, got %q", id.Cert.Subject.CommonName, res.Message)
+		}
+	}
+
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	revocations := []Revocation{}
+	json.Unmarshal(stub.MockInvoke("7", util.ToChaincodeArgs("revocations")).Payload, &revocations)
+	if len(revocations) != 2 || revocations[0].Serial != alice.Cert.SerialNumber.Text(16) || revocations[0].Reason != "key compromise" {
+		t.Errorf("Unexpected revocations: %+v", revocations)
+	}
+
+	if res := stub.MockInvoke("8", util.ToChaincodeArgs("unrevoke", bySKI)); res.Status != shim.OK {
+		t.Fatal("Unrevoke failed: " + res.Message)
+	}
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("9", util.ToChaincodeArgs("transfer", `{"to": "carol", "value": 10}`)); res.Status != shim.OK {
+		t.Error("Expected bob to transfer again: " + res.Message)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"sort"
+)
+
+// Roles are granted through the caller's certificate instead of on-ledger
+// lists: Token.Roles maps each role to rules on the MSP, the OUs and the
+// Fabric CA attributes of the caller, any matching rule granting the role.
+// Anonymous Idemix callers only match the rules allowing them. The mapping is
+// given at Init, by an upgrade, or by an admin with setRoles.
+
+const RoleAdmin = "admin"
+const RoleMinter = "minter"
+const RoleCompliance = "compliance"
+const RoleAuditor = "auditor"
+const RoleKYC = "kyc"
+const RoleRisk = "risk"
+
+var knownRoles = map[string]bool{
+	RoleAdmin:      true,
+	RoleMinter:     true,
+	RoleCompliance: true,
+	RoleAuditor:    true,
+	RoleKYC:        true,
+	RoleRisk:       true,
+}
+
+// OID of the extension where Fabric CA puts the attributes of the enrollment
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// the caller as seen by the role rules, Idemix callers only reveal their OU
+type callerInfo struct {
+	MspID  string
+	OUs    []string
+	Attrs  map[string]string
+	Idemix bool
+}
+
+// extracts the Fabric CA attributes of an x509 certificate
+func attrsFromX509(cert *x509.Certificate) (map[string]string, error) {
+	attrs := struct {
+		Attrs map[string]string `json:"attrs"`
+	}{}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(attrOID) {
+			if err := json.Unmarshal(ext.Value, &attrs); err != nil {
+				return nil, errors.New("Failed to parse attributes: " + err.Error())
+			}
+		}
+	}
+	if attrs.Attrs == nil {
+		attrs.Attrs = map[string]string{}
+	}
+	return attrs.Attrs, nil
+}
+
+func callerAttributes(stub shim.ChaincodeStubInterface) (callerInfo, error) {
+	info := callerInfo{Attrs: map[string]string{}}
+	serializedId, err := callerIdentity(stub)
+	if err != nil {
+		return info, err
+	}
+	info.MspID = serializedId.Mspid
+
+	if !isX509(serializedId.IdBytes) {
+		info.Idemix = true
+		idemixId := msp.SerializedIdemixIdentity{}
+		ou := msp.OrganizationUnit{}
+		if proto.Unmarshal(serializedId.IdBytes, &idemixId) == nil && proto.Unmarshal(idemixId.Ou, &ou) == nil && ou.OrganizationalUnitIdentifier != "" {
+			info.OUs = []string{ou.OrganizationalUnitIdentifier}
+		}
+		return info, nil
+	}
+
+	cert, err := callerCertificate(stub, serializedId)
+	if err != nil {
+		return info, err
+	}
+	info.OUs = cert.Subject.OrganizationalUnit
+	info.Attrs, err = attrsFromX509(cert)
+	return info, err
+}
+
+// a rule matches callers having all of its set fields,
+// an attribute without value has to be "true"
+type RoleRule struct {
+	MspID string `json:"mspId,omitempty"`
+	OU    string `json:"ou,omitempty"`
+	Attr  string `json:"attr,omitempty"`
+	Value string `json:"value,omitempty"`
+	// also matches anonymous Idemix callers, which have no attributes
+	Idemix bool `json:"idemix,omitempty"`
+}
+
+func (rule RoleRule) matches(info callerInfo) bool {
+	if info.Idemix && !rule.Idemix {
+		return false
+	}
+	if rule.MspID != "" && rule.MspID != info.MspID {
+		return false
+	}
+	if rule.OU != "" {
+		found := false
+		for _, ou := range info.OUs {
+			found = found || ou == rule.OU
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Attr != "" {
+		value, ok := info.Attrs[rule.Attr]
+		expected := rule.Value
+		if expected == "" {
+			expected = "true"
+		}
+		if !ok || value != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func validateRoles(roles map[string][]RoleRule) error {
+	for role, rules := range roles {
+		if !knownRoles[role] {
+			return errors.New("Unknown role " + role)
+		}
+		for _, rule := range rules {
+			rule.Idemix = false
+			if rule == (RoleRule{}) || (rule.Attr == "" && rule.Value != "") {
+				return errors.New("Invalid rule for role " + role)
+			}
+		}
+	}
+	return nil
+}
+
+// replaces the mapping of the token data
+func setTokenRoles(stub shim.ChaincodeStubInterface, roles map[string][]RoleRule) error {
+	if err := validateRoles(roles); err != nil {
+		return err
+	}
+	token, err := tokenData(stub)
+	if err != nil {
+		return errors.New("Error getting token data")
+	}
+	token.Roles = roles
+	tokenBytes, _ := json.Marshal(token)
+	if err := stub.PutState(KeyToken, tokenBytes); err != nil {
+		return errors.New("Error saving token data")
+	}
+	return nil
+}
+
+// replaces the roles mapping, callers need the admin role and must keep it
+func (t *TokenChaincode) setRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetRoles expected 1 argument")
+	}
+	roles := map[string][]RoleRule{}
+	if err := json.Unmarshal([]byte(args[0]), &roles); err != nil {
+		return shim.Error("Error parsing roles json")
+	}
+	if err := requireRole(stub, RoleAdmin); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// an admin locking itself out could not fix the mapping any more
+	info, err := callerAttributes(stub)
+	if err != nil {
+		return shim.Error("Error getting caller attributes")
+	}
+	admin := false
+	for _, rule := range roles[RoleAdmin] {
+		admin = admin || rule.matches(info)
+	}
+	if !admin {
+		return shim.Error("The roles must keep the admin role of the caller")
+	}
+
+	if err := setTokenRoles(stub, roles); err != nil {
+		return shim.Error(err.Error())
+	}
+	rolesBytes, _ := json.Marshal(roles)
+	stub.SetEvent("RolesChanged", rolesBytes)
+	return shim.Success(rolesBytes)
+}
+
+// roles granted to the caller by the mapping of the token data
+func callerRoles(stub shim.ChaincodeStubInterface) ([]string, error) {
+	token, err := tokenData(stub)
+	if err != nil {
+		return nil, errors.New("Error getting token data")
+	}
+	info, err := callerAttributes(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	for role, rules := range token.Roles {
+		for _, rule := range rules {
+			if rule.matches(info) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// fails unless the caller has the role
+func requireRole(stub shim.ChaincodeStubInterface, role string) error {
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return err
+	}
+	for _, granted := range roles {
+		if granted == role {
+			return nil
+		}
+	}
+	return errors.New("Caller does not have the " + role + " role")
+}
+
+func (t *TokenChaincode) rolesAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return shim.Error("Error getting roles: " + err.Error())
+	}
+	result, _ := json.Marshal(roles)
+	return shim.Success(result)
+}
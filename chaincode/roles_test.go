@@ -0,0 +1,197 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"reflect"
+	"testing"
+)
+
+const rolesToken = `{"name": "Roles", "totalSupply": 1000, "roles": {
+	"admin": [{"mspId": "Org1MSP", "ou": "admins"}],
+	"minter": [{"attr": "token.minter"}],
+	"compliance": [{"attr": "hf.Type", "value": "compliance"}, {"ou": "compliance", "idemix": true}],
+	"auditor": [{"mspId": "AuditMSP"}]
+}}`
+
+var rolesCA = testca.MustNew("Org1MSP")
+
+var roleActors = map[string]*testca.Identity{
+	"issuer":  rolesCA.MustIssue("issuer", testca.Options{}),
+	"admin":   rolesCA.MustIssue("admin", testca.Options{OUs: []string{"client", "admins"}}),
+	"minter":  rolesCA.MustIssue("minter", testca.Options{Attrs: map[string]string{"token.minter": "true"}}),
+	"officer": rolesCA.MustIssue("officer", testca.Options{Attrs: map[string]string{"hf.Type": "compliance", "token.minter": "false"}}),
+	"auditor": testca.MustNew("AuditMSP").MustIssue("auditor", testca.Options{OUs: []string{"admins"}}),
+}
+
+func rolesLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", rolesToken)); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	return stub
+}
+
+func TestAttrsFromX509(t *testing.T) {
+	attrs, err := attrsFromX509(roleActors["officer"].Cert)
+	expected := map[string]string{"hf.Type": "compliance", "token.minter": "false"}
+	if err != nil || !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("Expected attributes %v, got %v (%v)", expected, attrs, err)
+	}
+	if attrs, err := attrsFromX509(roleActors["issuer"].Cert); err != nil || len(attrs) != 0 {
+		t.Errorf("Expected no attributes, got %v (%v)", attrs, err)
+	}
+}
+
+func TestCallerRoles(t *testing.T) {
+	stub := rolesLedger(t)
+	for name, expected := range map[string][]string{
+		"issuer":  {},
+		"admin":   {RoleAdmin},
+		"minter":  {RoleMinter},
+		"officer": {RoleCompliance},
+		"auditor": {RoleAuditor},
+	} {
+		id := roleActors[name]
+		stub.MockCreator(id.MspID, id.CertPEM)
+		res := stub.MockInvoke("1", util.ToChaincodeArgs("roles"))
+		roles := []string{}
+		if err := json.Unmarshal(res.Payload, &roles); err != nil || !reflect.DeepEqual(roles, expected) {
+			t.Errorf("Expected %s to have roles %v, got %v (%s)", name, expected, roles, res.Message)
+		}
+	}
+
+	// Idemix callers are matched on the OU they reveal
+	anon := testca.MustNewIdemix("IdemixMSP", "compliance")
+	stub.MockCreator(anon.MspID, string(anon.IdBytes))
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("roles"))
+	if string(res.Payload) != `["compliance"]` {
+		t.Errorf("Expected the Idemix caller to have the compliance role, got %s (%s)", res.Payload, res.Message)
+	}
+
+	// but only by the rules allowing them
+	anon = testca.MustNewIdemix("Org1MSP", "admins")
+	stub.MockCreator(anon.MspID, string(anon.IdBytes))
+	res = stub.MockInvoke("3", util.ToChaincodeArgs("roles"))
+	if string(res.Payload) != `[]` {
+		t.Errorf("Expected the Idemix caller to have no roles, got %s (%s)", res.Payload, res.Message)
+	}
+}
+
+func TestSetRoles(t *testing.T) {
+	stub := rolesLedger(t)
+	roles := `{"admin": [{"mspId": "Org1MSP", "ou": "admins"}], "minter": [{"mspId": "Org1MSP", "ou": "client"}]}`
+
+	minter := roleActors["minter"]
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setRoles", roles)); res.Status == shim.OK {
+		t.Error("Expected a minter not to set the roles")
+	}
+
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	for _, invalid := range []string{
+		`{"admin": [{}]}`,
+		`{"admin": [{"mspId": "AuditMSP"}]}`,
+	} {
+		if res := stub.MockInvoke("2", util.ToChaincodeArgs("setRoles", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected roles %s to be rejected", invalid)
+		}
+	}
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("setRoles", roles)); res.Status != shim.OK {
+		t.Fatal("SetRoles failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("roles")); string(res.Payload) != `["admin","minter"]` {
+		t.Errorf("Expected the admin to be a minter, got %s (%s)", res.Payload, res.Message)
+	}
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("roles")); string(res.Payload) != `[]` {
+		t.Errorf("Expected the minter to have lost its role, got %s (%s)", res.Payload, res.Message)
+	}
+}
+
+func TestMint(t *testing.T) {
+	stub := rolesLedger(t)
+
+	minter := roleActors["minter"]
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("mint", `{"to": "alice", "value": 500}`)); res.Status != shim.OK {
+		t.Fatal("Mint failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 500 {
+		t.Errorf("Expected alice to hold 500 tokens, got %d", b.Value)
+	}
+	token := Token{}
+	json.Unmarshal(stub.MockInvoke("2", util.ToChaincodeArgs("info")).Payload, &token)
+	if token.TotalSupply != 1500 || len(token.Roles) != 4 {
+		t.Errorf("Expected the total supply to be 1500 with the roles kept, got %+v", token)
+	}
+
+	for _, name := range []string{"issuer", "officer"} {
+		id := roleActors[name]
+		stub.MockCreator(id.MspID, id.CertPEM)
+		if res := stub.MockInvoke("3", util.ToChaincodeArgs("mint", `{"to": "alice", "value": 500}`)); res.Status == shim.OK {
+			t.Errorf("Expected %s not to mint", name)
+		}
+	}
+}
+
+func TestBurn(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("burn", `{"value": 300}`)); res.Status != shim.OK {
+		t.Fatal("Burn failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("burn", `{"value": 701}`)); res.Status == shim.OK {
+		t.Error("Expected a burn above the balance to fail")
+	}
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("burn", `{"from": "alice", "value": 1}`)); res.Status == shim.OK {
+		t.Error("Expected the issuer not to burn alice's tokens")
+	}
+
+	token := Token{}
+	json.Unmarshal(stub.MockInvoke("4", util.ToChaincodeArgs("info")).Payload, &token)
+	if b, _ := balance(stub, "issuer"); b.Value != 700 || token.TotalSupply != 700 {
+		t.Errorf("Expected 700 tokens left, got a balance of %d and a supply of %d", b.Value, token.TotalSupply)
+	}
+	if event := stub.Events[len(stub.Events)-1]; event.EventName != "Transfer" || string(event.Payload) != `{"from":"issuer","to":"","value":300}` {
+		t.Errorf("Expected a Transfer event to nobody, got %s %s", event.EventName, event.Payload)
+	}
+}
+
+func TestInitWithInvalidRoles(t *testing.T) {
+	for _, roles := range []string{
+		`{"owner": [{"mspId": "Org1MSP"}]}`,
+		`{"admin": [{}]}`,
+		`{"admin": [{"value": "true"}]}`,
+	} {
+		stub := mock.NewFullMockStub("token", &TokenChaincode{})
+		issuer := roleActors["issuer"]
+		stub.MockCreator(issuer.MspID, issuer.CertPEM)
+		if res := stub.MockInit("init", util.ToChaincodeArgs("init", `{"roles": `+roles+`}`)); res.Status == shim.OK {
+			t.Errorf("Expected roles %s to be rejected", roles)
+		}
+	}
+}
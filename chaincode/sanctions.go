@@ -0,0 +1,337 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// Parties on the sanctions list can't send nor receive tokens. Listing the
+// SHA-256 of a CN keeps the list from disclosing the names it holds; a CN
+// listed with its MSP only blocks callers of that MSP, as receivers are not
+// known by MSP. Lists are loaded by callers with the compliance role in
+// chunks of up to maxSanctionsChunk entries, one transaction each. Every
+// imported chunk is recorded under its own key, so chunks don't conflict and
+// the sanctionsImport query tells whether all the chunks of an import arrived.
+//
+// A blocked call is committed with StatusSanctioned rather than failing, so
+// the attempt is kept on the ledger with its SanctionsHit event; it writes
+// nothing, so it doesn't change any balance. Clients, which see any status
+// below 400 as a success, must check for StatusSanctioned.
+
+const IndexSanctionedHash = "hash~sanctioned"
+const IndexSanctionedID = "msp~cn~sanctioned"
+const IndexSanctionsChunk = "list~import~chunk~sanctions"
+
+const maxSanctionsChunk = 500
+
+// below shim.ERRORTHRESHOLD, so that the peer endorses the blocked call
+const StatusSanctioned = 299
+
+func hashCN(cn string) string {
+	hash := sha256.Sum256([]byte(cn))
+	return hex.EncodeToString(hash[:])
+}
+
+// state key of the entry, with its hash normalized
+func sanctionKey(stub shim.ChaincodeStubInterface, entry *Sanction) (string, error) {
+	switch {
+	case entry.Hash != "" && entry.MspID == "" && entry.CN == "":
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return "", errors.New("Invalid hash: " + entry.Hash)
+		}
+		entry.Hash = strings.ToLower(entry.Hash)
+		return stub.CreateCompositeKey(IndexSanctionedHash, []string{entry.Hash})
+	case entry.Hash == "" && entry.MspID != "" && entry.CN != "":
+		return stub.CreateCompositeKey(IndexSanctionedID, []string{entry.MspID, entry.CN})
+	}
+	return "", errors.New("Expected either a hash or an MSP ID and a CN")
+}
+
+// the entry listing the account, of the given MSP if not empty
+func sanctioned(stub shim.ChaincodeStubInterface, cn, mspID string) (*Sanction, error) {
+	keys := []string{}
+	key, err := stub.CreateCompositeKey(IndexSanctionedHash, []string{hashCN(cn)})
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, key)
+	if mspID != "" {
+		key, err = stub.CreateCompositeKey(IndexSanctionedID, []string{mspID, cn})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		data, err := stub.GetState(key)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			entry := &Sanction{}
+			err = json.Unmarshal(data, entry)
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+// nil if no party of the call is sanctioned, the response blocking it otherwise
+func checkSanctions(stub shim.ChaincodeStubInterface, function string, transfer Transfer) *pb.Response {
+	serializedId, err := callerIdentity(stub)
+	if err != nil {
+		res := shim.Error("Error getting caller identity")
+		return &res
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		res := shim.Error("Error getting caller cn")
+		return &res
+	}
+
+	hit := SanctionsHit{TxID: stub.GetTxID(), Function: function, Caller: caller, From: transfer.From, To: transfer.To, Value: transfer.Value}
+	for _, party := range []string{caller, transfer.From, transfer.To} {
+		if party == "" {
+			continue
+		}
+		mspID := ""
+		if party == caller {
+			mspID = serializedId.Mspid
+		}
+		entry, err := sanctioned(stub, party, mspID)
+		if err != nil {
+			res := shim.Error("Error checking sanctions")
+			return &res
+		}
+		if entry != nil {
+			hit.Party, hit.List = party, entry.List
+			break
+		}
+	}
+	if hit.Party == "" {
+		return nil
+	}
+
+	hitBytes, _ := json.Marshal(hit)
+	stub.SetEvent("SanctionsHit", hitBytes)
+	return &pb.Response{Status: StatusSanctioned, Message: "Blocked: party " + hit.Party + " is sanctioned", Payload: hitBytes}
+}
+
+type sanctionsRule struct{}
+
+func (rule sanctionsRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	for _, party := range []string{transfer.From, transfer.To} {
+		if party == "" {
+			continue
+		}
+		entry, err := sanctioned(stub, party, "")
+		if err != nil {
+			return 0, err
+		}
+		if entry != nil {
+			return RestrictionSanctioned, nil
+		}
+	}
+	return RestrictionNone, nil
+}
+
+func parseSanctionsBatch(stub shim.ChaincodeStubInterface, args []string) (SanctionsBatch, []string, error) {
+	batch := SanctionsBatch{}
+	if len(args) != 1 {
+		return batch, nil, errors.New("Expected 1 argument")
+	}
+	err := json.Unmarshal([]byte(args[0]), &batch)
+	if err != nil {
+		return batch, nil, errors.New("Error parsing sanctions json")
+	}
+	if batch.List == "" {
+		return batch, nil, errors.New("Expected the list")
+	}
+	batch.Changed = 0
+	if batch.Chunks < 1 || batch.Chunk < 0 || batch.Chunk >= batch.Chunks {
+		return batch, nil, fmt.Errorf("Invalid chunk %d of %d", batch.Chunk, batch.Chunks)
+	}
+	if len(batch.Entries) > maxSanctionsChunk {
+		return batch, nil, fmt.Errorf("Chunks have at most %d entries", maxSanctionsChunk)
+	}
+
+	keys := make([]string, len(batch.Entries))
+	for i := range batch.Entries {
+		batch.Entries[i].List = batch.List
+		keys[i], err = sanctionKey(stub, &batch.Entries[i])
+		if err != nil {
+			return batch, nil, fmt.Errorf("Entry %d: %s", i, err.Error())
+		}
+	}
+	return batch, keys, nil
+}
+
+// adds a chunk of a sanctions list, callers need the compliance role
+func (t *TokenChaincode) importSanctions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	batch, keys, err := parseSanctionsBatch(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleCompliance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for i, key := range keys {
+		data, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error("Error getting sanction")
+		}
+		if data == nil {
+			batch.Changed++
+		}
+		entryBytes, _ := json.Marshal(batch.Entries[i])
+		err = stub.PutState(key, entryBytes)
+		if err != nil {
+			return shim.Error("Error saving sanction")
+		}
+	}
+
+	batch.Entries = nil
+	evtData, _ := json.Marshal(batch)
+	err = putJson(stub, IndexSanctionsChunk, []string{batch.List, batch.Import, fmt.Sprintf("%06d", batch.Chunk)}, batch)
+	if err != nil {
+		return shim.Error("Error saving chunk")
+	}
+	stub.SetEvent("SanctionsImported", evtData)
+	return shim.Success(evtData)
+}
+
+// removes a chunk of entries from the sanctions list, callers need the compliance role
+func (t *TokenChaincode) removeSanctions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	batch, keys, err := parseSanctionsBatch(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = requireRole(stub, RoleCompliance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, key := range keys {
+		data, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error("Error getting sanction")
+		}
+		if data == nil {
+			continue
+		}
+		batch.Changed++
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error deleting sanction")
+		}
+	}
+
+	batch.Entries = nil
+	evtData, _ := json.Marshal(batch)
+	stub.SetEvent("SanctionsRemoved", evtData)
+	return shim.Success(evtData)
+}
+
+// the chunks of an import received so far, for the chunk count of the highest
+// chunk if they don't agree on it
+func (t *TokenChaincode) sanctionsImportAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected import to query")
+	}
+	status := SanctionsImport{}
+	if err := json.Unmarshal([]byte(args[0]), &status); err != nil {
+		return shim.Error(err.Error())
+	}
+	if status.List == "" {
+		return shim.Error("Expected the list")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexSanctionsChunk, []string{status.List, status.Import})
+	if err != nil {
+		return shim.Error("Error getting chunks")
+	}
+	defer iterator.Close()
+
+	chunks := []SanctionsBatch{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error("Error getting chunks")
+		}
+		chunk := SanctionsBatch{}
+		if err := json.Unmarshal(kv.Value, &chunk); err != nil {
+			return shim.Error("Error parsing chunk")
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	status.Received, status.Missing = []int{}, []int{}
+	if len(chunks) > 0 {
+		status.Chunks = chunks[len(chunks)-1].Chunks
+	}
+	received := map[int]bool{}
+	for _, chunk := range chunks {
+		if chunk.Chunks == status.Chunks {
+			received[chunk.Chunk] = true
+		}
+	}
+	for chunk := 0; chunk < status.Chunks; chunk++ {
+		if received[chunk] {
+			status.Received = append(status.Received, chunk)
+		} else {
+			status.Missing = append(status.Missing, chunk)
+		}
+	}
+	status.Complete = status.Chunks > 0 && len(status.Missing) == 0
+
+	result, _ := json.Marshal(status)
+	return shim.Success(result)
+}
+
+// whether the user, of the MSP if given, is on the sanctions list
+func (t *TokenChaincode) checkSanctionAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to check")
+	}
+	status := SanctionStatus{}
+	if err := json.Unmarshal([]byte(args[0]), &status); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entry, err := sanctioned(stub, status.User, status.MspID)
+	if err != nil {
+		return shim.Error("Error checking sanctions")
+	}
+	status.Sanctioned = entry != nil
+	if entry != nil {
+		status.List = entry.List
+	}
+	result, _ := json.Marshal(status)
+	return shim.Success(result)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// bob is listed by the hash of his CN, alice of Org1MSP by her CN
+func sanctionsLedger(t *testing.T) *mock.FullMockStub {
+	stub := restrictedLedger(t, `{}`)
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	batch := fmt.Sprintf(`{"list": "OFAC", "chunk": 0, "chunks": 1, "entries": [{"hash": "%s"}, {"mspId": "Org1MSP", "cn": "alice"}]}`, strings.ToUpper(hashCN("bob")))
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("importSanctions", batch))
+	imported := SanctionsBatch{}
+	json.Unmarshal(res.Payload, &imported)
+	if res.Status != shim.OK || imported.Changed != 2 {
+		t.Fatalf("ImportSanctions failed: %s %s", res.Message, res.Payload)
+	}
+	return stub
+}
+
+func expectSanctioned(t *testing.T, stub *mock.FullMockStub, function, arg, party string) {
+	eventsBefore := len(stub.Events)
+	state := map[string][]byte{}
+	for key, value := range stub.State {
+		state[key] = value
+	}
+	res := stub.MockInvoke("sanctioned", util.ToChaincodeArgs(function, arg))
+	if !reflect.DeepEqual(state, stub.State) {
+		t.Errorf("Expected the blocked %s %s to leave the state unchanged", function, arg)
+	}
+	hit := SanctionsHit{}
+	json.Unmarshal(res.Payload, &hit)
+	if res.Status != StatusSanctioned || !strings.HasPrefix(res.Message, "Blocked: ") || hit.Party != party || hit.List != "OFAC" || hit.Function != function {
+		t.Errorf("Expected %s %s to be blocked for %s, got %d %s", function, arg, party, res.Status, res.Payload)
+	}
+	if len(stub.Events) != eventsBefore+1 || stub.Events[eventsBefore].EventName != "SanctionsHit" {
+		t.Errorf("Expected a SanctionsHit event for %s %s", function, arg)
+	}
+}
+
+func TestImportSanctions(t *testing.T) {
+	stub := sanctionsLedger(t)
+	issuer, officer := roleActors["issuer"], roleActors["officer"]
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("importSanctions", `{"list": "OFAC", "chunks": 1, "entries": []}`)); res.Status == shim.OK {
+		t.Error("Expected only compliance officers to import sanctions")
+	}
+
+	tooLarge := make([]Sanction, maxSanctionsChunk+1)
+	for i := range tooLarge {
+		tooLarge[i].Hash = hashCN(fmt.Sprint(i))
+	}
+	tooLargeBytes, _ := json.Marshal(SanctionsBatch{List: "OFAC", Chunks: 1, Entries: tooLarge})
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	for _, invalid := range []string{
+		`{"list": "OFAC", "chunk": 1, "chunks": 1, "entries": []}`,
+		`{"chunk": 0, "chunks": 1, "entries": []}`,
+		`{"list": "OFAC", "chunk": 0, "chunks": 1, "entries": [{"hash": "abcd"}]}`,
+		`{"list": "OFAC", "chunk": 0, "chunks": 1, "entries": [{"cn": "carol"}]}`,
+		string(tooLargeBytes),
+	} {
+		if res := stub.MockInvoke("2", util.ToChaincodeArgs("importSanctions", invalid)); res.Status == shim.OK {
+			t.Errorf("Expected the batch to be rejected: %.80s", invalid)
+		}
+	}
+
+	// a list in chunks, entries already listed are not counted again
+	for chunk, hashes := range [][]string{{hashCN("carol"), hashCN("dave")}, {hashCN("dave"), hashCN("erin")}} {
+		batch, _ := json.Marshal(SanctionsBatch{List: "EU", Chunk: chunk, Chunks: 2, Entries: []Sanction{{Hash: hashes[0]}, {Hash: hashes[1]}}})
+		res := stub.MockInvoke("3", util.ToChaincodeArgs("importSanctions", string(batch)))
+		imported := SanctionsBatch{}
+		json.Unmarshal(res.Payload, &imported)
+		if res.Status != shim.OK || imported.Changed != 2-chunk || imported.Chunk != chunk {
+			t.Errorf("Unexpected import of chunk %d: %s %s", chunk, res.Message, res.Payload)
+		}
+	}
+
+	for check, expected := range map[string]string{
+		`{"user": "bob"}`:                       "OFAC",
+		`{"user": "dave"}`:                      "EU",
+		`{"user": "alice"}`:                     "",
+		`{"user": "alice", "mspId": "Org1MSP"}`: "OFAC",
+		`{"user": "alice", "mspId": "Org2MSP"}`: "",
+	} {
+		status := SanctionStatus{}
+		json.Unmarshal(stub.MockInvoke("4", util.ToChaincodeArgs("checkSanction", check)).Payload, &status)
+		if status.Sanctioned != (expected != "") || status.List != expected {
+			t.Errorf("Unexpected status of %s: %+v", check, status)
+		}
+	}
+
+	batch, _ := json.Marshal(SanctionsBatch{List: "EU", Chunks: 1, Entries: []Sanction{{Hash: hashCN("dave")}, {Hash: hashCN("frank")}}})
+	res := stub.MockInvoke("5", util.ToChaincodeArgs("removeSanctions", string(batch)))
+	removed := SanctionsBatch{}
+	json.Unmarshal(res.Payload, &removed)
+	if res.Status != shim.OK || removed.Changed != 1 {
+		t.Errorf("Unexpected removal: %s %s", res.Message, res.Payload)
+	}
+	if res := stub.MockInvoke("6", util.ToChaincodeArgs("checkSanction", `{"user": "dave"}`)); strings.Contains(string(res.Payload), `"sanctioned":true`) {
+		t.Error("Expected dave to be removed from the list")
+	}
+}
+
+func TestSanctionsImportChunks(t *testing.T) {
+	stub := sanctionsLedger(t)
+	officer := roleActors["officer"]
+	stub.MockCreator(officer.MspID, officer.CertPEM)
+	importStatus := func() SanctionsImport {
+		status := SanctionsImport{}
+		json.Unmarshal(stub.MockInvoke("status", util.ToChaincodeArgs("sanctionsImport", `{"list": "OFAC", "import": "2026-10"}`)).Payload, &status)
+		return status
+	}
+
+	for _, chunk := range []int{2, 0} {
+		batch := fmt.Sprintf(`{"list": "OFAC", "import": "2026-10", "chunk": %d, "chunks": 3, "entries": [{"hash": "%s"}]}`, chunk, hashCN(fmt.Sprint(chunk)))
+		if res := stub.MockInvoke("1", util.ToChaincodeArgs("importSanctions", batch)); res.Status != shim.OK {
+			t.Fatal("ImportSanctions failed: " + res.Message)
+		}
+	}
+	if status := importStatus(); status.Complete || status.Chunks != 3 || !reflect.DeepEqual(status.Missing, []int{1}) {
+		t.Errorf("Expected chunk 1 to be missing, got %+v", status)
+	}
+	stub.MockInvoke("2", util.ToChaincodeArgs("importSanctions", `{"list": "OFAC", "import": "2026-10", "chunk": 1, "chunks": 3, "entries": []}`))
+	if status := importStatus(); !status.Complete || len(status.Received) != 3 {
+		t.Errorf("Expected the import to be complete, got %+v", status)
+	}
+}
+
+func TestSanctionedTransfers(t *testing.T) {
+	stub := sanctionsLedger(t)
+	issuer, minter, alice := roleActors["issuer"], roleActors["minter"], recoveryActors["alice"]
+
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	expectSanctioned(t, stub, "transfer", `{"to": "bob", "value": 10}`, "bob")
+	stub.MockInvoke("1", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 10}`))
+	if code := detectRestriction(t, stub, `{"from": "issuer", "to": "bob", "value": 10}`); code != RestrictionSanctioned {
+		t.Errorf("Expected the transfer to bob to be restricted, got %d", code)
+	}
+
+	// alice is listed for her MSP, so only as a caller
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectSanctioned(t, stub, "transfer", `{"to": "carol", "value": 10}`, "alice")
+	expectSanctioned(t, stub, "transferFrom", `{"from": "issuer", "to": "carol", "value": 10}`, "alice")
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	expectSanctioned(t, stub, "mint", `{"to": "bob", "value": 10}`, "bob")
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("mint", `{"to": "alice", "value": 10}`)); res.Status != shim.OK {
+		t.Error("Mint failed: " + res.Message)
+	}
+
+	if b, _ := balance(stub, "bob"); b.Value != 0 {
+		t.Errorf("Expected bob to receive nothing, got %d", b.Value)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 110 {
+		t.Errorf("Expected alice to hold 110, got %d", b.Value)
+	}
+}
+
+// the blocked calls report a success status, so they must not write anything
+func TestSanctionedCallsWriteNothing(t *testing.T) {
+	stub := sanctionsLedger(t)
+	stub.MockCollection(privateCollection, "Org1MSP", "Org2MSP")
+	alice := recoveryActors["alice"]
+	transient := map[string][]byte{TransientTransfer: []byte(`{"to": "carol", "value": 10}`)}
+
+	for i, call := range []struct {
+		function  string
+		arg       string
+		transient map[string][]byte
+	}{
+		{"transfer", `{"to": "carol", "value": 10}`, nil},
+		{"transferFrom", `{"from": "issuer", "to": "carol", "value": 10}`, nil},
+		{"burn", `{"value": 10}`, nil},
+		{"stake", `{"amount": 10}`, nil},
+		{"unstake", `{"id": "stake"}`, nil},
+		{"privateDeposit", privateCollection, transient},
+		{"privateTransfer", privateCollection, transient},
+		{"privateWithdraw", privateCollection, transient},
+		{"confidentialDeposit", `{"value": 10}`, nil},
+		{"confidentialWithdraw", `{"value": 10}`, nil},
+	} {
+		result := stub.MockEndorse(mock.Proposal{
+			TxID:      fmt.Sprint("tx", i),
+			MspID:     alice.MspID,
+			Cert:      alice.CertPEM,
+			Args:      util.ToChaincodeArgs(call.function, call.arg),
+			Transient: call.transient,
+		})
+		if result.Response.Status != StatusSanctioned {
+			t.Errorf("Expected %s to be blocked, got %d %s", call.function, result.Response.Status, result.Response.Message)
+		}
+		if len(result.RWSet.Writes) != 0 {
+			t.Errorf("Expected the blocked %s not to write, got %+v", call.function, result.RWSet.Writes)
+		}
+	}
+}
+
+func TestSanctionsHitInBlock(t *testing.T) {
+	stub := sanctionsLedger(t)
+	alice := recoveryActors["alice"]
+
+	// the blocked attempt is committed with its event, without changing the state
+	eventsBefore := len(stub.Events)
+	results := stub.MockBlock([]mock.Proposal{transferProposal("tx1", alice, `{"to": "carol", "value": 10}`)})
+	expectValidation(t, results, pb.TxValidationCode_VALID)
+	if len(results[0].RWSet.Writes) != 0 {
+		t.Errorf("Expected the blocked transfer not to write, got %+v", results[0].RWSet.Writes)
+	}
+	if events := stub.Events[eventsBefore:]; len(events) != 1 || events[0].EventName != "SanctionsHit" || events[0].TxId != "tx1" {
+		t.Error("Expected the SanctionsHit event to be committed")
+	}
+}
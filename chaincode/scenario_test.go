@@ -0,0 +1,209 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Scenario files in testdata/scenarios describe multi-party token flows
+// as a list of steps, each one called by an identity and checked against
+// the expected status, error, balances, allowances and events.
+type scenario struct {
+	Name  string         `json:"name"`
+	Steps []scenarioStep `json:"steps"`
+}
+
+type scenarioStep struct {
+	Caller   string            `json:"caller"`
+	Msp      string            `json:"msp"`
+	Function string            `json:"function"`
+	Args     []json.RawMessage `json:"args"`
+
+	// expected results, left out to skip the check;
+	// without status and error the step is expected to succeed
+	Status     int32                        `json:"status"`
+	Error      string                       `json:"error"`
+	Balances   map[string]uint64            `json:"balances"`
+	Allowances map[string]map[string]uint64 `json:"allowances"`
+	Events     []scenarioEvent              `json:"events"`
+}
+
+type scenarioEvent struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// scenario callers get certificates issued on the fly, by one test CA per MSP
+type scenarioIdentities struct {
+	cas map[string]*testca.CA
+	ids map[string]*testca.Identity
+}
+
+func newScenarioIdentities() *scenarioIdentities {
+	return &scenarioIdentities{
+		cas: map[string]*testca.CA{},
+		ids: map[string]*testca.Identity{},
+	}
+}
+
+func (s *scenarioIdentities) get(msp, cn string) *testca.Identity {
+	if _, ok := s.cas[msp]; !ok {
+		s.cas[msp] = testca.MustNew(msp)
+	}
+	if _, ok := s.ids[msp+"/"+cn]; !ok {
+		s.ids[msp+"/"+cn] = s.cas[msp].MustIssue(cn, testca.Options{})
+	}
+	return s.ids[msp+"/"+cn]
+}
+
+// string arguments are passed as they are, any other JSON value is passed encoded
+func (step *scenarioStep) chaincodeArgs() [][]byte {
+	args := [][]byte{[]byte(step.Function)}
+	for _, arg := range step.Args {
+		var str string
+		if err := json.Unmarshal(arg, &str); err == nil {
+			args = append(args, []byte(str))
+		} else {
+			args = append(args, []byte(arg))
+		}
+	}
+	return args
+}
+
+func jsonEqual(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func (step *scenarioStep) run(stub *mock.FullMockStub, ids *scenarioIdentities, txID string) error {
+	msp := step.Msp
+	if msp == "" {
+		msp = "default"
+	}
+	id := ids.get(msp, step.Caller)
+	stub.MockCreator(id.MspID, id.CertPEM)
+
+	eventsBefore := len(stub.Events)
+	var res pb.Response
+	if step.Function == "init" {
+		res = stub.MockInit(txID, step.chaincodeArgs())
+	} else {
+		res = stub.MockInvoke(txID, step.chaincodeArgs())
+	}
+	events := stub.Events[eventsBefore:]
+
+	switch {
+	case step.Status != 0 && res.Status != step.Status:
+		return fmt.Errorf("Expected status %d, got %d: %s", step.Status, res.Status, res.Message)
+	case step.Status == 0 && step.Error == "" && res.Status != shim.OK:
+		return fmt.Errorf("Expected success, got %d: %s", res.Status, res.Message)
+	case step.Error != "" && res.Status == shim.OK:
+		return fmt.Errorf("Expected error %q, got success", step.Error)
+	case step.Error != "" && !strings.Contains(res.Message, step.Error):
+		return fmt.Errorf("Expected error %q, got %q", step.Error, res.Message)
+	}
+
+	for user, expected := range step.Balances {
+		b, err := balance(stub, user)
+		if err != nil {
+			return err
+		}
+		if b.Value != expected {
+			return fmt.Errorf("Expected balance of %s to be %d, got %d", user, expected, b.Value)
+		}
+	}
+
+	for owner, expected := range step.Allowances {
+		allowances, err := allAllowances(stub, owner)
+		if err != nil {
+			return err
+		}
+		actual := map[string]uint64{}
+		for _, a := range allowances {
+			actual[a.Spender] = a.Value
+		}
+		for spender, value := range expected {
+			if actual[spender] != value {
+				return fmt.Errorf("Expected allowance of %s for %s to be %d, got %d", owner, spender, value, actual[spender])
+			}
+		}
+	}
+
+	if step.Events != nil {
+		if len(events) != len(step.Events) {
+			return fmt.Errorf("Expected %d events, got %d", len(step.Events), len(events))
+		}
+		for i, expected := range step.Events {
+			if events[i].EventName != expected.Name || !jsonEqual(events[i].Payload, expected.Payload) {
+				return fmt.Errorf("Expected event %s %s, got %s %s", expected.Name, expected.Payload, events[i].EventName, events[i].Payload)
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadScenario(path string) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "scenarios", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("No scenario files found")
+	}
+
+	for _, file := range files {
+		s, err := loadScenario(file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			stub := mock.NewFullMockStub("token", &TokenChaincode{})
+			ids := newScenarioIdentities()
+			for i, step := range s.Steps {
+				if err := step.run(stub, ids, fmt.Sprint(i+1)); err != nil {
+					t.Fatalf("%s, step %d (%s by %s): %s", s.Name, i+1, step.Function, step.Caller, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const KeySchemaVersion = "__schema"
+
+// upgrades the state from one schema version to the next
+type migration func(stub shim.ChaincodeStubInterface) error
+
+// migrations[v] upgrades the state from version v to v+1,
+// the current version is the number of registered migrations
+var migrations = []migration{
+	// version 0 is the layout written before the version was stored,
+	// the balances and allowances are unchanged in version 1
+	checkTokenState,
+}
+
+func currentSchemaVersion() uint64 {
+	return uint64(len(migrations))
+}
+
+// version of the stored state, 0 if it was written before versioning
+func schemaVersion(stub shim.ChaincodeStubInterface) (uint64, error) {
+	versionBytes, err := stub.GetState(KeySchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	if versionBytes == nil {
+		return 0, nil
+	}
+	if len(versionBytes) != 8 {
+		return 0, errors.New("Invalid schema version")
+	}
+	return binary.LittleEndian.Uint64(versionBytes), nil
+}
+
+func setSchemaVersion(stub shim.ChaincodeStubInterface, version uint64) error {
+	versionBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(versionBytes, version)
+	return stub.PutState(KeySchemaVersion, versionBytes)
+}
+
+// runs the migrations from the stored schema version instead of
+// initializing the token again, so an upgrade keeps the supply
+func (t *TokenChaincode) upgrade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	version, err := schemaVersion(stub)
+	if err != nil {
+		return shim.Error("Error getting schema version")
+	}
+
+	current := currentSchemaVersion()
+	if version > current {
+		return shim.Error(fmt.Sprintf("State schema version %d is newer than the chaincode version %d", version, current))
+	}
+
+	for ; version < current; version++ {
+		err = migrations[version](stub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Error migrating state to version %d: %s", version+1, err))
+		}
+	}
+
+	err = setSchemaVersion(stub, current)
+	if err != nil {
+		return shim.Error("Error setting schema version")
+	}
+
+	// the roles of the token data given to the upgrade replace the stored ones,
+	// so that a token initialized without roles gets an admin
+	if len(args) == 1 {
+		upgraded := Token{}
+		if err := json.Unmarshal([]byte(args[0]), &upgraded); err != nil {
+			return shim.Error("Error parsing token json")
+		}
+		if upgraded.Roles != nil {
+			if err := setTokenRoles(stub, upgraded.Roles); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// the token data must still be readable by the chaincode
+func checkTokenState(stub shim.ChaincodeStubInterface) error {
+	tokenBytes, err := stub.GetState(KeyToken)
+	if err != nil {
+		return err
+	}
+
+	token := Token{}
+	return json.Unmarshal(tokenBytes, &token)
+}
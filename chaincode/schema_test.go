@@ -0,0 +1,191 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testdata"
+	"reflect"
+	"testing"
+)
+
+// the state as written before the schema version was stored
+func unversionedLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	stub.MockTime(testdata.ValidAt)
+	tokenBytes, _ := json.Marshal(fabricToken)
+
+	stub.MockTransactionStart("layout")
+	stub.PutState(KeyToken, tokenBytes)
+	put := func(index string, attributes []string, value uint64) {
+		key, err := stub.CreateCompositeKey(index, attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valueBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(valueBytes, value)
+		stub.PutState(key, valueBytes)
+	}
+	put(IndexBalance, []string{testdata.TestUser1CN}, 9900)
+	put(IndexBalance, []string{"testUser2"}, 100)
+	put(IndexAllowance, []string{testdata.TestUser1CN, "testUser2"}, 50)
+	stub.MockTransactionEnd("layout")
+	return stub
+}
+
+func storedSchemaVersion(t *testing.T, stub *mock.FullMockStub) uint64 {
+	versionBytes := stub.State[KeySchemaVersion]
+	if len(versionBytes) != 8 {
+		t.Fatalf("Expected the schema version to be stored, got %v", versionBytes)
+	}
+	return binary.LittleEndian.Uint64(versionBytes)
+}
+
+func TestInitStoresSchemaVersion(t *testing.T) {
+	stub := initToken(t)
+	if version := storedSchemaVersion(t, stub); version != currentSchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d", currentSchemaVersion(), version)
+	}
+}
+
+func TestReInitKeepsSupply(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "testUser2", "value": 100}`))
+
+	// a second init with another supply, by another user
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInit("2", util.ToChaincodeArgs("init", `{"name": "Other", "totalSupply": 500}`))
+	if res.Status != shim.OK {
+		t.Fatal("Re-init failed: " + res.Message)
+	}
+
+	balanceFrom, _ := balance(stub, testdata.TestUser1CN)
+	balanceTo, _ := balance(stub, "testUser2")
+	if balanceFrom.Value != 9900 || balanceTo.Value != 100 {
+		t.Errorf("Expected the balances to be kept: (%d, %d)", balanceFrom.Value, balanceTo.Value)
+	}
+
+	token := Token{}
+	json.Unmarshal(stub.MockInvoke("3", util.ToChaincodeArgs("info")).Payload, &token)
+	if !reflect.DeepEqual(token, fabricToken) {
+		t.Errorf("Expected the token data to be kept, got %+v", token)
+	}
+}
+
+func TestUpgradeFromUnversionedLayout(t *testing.T) {
+	stub := unversionedLedger(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	res := stub.MockInit("1", util.ToChaincodeArgs("init"))
+	if res.Status != shim.OK {
+		t.Fatal("Upgrade failed: " + res.Message)
+	}
+	if version := storedSchemaVersion(t, stub); version != currentSchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d", currentSchemaVersion(), version)
+	}
+
+	// the existing balances and allowances are still used
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	transferData := `{"from": "` + testdata.TestUser1CN + `", "to": "testUser3", "value": 50}`
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("transferFrom", transferData)); res.Status != shim.OK {
+		t.Fatal("TransferFrom failed: " + res.Message)
+	}
+	balanceFrom, _ := balance(stub, testdata.TestUser1CN)
+	balanceTo, _ := balance(stub, "testUser3")
+	if balanceFrom.Value != 9850 || balanceTo.Value != 50 {
+		t.Errorf("Expected the migrated balances to be used: (%d, %d)", balanceFrom.Value, balanceTo.Value)
+	}
+}
+
+func TestUpgradeWithRoles(t *testing.T) {
+	stub := unversionedLedger(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	if res := stub.MockInit("1", util.ToChaincodeArgs("init", `{"roles": {"admin": [{}]}}`)); res.Status == shim.OK {
+		t.Error("Expected invalid roles to fail the upgrade")
+	}
+	upgrade := `{"name": "Other", "roles": {"admin": [{"mspId": "default"}]}}`
+	if res := stub.MockInit("2", util.ToChaincodeArgs("init", upgrade)); res.Status != shim.OK {
+		t.Fatal("Upgrade failed: " + res.Message)
+	}
+
+	// only the roles are applied
+	token := Token{}
+	json.Unmarshal(stub.State[KeyToken], &token)
+	expected := fabricToken
+	expected.Roles = map[string][]RoleRule{RoleAdmin: {{MspID: "default"}}}
+	if !reflect.DeepEqual(token, expected) {
+		t.Errorf("Expected the roles to be set, got %+v", token)
+	}
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("roles")); string(res.Payload) != `["admin"]` {
+		t.Errorf("Expected the caller to be admin, got %s (%s)", res.Payload, res.Message)
+	}
+}
+
+func TestUpgradeRunsMigrationsOnce(t *testing.T) {
+	stub := unversionedLedger(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	registered := migrations
+	defer func() { migrations = registered }()
+	runs := 0
+	migrations = append(append([]migration{}, registered...), func(stub shim.ChaincodeStubInterface) error {
+		runs++
+		return stub.PutState("migrated", []byte("yes"))
+	})
+
+	for _, txID := range []string{"1", "2"} {
+		if res := stub.MockInit(txID, util.ToChaincodeArgs("init")); res.Status != shim.OK {
+			t.Fatal("Upgrade failed: " + res.Message)
+		}
+	}
+	if runs != 1 || string(stub.State["migrated"]) != "yes" {
+		t.Errorf("Expected the migration to run once, ran %d times", runs)
+	}
+	if version := storedSchemaVersion(t, stub); version != uint64(len(registered)+1) {
+		t.Errorf("Expected schema version %d, got %d", len(registered)+1, version)
+	}
+}
+
+func TestUpgradeFailures(t *testing.T) {
+	stub := unversionedLedger(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	registered := migrations
+	defer func() { migrations = registered }()
+	migrations = append(append([]migration{}, registered...), func(stub shim.ChaincodeStubInterface) error {
+		return errors.New("broken")
+	})
+	if res := stub.MockInit("1", util.ToChaincodeArgs("init")); res.Status == shim.OK {
+		t.Error("Expected a failing migration to fail the upgrade")
+	}
+
+	// a downgrade cannot read the state of a newer chaincode
+	migrations = registered
+	stub.MockTransactionStart("newer")
+	setSchemaVersion(stub, currentSchemaVersion()+1)
+	stub.MockTransactionEnd("newer")
+	if res := stub.MockInit("2", util.ToChaincodeArgs("init")); res.Status == shim.OK {
+		t.Error("Expected an upgrade from a newer schema to fail")
+	}
+}
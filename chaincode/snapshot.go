@@ -0,0 +1,219 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Snapshots record balances and the total supply at a point in time, the way
+// ERC20Snapshot does: taking one only increments the current snapshot ID,
+// and the first change of a balance or of the supply after it writes the
+// value it had under that ID. The value at a snapshot is the one recorded
+// under the first ID from it, or the current one if there is none.
+// The records have simple keys, which unlike composite keys can be read from
+// an ID on with GetStateByRange.
+
+const KeySnapshot = "__snapshot"
+const IndexSnapshotBalance = "cn~snapshot~balance"
+const IndexSnapshotSupply = "snapshot~supply"
+
+func currentSnapshot(stub shim.ChaincodeStubInterface) (Snapshot, error) {
+	snapshot := Snapshot{}
+	data, err := stub.GetState(KeySnapshot)
+	if err != nil || data == nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func snapshotID(id uint64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+// key of a snapshot record: the index, the attributes and the snapshot ID
+// separated by null characters, which the attributes can't contain
+func snapshotKey(index string, attrs []string, id string) (string, error) {
+	for _, attr := range attrs {
+		if !utf8.ValidString(attr) || strings.ContainsRune(attr, 0) {
+			return "", fmt.Errorf("Invalid snapshot attribute %q", attr)
+		}
+	}
+	return strings.Join(append(append([]string{index}, attrs...), id), "\x00"), nil
+}
+
+// records the value before its first change since the current snapshot
+func updateSnapshot(stub shim.ChaincodeStubInterface, index string, attrs []string, value uint64) error {
+	snapshot, err := currentSnapshot(stub)
+	if err != nil || snapshot.ID == 0 {
+		return err
+	}
+	key, err := snapshotKey(index, attrs, snapshotID(snapshot.ID))
+	if err != nil {
+		return err
+	}
+	recorded, err := stub.GetState(key)
+	if err != nil || recorded != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return stub.PutState(key, data)
+}
+
+// the value recorded under the first snapshot from id, if any
+func snapshotValue(stub shim.ChaincodeStubInterface, index string, attrs []string, id uint64) (uint64, bool, error) {
+	startKey, err := snapshotKey(index, attrs, snapshotID(id))
+	if err != nil {
+		return 0, false, err
+	}
+	// the IDs are digits, all below the end key
+	endKey, _ := snapshotKey(index, attrs, "~")
+	iterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return 0, false, err
+	}
+	defer iterator.Close()
+
+	if !iterator.HasNext() {
+		return 0, false, nil
+	}
+	kv, err := iterator.Next()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(kv.Value) != 8 {
+		return 0, false, fmt.Errorf("Invalid snapshot record %q", kv.Key)
+	}
+	return binary.LittleEndian.Uint64(kv.Value), true, nil
+}
+
+// checks that the snapshot was taken
+func checkSnapshotID(stub shim.ChaincodeStubInterface, id uint64) error {
+	snapshot, err := currentSnapshot(stub)
+	if err != nil {
+		return errors.New("Error getting snapshot")
+	}
+	if id == 0 || id > snapshot.ID {
+		return fmt.Errorf("Unknown snapshot: %d", id)
+	}
+	return nil
+}
+
+func takeSnapshot(stub shim.ChaincodeStubInterface) (Snapshot, error) {
+	snapshot, err := currentSnapshot(stub)
+	if err != nil {
+		return snapshot, errors.New("Error getting snapshot")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot = Snapshot{ID: snapshot.ID + 1, Time: now.Format(time.RFC3339)}
+	snapshotBytes, _ := json.Marshal(snapshot)
+	if err := stub.PutState(KeySnapshot, snapshotBytes); err != nil {
+		return snapshot, errors.New("Error saving snapshot")
+	}
+	stub.SetEvent("Snapshot", snapshotBytes)
+	return snapshot, nil
+}
+
+func (t *TokenChaincode) snapshot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Snapshot expected no arguments")
+	}
+	err := requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	snapshot, err := takeSnapshot(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, _ := json.Marshal(snapshot)
+	return shim.Success(result)
+}
+
+func (t *TokenChaincode) balanceAt(stub shim.ChaincodeStubInterface, cn string, id uint64) (uint64, error) {
+	value, recorded, err := snapshotValue(stub, IndexSnapshotBalance, []string{cn}, id)
+	if err != nil || recorded {
+		return value, err
+	}
+	return t.balance(stub, cn)
+}
+
+func totalSupplyAt(stub shim.ChaincodeStubInterface, id uint64) (uint64, error) {
+	value, recorded, err := snapshotValue(stub, IndexSnapshotSupply, []string{}, id)
+	if err != nil || recorded {
+		return value, err
+	}
+	token, err := tokenData(stub)
+	return token.TotalSupply, err
+}
+
+func (t *TokenChaincode) balanceOfAtAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user and snapshot to query")
+	}
+	balanceRq := SnapshotBalance{}
+	if err := json.Unmarshal([]byte(args[0]), &balanceRq); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkSnapshotID(stub, balanceRq.SnapshotID); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	balance, err := t.balanceAt(stub, balanceRq.User, balanceRq.SnapshotID)
+	if err != nil {
+		return shim.Error("Error getting balance: " + err.Error())
+	}
+	balanceRq.Value = balance
+	result, _ := json.Marshal(balanceRq)
+	return shim.Success(result)
+}
+
+// total supply at the snapshot given as a number
+func (t *TokenChaincode) totalSupplyAtAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected the snapshot to query")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return shim.Error("Invalid snapshot: " + args[0])
+	}
+	if err := checkSnapshotID(stub, id); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	supply, err := totalSupplyAt(stub, id)
+	if err != nil {
+		return shim.Error("Error getting total supply: " + err.Error())
+	}
+	result, _ := json.Marshal(SnapshotSupply{SnapshotID: id, TotalSupply: supply})
+	return shim.Success(result)
+}
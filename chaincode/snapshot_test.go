@@ -0,0 +1,148 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"testing"
+)
+
+func adminSnapshot(t *testing.T, stub *mock.FullMockStub) Snapshot {
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	res := stub.MockInvoke("snapshot", util.ToChaincodeArgs("snapshot"))
+	if res.Status != shim.OK {
+		t.Fatal("Snapshot failed: " + res.Message)
+	}
+	snapshot := Snapshot{}
+	json.Unmarshal(res.Payload, &snapshot)
+	return snapshot
+}
+
+func balanceOfAt(stub *mock.FullMockStub, cn string, id uint64) (uint64, error) {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("balanceOfAt", fmt.Sprintf(`{"user": "%s", "snapshotId": %d}`, cn, id)))
+	if res.Status != shim.OK {
+		return 0, errors.New(res.Message)
+	}
+	balance := SnapshotBalance{}
+	err := json.Unmarshal(res.Payload, &balance)
+	return balance.Value, err
+}
+
+func supplyAt(stub *mock.FullMockStub, id uint64) (uint64, error) {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("totalSupplyAt", fmt.Sprint(id)))
+	if res.Status != shim.OK {
+		return 0, errors.New(res.Message)
+	}
+	supply := SnapshotSupply{}
+	err := json.Unmarshal(res.Payload, &supply)
+	return supply.TotalSupply, err
+}
+
+func TestSnapshot(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer, minter := roleActors["issuer"], roleActors["minter"]
+	alice := recoveryActors["alice"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("snapshot")); res.Status == shim.OK {
+		t.Error("Expected only admins to take snapshots")
+	}
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	token, _ := tokenData(stub)
+	supply := token.TotalSupply
+
+	if snapshot := adminSnapshot(t, stub); snapshot.ID != 1 || snapshot.Time == "" {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("3", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 30}`))
+	stub.MockCreator(minter.MspID, minter.CertPEM)
+	stub.MockInvoke("4", util.ToChaincodeArgs("mint", `{"to": "carol", "value": 50}`))
+
+	adminSnapshot(t, stub)
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	stub.MockInvoke("5", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 20}`))
+	stub.MockInvoke("6", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 20}`))
+
+	for _, expected := range []struct {
+		user  string
+		id    uint64
+		value uint64
+	}{
+		{"alice", 1, 100}, {"alice", 2, 70},
+		{"bob", 1, 0}, {"bob", 2, 30},
+		{"carol", 1, 0}, {"carol", 2, 50},
+		{"issuer", 1, supply - 100}, {"issuer", 2, supply - 100},
+	} {
+		if value, err := balanceOfAt(stub, expected.user, expected.id); err != nil || value != expected.value {
+			t.Errorf("Expected %s to have %d at snapshot %d, got %d (%v)", expected.user, expected.value, expected.id, value, err)
+		}
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 30 {
+		t.Errorf("Expected the current balance to be 30, got %d", b.Value)
+	}
+	if value, err := supplyAt(stub, 1); err != nil || value != supply {
+		t.Errorf("Expected the supply %d at snapshot 1, got %d (%v)", supply, value, err)
+	}
+	if value, err := supplyAt(stub, 2); err != nil || value != supply+50 {
+		t.Errorf("Expected the supply %d at snapshot 2, got %d (%v)", supply+50, value, err)
+	}
+	for _, id := range []uint64{0, 3} {
+		if _, err := balanceOfAt(stub, "alice", id); err == nil {
+			t.Errorf("Expected no balance at snapshot %d", id)
+		}
+		if _, err := supplyAt(stub, id); err == nil {
+			t.Errorf("Expected no supply at snapshot %d", id)
+		}
+	}
+
+	// only the first change after a snapshot is recorded
+	startKey, _ := snapshotKey(IndexSnapshotBalance, []string{"alice"}, "")
+	endKey, _ := snapshotKey(IndexSnapshotBalance, []string{"alice"}, "~")
+	iterator, _ := stub.GetStateByRange(startKey, endKey)
+	defer iterator.Close()
+	records := 0
+	for ; iterator.HasNext(); records++ {
+		iterator.Next()
+	}
+	if records != 2 {
+		t.Errorf("Expected 2 recorded balances of alice, got %d", records)
+	}
+}
+
+func TestSnapshotInBlock(t *testing.T) {
+	stub := rolesLedger(t)
+	issuer, admin := roleActors["issuer"], roleActors["admin"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+
+	// a transfer endorsed before the snapshot would miss recording the balance
+	results := stub.MockBlock([]mock.Proposal{
+		{TxID: "tx1", MspID: admin.MspID, Cert: admin.CertPEM, Args: util.ToChaincodeArgs("snapshot")},
+		transferProposal("tx2", recoveryActors["alice"], `{"to": "bob", "value": 10}`),
+	})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT)
+	if value, err := balanceOfAt(stub, "alice", 1); err != nil || value != 100 {
+		t.Errorf("Expected alice to have 100 at snapshot 1, got %d (%v)", value, err)
+	}
+}
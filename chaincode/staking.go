@@ -0,0 +1,492 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"time"
+)
+
+// Staked tokens leave the holder's balance until the lock period of the stake
+// is over. Rewards are paid at a rate per second out of a pool funded by the
+// admin, shared by the staked tokens: as in the Synthetix staking rewards, the
+// rewards per staked token, scaled by 10^18, add up since staking started, and
+// the rewards of a holder are what its staked tokens earned since it last
+// staked, unstaked or claimed. Every one of these updates the total staked,
+// so the ones in a block conflict with each other.
+
+const KeyStaking = "__staking"
+const IndexStakingAccount = "cn~staking"
+const IndexStake = "cn~id~stake"
+
+// lock periods are in seconds, up to 100 years
+const maxLockPeriod = 100 * 365 * 24 * 60 * 60
+
+func stakingState(stub shim.ChaincodeStubInterface) (Staking, error) {
+	staking := Staking{}
+	data, err := stub.GetState(KeyStaking)
+	if err != nil || data == nil {
+		return staking, err
+	}
+	err = json.Unmarshal(data, &staking)
+	return staking, err
+}
+
+// adds the rewards of the time since the last update to the rewards per token
+func accrueRewards(stub shim.ChaincodeStubInterface, staking *Staking) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	if staking.LastUpdate == "" {
+		staking.LastUpdate = now.Format(time.RFC3339)
+		return nil
+	}
+	last, err := time.Parse(time.RFC3339, staking.LastUpdate)
+	if err != nil {
+		return errors.New("Error parsing staking update time")
+	}
+	// timestamps set by clients don't always increase
+	if !now.After(last) {
+		return nil
+	}
+	seconds := uint64(now.Sub(last) / time.Second)
+	if seconds == 0 {
+		return nil
+	}
+	staking.LastUpdate = last.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339)
+	if staking.TotalStaked == 0 {
+		return nil
+	}
+
+	reward := new(big.Int).Mul(bigUint(staking.Rate), bigUint(seconds))
+	if reward.Cmp(bigUint(staking.Pool)) > 0 {
+		reward = bigUint(staking.Pool)
+	}
+	perToken := new(big.Int).Mul(reward, dividendScale)
+	perToken.Quo(perToken, bigUint(staking.TotalStaked))
+	// rounded up, at most the reward: the accounts round their shares of every
+	// change of the rewards per token down, so they never earn more than this
+	allocated := new(big.Int).Mul(perToken, bigUint(staking.TotalStaked))
+	allocated.Add(allocated, new(big.Int).Sub(dividendScale, big.NewInt(1)))
+	allocated.Quo(allocated, dividendScale)
+
+	staking.Pool -= allocated.Uint64()
+	staking.Rewards += allocated.Uint64()
+	staking.RewardPerToken = new(big.Int).Add(parseBig(staking.RewardPerToken), perToken).String()
+	return nil
+}
+
+// adds what the staked tokens of the account earned since its last update
+func earnRewards(staking Staking, account *StakingAccount) {
+	perToken := parseBig(staking.RewardPerToken)
+	earned := new(big.Int).Sub(perToken, parseBig(account.RewardPerTokenPaid))
+	earned.Mul(earned, bigUint(account.Staked))
+	earned.Quo(earned, dividendScale)
+	account.Rewards += earned.Uint64()
+	account.RewardPerTokenPaid = perToken.String()
+}
+
+// the staking state and the account of the caller, with their rewards up to now
+func (t *TokenChaincode) stakingAccount(stub shim.ChaincodeStubInterface, cn string) (Staking, StakingAccount, error) {
+	account := StakingAccount{User: cn}
+	staking, err := stakingState(stub)
+	if err != nil {
+		return staking, account, errors.New("Error getting staking")
+	}
+	if err := accrueRewards(stub, &staking); err != nil {
+		return staking, account, err
+	}
+	if _, err := getJson(stub, IndexStakingAccount, []string{cn}, &account); err != nil {
+		return staking, account, errors.New("Error getting staking account")
+	}
+	earnRewards(staking, &account)
+	return staking, account, nil
+}
+
+func saveStaking(stub shim.ChaincodeStubInterface, staking Staking, account StakingAccount) error {
+	stakingBytes, _ := json.Marshal(staking)
+	if err := stub.PutState(KeyStaking, stakingBytes); err != nil {
+		return errors.New("Error saving staking")
+	}
+	if err := putJson(stub, IndexStakingAccount, []string{account.User}, account); err != nil {
+		return errors.New("Error saving staking account")
+	}
+	return nil
+}
+
+// moves the stakes and rewards of a migrated account to the new one, reading
+// the staking state only if the old account staked
+func (t *TokenChaincode) migrateStakes(stub shim.ChaincodeStubInterface, from, to string) error {
+	found, err := getJson(stub, IndexStakingAccount, []string{from}, &StakingAccount{})
+	if err != nil || !found {
+		return err
+	}
+	staking, fromAccount, err := t.stakingAccount(stub, from)
+	if err != nil {
+		return err
+	}
+	toAccount := StakingAccount{User: to}
+	if _, err := getJson(stub, IndexStakingAccount, []string{to}, &toAccount); err != nil {
+		return errors.New("Error getting staking account")
+	}
+	earnRewards(staking, &toAccount)
+	// both are parts of the totals of the staking state
+	toAccount.Staked += fromAccount.Staked
+	toAccount.Rewards += fromAccount.Rewards
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexStake, []string{from})
+	if err != nil {
+		return errors.New("Error getting stakes")
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return errors.New("Error getting stakes")
+		}
+		stake := Stake{}
+		if err := json.Unmarshal(kv.Value, &stake); err != nil {
+			return errors.New("Error parsing stake")
+		}
+		stake.User = to
+		if err := putJson(stub, IndexStake, []string{to, stake.ID}, stake); err != nil {
+			return errors.New("Error saving stake")
+		}
+		if err := stub.DelState(kv.Key); err != nil {
+			return errors.New("Error deleting stake")
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(IndexStakingAccount, []string{from})
+	if err == nil {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return errors.New("Error deleting staking account")
+	}
+	return saveStaking(stub, staking, toAccount)
+}
+
+// sets the rewards per second and adds the given amount of the caller's tokens to the pool
+func (t *TokenChaincode) setStakingRewards(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetStakingRewards expected 1 argument")
+	}
+	rewards := StakingRewards{}
+	err := json.Unmarshal([]byte(args[0]), &rewards)
+	if err != nil {
+		return shim.Error("Error parsing staking rewards json")
+	}
+	err = requireRole(stub, RoleAdmin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	admin, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+
+	// rewards until now are paid at the former rate
+	staking, account, err := t.stakingAccount(stub, admin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rewards.Fund > 0 {
+		adminBalance, err := t.balance(stub, admin)
+		if err != nil {
+			return shim.Error("Error getting balance")
+		}
+		if adminBalance < rewards.Fund {
+			return shim.Error("Not enough balance")
+		}
+		if staking.Pool+rewards.Fund < staking.Pool {
+			return shim.Error("Reward pool overflow")
+		}
+		if err := t.setBalance(stub, admin, adminBalance-rewards.Fund); err != nil {
+			return shim.Error("Error setting balance")
+		}
+		staking.Pool += rewards.Fund
+	}
+	staking.Rate = rewards.Rate
+
+	if err := saveStaking(stub, staking, account); err != nil {
+		return shim.Error(err.Error())
+	}
+	stakingBytes, _ := json.Marshal(staking)
+	stub.SetEvent("StakingRewardsUpdated", stakingBytes)
+	return shim.Success(stakingBytes)
+}
+
+func (t *TokenChaincode) stake(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Stake expected 1 argument")
+	}
+	stake := Stake{}
+	err := json.Unmarshal([]byte(args[0]), &stake)
+	if err != nil {
+		return shim.Error("Error parsing stake json")
+	}
+	if stake.Amount == 0 {
+		return shim.Error("Expected the amount to stake")
+	}
+	if stake.LockPeriod > maxLockPeriod {
+		return shim.Error("Lock period is at most 100 years")
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	// staked tokens leave the balance like a transfer of the caller to itself
+	staked := Transfer{From: caller, To: caller, Value: stake.Amount}
+	if res := checkSanctions(stub, "stake", staked); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, staked); res != nil {
+		return *res
+	}
+
+	staking, account, err := t.stakingAccount(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callerBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	if callerBalance < stake.Amount {
+		return shim.Error("Not enough balance")
+	}
+	if staking.TotalStaked+stake.Amount < staking.TotalStaked {
+		return shim.Error("Total staked overflow")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	maturity := now.Add(time.Duration(stake.LockPeriod) * time.Second)
+	stake.User = caller
+	stake.ID = stub.GetTxID()
+	stake.Start = now.Format(time.RFC3339)
+	stake.Maturity = maturity.Format(time.RFC3339)
+
+	account.Staked += stake.Amount
+	staking.TotalStaked += stake.Amount
+	if err := t.setBalance(stub, caller, callerBalance-stake.Amount); err != nil {
+		return shim.Error("Error setting balance")
+	}
+	if err := putJson(stub, IndexStake, []string{caller, stake.ID}, stake); err != nil {
+		return shim.Error("Error saving stake")
+	}
+	if err := recordSpending(stub, caller, stake.Amount); err != nil {
+		return shim.Error("Error recording spending")
+	}
+	if err := saveStaking(stub, staking, account); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stakeBytes, _ := json.Marshal(stake)
+	stub.SetEvent("Staked", stakeBytes)
+	return shim.Success(stakeBytes)
+}
+
+// returns the tokens of a stake of the caller after its lock period
+func (t *TokenChaincode) unstake(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Unstake expected 1 argument")
+	}
+	rq := Stake{}
+	err := json.Unmarshal([]byte(args[0]), &rq)
+	if err != nil {
+		return shim.Error("Error parsing stake json")
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "unstake", Transfer{From: caller, To: caller}); res != nil {
+		return *res
+	}
+
+	stake := Stake{}
+	found, err := getJson(stub, IndexStake, []string{caller, rq.ID}, &stake)
+	if err != nil {
+		return shim.Error("Error getting stake")
+	}
+	if !found {
+		return shim.Error("Unknown stake: " + rq.ID)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	maturity, err := time.Parse(time.RFC3339, stake.Maturity)
+	if err != nil {
+		return shim.Error("Error parsing stake maturity")
+	}
+	if now.Before(maturity) {
+		return shim.Error(fmt.Sprintf("Stake is locked until %s", stake.Maturity))
+	}
+	// unstaked tokens come back as if they were minted to the caller
+	if res := t.checkRestrictions(stub, Transfer{To: caller, Value: stake.Amount}); res != nil {
+		return *res
+	}
+
+	staking, account, err := t.stakingAccount(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callerBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	if callerBalance+stake.Amount < callerBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	account.Staked -= stake.Amount
+	staking.TotalStaked -= stake.Amount
+	if err := t.setBalance(stub, caller, callerBalance+stake.Amount); err != nil {
+		return shim.Error("Error setting balance")
+	}
+	key, err := stub.CreateCompositeKey(IndexStake, []string{caller, stake.ID})
+	if err == nil {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return shim.Error("Error deleting stake")
+	}
+	if err := saveStaking(stub, staking, account); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stakeBytes, _ := json.Marshal(stake)
+	stub.SetEvent("Unstaked", stakeBytes)
+	return shim.Success(stakeBytes)
+}
+
+// pays the caller's rewards out of the pool
+func (t *TokenChaincode) claimRewards(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	staking, account, err := t.stakingAccount(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if account.Rewards == 0 {
+		return shim.Error("No rewards to claim")
+	}
+	if account.Rewards > staking.Rewards {
+		return shim.Error("Rewards above the allocated ones")
+	}
+	if res := checkSanctions(stub, "claimRewards", Transfer{To: caller, Value: account.Rewards}); res != nil {
+		return *res
+	}
+	// the rewards enter the caller's balance like a mint
+	if res := t.checkRestrictions(stub, Transfer{To: caller, Value: account.Rewards}); res != nil {
+		return *res
+	}
+	callerBalance, err := t.balance(stub, caller)
+	if err != nil {
+		return shim.Error("Error getting balance")
+	}
+	if callerBalance+account.Rewards < callerBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	paid := Balance{User: caller, Value: account.Rewards}
+	staking.Rewards -= paid.Value
+	account.Rewards = 0
+	if err := t.setBalance(stub, caller, callerBalance+paid.Value); err != nil {
+		return shim.Error("Error setting balance")
+	}
+	if err := saveStaking(stub, staking, account); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	paidBytes, _ := json.Marshal(paid)
+	stub.SetEvent("RewardsClaimed", paidBytes)
+	return shim.Success(paidBytes)
+}
+
+// tokens staked by the user, its stakes and its rewards up to now
+func (t *TokenChaincode) stakedBalanceAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	balanceRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &balanceRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, account, err := t.stakingAccount(stub, balanceRq.User)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexStake, []string{balanceRq.User})
+	if err != nil {
+		return shim.Error("Error getting stakes")
+	}
+	defer iterator.Close()
+
+	staked := StakedBalance{User: balanceRq.User, Value: account.Staked, Rewards: account.Rewards, Stakes: []Stake{}}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error("Error getting stakes")
+		}
+		stake := Stake{}
+		if err := json.Unmarshal(kv.Value, &stake); err != nil {
+			return shim.Error("Error parsing stake")
+		}
+		staked.Stakes = append(staked.Stakes, stake)
+	}
+
+	result, _ := json.Marshal(staked)
+	return shim.Success(result)
+}
+
+// the staking rates and totals
+func (t *TokenChaincode) stakingAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	staking, err := stakingState(stub)
+	if err != nil {
+		return shim.Error("Error getting staking")
+	}
+	if err := accrueRewards(stub, &staking); err != nil {
+		return shim.Error(err.Error())
+	}
+	result, _ := json.Marshal(staking)
+	return shim.Success(result)
+}
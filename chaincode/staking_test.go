@@ -0,0 +1,275 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"testing"
+	"time"
+)
+
+var stakingStart = time.Now().UTC().Truncate(time.Second)
+
+// alice has 300 tokens, bob 100 and the admin funds a pool of 200 paying 10 per second
+func stakingLedger(t *testing.T) *mock.FullMockStub {
+	stub := rolesLedger(t)
+	stub.MockTime(stakingStart)
+	issuer, admin := roleActors["issuer"], roleActors["admin"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	for _, transfer := range []string{`{"to": "alice", "value": 300}`, `{"to": "bob", "value": 100}`, `{"to": "admin", "value": 200}`} {
+		stub.MockInvoke(transfer, util.ToChaincodeArgs("transfer", transfer))
+	}
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("rewards", util.ToChaincodeArgs("setStakingRewards", `{"rate": 10, "fund": 200}`)); res.Status != shim.OK {
+		t.Fatal("SetStakingRewards failed: " + res.Message)
+	}
+	return stub
+}
+
+func stakeTokens(stub *mock.FullMockStub, holder *testca.Identity, txID, stakeData string) pb.Response {
+	stub.MockCreator(holder.MspID, holder.CertPEM)
+	return stub.MockInvoke(txID, util.ToChaincodeArgs("stake", stakeData))
+}
+
+func stakedBalance(stub *mock.FullMockStub, cn string) StakedBalance {
+	staked := StakedBalance{}
+	json.Unmarshal(stub.MockInvoke("1", util.ToChaincodeArgs("stakedBalance", `{"user": "`+cn+`"}`)).Payload, &staked)
+	return staked
+}
+
+func TestSetStakingRewards(t *testing.T) {
+	stub := stakingLedger(t)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setStakingRewards", `{"rate": 100}`)); res.Status == shim.OK {
+		t.Error("Expected only admins to set the staking rewards")
+	}
+	admin := roleActors["admin"]
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("setStakingRewards", `{"rate": 10, "fund": 1}`)); res.Status == shim.OK {
+		t.Error("Expected the pool to be funded by the admin's balance")
+	}
+
+	staking := Staking{}
+	json.Unmarshal(stub.MockInvoke("3", util.ToChaincodeArgs("staking")).Payload, &staking)
+	if staking.Rate != 10 || staking.Pool != 200 || staking.TotalStaked != 0 {
+		t.Errorf("Unexpected staking %+v", staking)
+	}
+	if b, _ := balance(stub, "admin"); b.Value != 0 {
+		t.Errorf("Expected the admin's tokens in the pool, got %d left", b.Value)
+	}
+}
+
+func TestStake(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+	for _, invalid := range []string{`{"amount": 0}`, `{"amount": 301}`, `{"amount": 1, "lockPeriod": 9999999999}`} {
+		if res := stakeTokens(stub, alice, "invalid", invalid); res.Status == shim.OK {
+			t.Errorf("Expected the stake %s to be rejected", invalid)
+		}
+	}
+	if res := stakeTokens(stub, alice, "stake-alice", `{"amount": 100, "lockPeriod": 3600}`); res.Status != shim.OK {
+		t.Fatal("Stake failed: " + res.Message)
+	}
+
+	// staked tokens can't be spent
+	staked := stakedBalance(stub, "alice")
+	if b, _ := balance(stub, "alice"); b.Value != 200 || staked.Value != 100 || len(staked.Stakes) != 1 {
+		t.Errorf("Expected alice to stake 100, got %d spendable and %+v", b.Value, staked)
+	}
+	if staked.Stakes[0].ID != "stake-alice" || staked.Stakes[0].Maturity != stakingStart.Add(time.Hour).Format(time.RFC3339) {
+		t.Errorf("Unexpected stake %+v", staked.Stakes[0])
+	}
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 201}`)); res.Status == shim.OK {
+		t.Error("Expected staked tokens not to be transferred")
+	}
+
+	// alice earns the 50 rewards of 5 seconds alone, then shares 50 with bob
+	stub.MockTimeAdvance(5 * time.Second)
+	stakeTokens(stub, bob, "stake-bob", `{"amount": 100}`)
+	stub.MockTimeAdvance(5 * time.Second)
+	if alice, bob := stakedBalance(stub, "alice"), stakedBalance(stub, "bob"); alice.Rewards != 75 || bob.Rewards != 25 {
+		t.Errorf("Expected rewards of 75 and 25, got %d and %d", alice.Rewards, bob.Rewards)
+	}
+}
+
+func TestUnstake(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+	stakeTokens(stub, alice, "stake-alice", `{"amount": 100, "lockPeriod": 3600}`)
+	stakeTokens(stub, bob, "stake-bob", `{"amount": 100, "lockPeriod": 10}`)
+	stub.MockTimeAdvance(5 * time.Second)
+
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("unstake", `{"id": "stake-bob"}`)); res.Status == shim.OK {
+		t.Error("Expected the stake to be locked")
+	}
+	stub.MockTimeAdvance(5 * time.Second)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("unstake", `{"id": "stake-bob"}`)); res.Status != shim.OK {
+		t.Fatal("Unstake failed: " + res.Message)
+	}
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("unstake", `{"id": "stake-alice"}`)); res.Status == shim.OK {
+		t.Error("Expected bob not to unstake alice's tokens")
+	}
+	staked := stakedBalance(stub, "bob")
+	if b, _ := balance(stub, "bob"); b.Value != 100 || staked.Value != 0 || len(staked.Stakes) != 0 || staked.Rewards != 50 {
+		t.Errorf("Expected bob to get his tokens back and keep his rewards, got %d and %+v", b.Value, staked)
+	}
+
+	// alice earns alone once bob unstaked
+	stub.MockTimeAdvance(2 * time.Second)
+	if staked := stakedBalance(stub, "alice"); staked.Rewards != 70 {
+		t.Errorf("Expected alice to earn 70, got %d", staked.Rewards)
+	}
+}
+
+func TestStakeRestrictions(t *testing.T) {
+	// staking spends from the velocity limits of alice
+	stub := velocityLedger(t)
+	alice := recoveryActors["alice"]
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectRestricted(t, stub, "stake", `{"amount": 60}`, RestrictionTransferLimit)
+	for _, txID := range []string{"stake-1", "stake-2"} {
+		if res := stakeTokens(stub, alice, txID, `{"amount": 50}`); res.Status != shim.OK {
+			t.Fatal("Stake failed: " + res.Message)
+		}
+	}
+	expectRestricted(t, stub, "stake", `{"amount": 10}`, RestrictionDailyLimit)
+
+	// unstaking is checked like a mint to the holder
+	stub = restrictedLedger(t, `{"maxBalance": 100}`)
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 100}`))
+	stakeTokens(stub, alice, "stake-3", `{"amount": 50}`)
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("2", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 50}`))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	expectRestricted(t, stub, "unstake", `{"id": "stake-3"}`, RestrictionMaxBalance)
+}
+
+func TestClaimRewards(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+	stakeTokens(stub, alice, "stake-alice", `{"amount": 100}`)
+	stub.MockTimeAdvance(5 * time.Second)
+
+	stub.MockCreator(bob.MspID, bob.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("claimRewards")); res.Status == shim.OK {
+		t.Error("Expected bob to have no rewards")
+	}
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("claimRewards")); res.Status != shim.OK {
+		t.Fatal("ClaimRewards failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice"); b.Value != 250 {
+		t.Errorf("Expected alice to receive 50, got %d", b.Value-200)
+	}
+
+	// rewards stop when the pool is empty
+	stub.MockTimeAdvance(time.Hour)
+	stub.MockInvoke("3", util.ToChaincodeArgs("claimRewards"))
+	if b, _ := balance(stub, "alice"); b.Value != 400 {
+		t.Errorf("Expected alice to receive the 150 left, got %d", b.Value-250)
+	}
+	staking := Staking{}
+	json.Unmarshal(stub.MockInvoke("4", util.ToChaincodeArgs("staking")).Payload, &staking)
+	if staking.Pool != 0 || staking.Rewards != 0 {
+		t.Errorf("Expected the pool to be paid out, got %+v", staking)
+	}
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("claimRewards")); res.Status == shim.OK {
+		t.Error("Expected no rewards left")
+	}
+}
+
+func TestClaimRoundedRewards(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, admin := recoveryActors["alice"], roleActors["admin"]
+	stakeTokens(stub, alice, "stake-alice", `{"amount": 7}`)
+
+	// 60 per accrual, shared by 7 staked tokens
+	stub.MockTimeAdvance(6 * time.Second)
+	stub.MockCreator(admin.MspID, admin.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setStakingRewards", `{"rate": 10}`)); res.Status != shim.OK {
+		t.Fatal("SetStakingRewards failed: " + res.Message)
+	}
+	stub.MockTimeAdvance(6 * time.Second)
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("claimRewards")); res.Status != shim.OK {
+		t.Fatal("ClaimRewards failed: " + res.Message)
+	}
+
+	staking := Staking{}
+	json.Unmarshal(stub.MockInvoke("3", util.ToChaincodeArgs("staking")).Payload, &staking)
+	b, _ := balance(stub, "alice")
+	if paid := b.Value - 293; paid != 119 || staking.Rewards != 1 || staking.Pool != 80 {
+		t.Errorf("Expected 119 of the 120 allocated to be paid, got %d with %+v", paid, staking)
+	}
+}
+
+func TestStakeInBlock(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, bob := recoveryActors["alice"], recoveryActors["bob"]
+
+	// stakes update the total staked, so only one of a block is valid
+	stake := func(txID string, holder *testca.Identity) mock.Proposal {
+		return mock.Proposal{TxID: txID, MspID: holder.MspID, Cert: holder.CertPEM, Args: util.ToChaincodeArgs("stake", `{"amount": 10}`)}
+	}
+	results := stub.MockBlock([]mock.Proposal{stake("tx1", alice), stake("tx2", bob)})
+	expectValidation(t, results, pb.TxValidationCode_VALID, pb.TxValidationCode_MVCC_READ_CONFLICT)
+	if staked := stakedBalance(stub, "bob"); staked.Value != 0 {
+		t.Errorf("Expected bob's stake to be invalid, got %d", staked.Value)
+	}
+}
+
+func TestMigrateStakes(t *testing.T) {
+	stub := stakingLedger(t)
+	alice, alice2 := recoveryActors["alice"], recoveryActors["alice2"]
+	stakeTokens(stub, alice, "stake-alice", `{"amount": 100, "lockPeriod": 3600}`)
+	stub.MockTimeAdvance(5 * time.Second)
+	stub.MockInvoke("1", util.ToChaincodeArgs("approveRecovery", `{"from": "alice", "to": "alice2"}`))
+
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("2", util.ToChaincodeArgs("migrateAccount", `{"from": "alice"}`)); res.Status != shim.OK {
+		t.Fatal("MigrateAccount failed: " + res.Message)
+	}
+	staked := stakedBalance(stub, "alice2")
+	if staked.Value != 100 || staked.Rewards != 50 || len(staked.Stakes) != 1 || staked.Stakes[0].User != "alice2" {
+		t.Errorf("Expected the stake and rewards to move, got %+v", staked)
+	}
+	if staked := stakedBalance(stub, "alice"); staked.Value != 0 || len(staked.Stakes) != 0 {
+		t.Errorf("Expected the old account to keep no stakes, got %+v", staked)
+	}
+
+	stub.MockTimeAdvance(time.Hour)
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("unstake", `{"id": "stake-alice"}`)); res.Status == shim.OK {
+		t.Error("Expected the old account not to unstake")
+	}
+	stub.MockCreator(alice2.MspID, alice2.CertPEM)
+	if res := stub.MockInvoke("4", util.ToChaincodeArgs("unstake", `{"id": "stake-alice"}`)); res.Status != shim.OK {
+		t.Fatal("Unstake failed: " + res.Message)
+	}
+	if b, _ := balance(stub, "alice2"); b.Value != 300 {
+		t.Errorf("Expected alice2 to get the staked tokens back, got %d", b.Value)
+	}
+}
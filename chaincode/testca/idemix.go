@@ -0,0 +1,65 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testca
+
+import (
+	"crypto/rand"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// Mock Idemix identity: a random pseudonym revealing its organizational unit
+// and role, with no proof, as serialized in the creator of a transaction.
+type IdemixIdentity struct {
+	MspID   string
+	OU      string
+	NymX    []byte
+	NymY    []byte
+	IdBytes []byte
+}
+
+// creates an Idemix identity of the given MSP and organizational unit
+func NewIdemix(mspID, ou string) (*IdemixIdentity, error) {
+	nym := make([]byte, 64)
+	if _, err := rand.Read(nym); err != nil {
+		return nil, err
+	}
+	ouBytes, err := proto.Marshal(&msp.OrganizationUnit{MspIdentifier: mspID, OrganizationalUnitIdentifier: ou})
+	if err != nil {
+		return nil, err
+	}
+	roleBytes, err := proto.Marshal(&msp.MSPRole{MspIdentifier: mspID, Role: msp.MSPRole_MEMBER})
+	if err != nil {
+		return nil, err
+	}
+
+	id := &IdemixIdentity{MspID: mspID, OU: ou, NymX: nym[:32], NymY: nym[32:]}
+	id.IdBytes, err = proto.Marshal(&msp.SerializedIdemixIdentity{NymX: id.NymX, NymY: id.NymY, Ou: ouBytes, Role: roleBytes})
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// same as NewIdemix, panicking on errors
+func MustNewIdemix(mspID, ou string) *IdemixIdentity {
+	id, err := NewIdemix(mspID, ou)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
@@ -0,0 +1,193 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testca is an in-memory ECDSA certificate authority issuing caller
+// identities for tests, to be used with FullMockStub.MockCreator.
+package testca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// OID of the extension holding Fabric CA attributes
+var AttrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+type CA struct {
+	MspID   string
+	Cert    *x509.Certificate
+	CertPEM string
+
+	key    *ecdsa.PrivateKey
+	lock   sync.Mutex
+	serial int64
+}
+
+type Identity struct {
+	MspID   string
+	Cert    *x509.Certificate
+	CertPEM string
+	Key     *ecdsa.PrivateKey
+}
+
+// optional settings of an issued certificate, zero values use the defaults
+type Options struct {
+	// MSP ID of the identity, defaults to the MSP of the CA
+	MspID string
+	OUs   []string
+	// Fabric CA attributes, as read by the client identity library
+	Attrs map[string]string
+	// validity window, defaults to one hour ago until one year from now
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// creates a CA with a self-signed root certificate for the given MSP
+func New(mspID string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca." + mspID, Organization: []string{mspID}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          subjectKeyID(&key.PublicKey),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{
+		MspID:   mspID,
+		Cert:    cert,
+		CertPEM: toPEM(der),
+		key:     key,
+		serial:  1,
+	}, nil
+}
+
+// same as New, panicking on errors
+func MustNew(mspID string) *CA {
+	ca, err := New(mspID)
+	if err != nil {
+		panic(err)
+	}
+	return ca
+}
+
+// issues a certificate for the given CN, signed by the CA
+func (ca *CA) Issue(cn string, opts Options) (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.nextSerial()),
+		Subject:               pkix.Name{CommonName: cn, OrganizationalUnit: opts.OUs},
+		NotBefore:             opts.NotBefore,
+		NotAfter:              opts.NotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          subjectKeyID(&key.PublicKey),
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = now.Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = now.Add(365 * 24 * time.Hour)
+	}
+
+	if opts.Attrs != nil {
+		// same encoding as Fabric CA: {"attrs":{"name":"value"}}
+		value, err := json.Marshal(map[string]map[string]string{"attrs": opts.Attrs})
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: AttrOID, Value: value}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	mspID := opts.MspID
+	if mspID == "" {
+		mspID = ca.MspID
+	}
+
+	return &Identity{
+		MspID:   mspID,
+		Cert:    cert,
+		CertPEM: toPEM(der),
+		Key:     key,
+	}, nil
+}
+
+// same as Issue, panicking on errors
+func (ca *CA) MustIssue(cn string, opts Options) *Identity {
+	id, err := ca.Issue(cn, opts)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (ca *CA) nextSerial() int64 {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	ca.serial++
+	return ca.serial
+}
+
+func toPEM(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// SHA-1 of the public key, as in RFC 5280 section 4.2.1.2
+func subjectKeyID(pub *ecdsa.PublicKey) []byte {
+	hash := sha1.Sum(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	return hash[:]
+}
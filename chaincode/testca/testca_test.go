@@ -0,0 +1,89 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	ca := MustNew("Org1MSP")
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	id, err := ca.Issue("alice", Options{
+		OUs:      []string{"client", "department1"},
+		Attrs:    map[string]string{"hf.Type": "client", "role": "minter"},
+		NotAfter: notAfter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode([]byte(id.CertPEM))
+	if block == nil {
+		t.Fatal("Expected a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Subject.CommonName != "alice" || len(cert.Subject.OrganizationalUnit) != 2 {
+		t.Errorf("Unexpected subject: %v", cert.Subject)
+	}
+	if !cert.NotAfter.Equal(notAfter) {
+		t.Errorf("Expected certificate to expire at %v, got %v", notAfter, cert.NotAfter)
+	}
+	if id.MspID != "Org1MSP" {
+		t.Errorf("Expected identity in the MSP of the CA, got %s", id.MspID)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		t.Errorf("Certificate not issued by the CA: %s", err)
+	}
+
+	var attrs struct {
+		Attrs map[string]string `json:"attrs"`
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(AttrOID) {
+			json.Unmarshal(ext.Value, &attrs)
+		}
+	}
+	if attrs.Attrs["role"] != "minter" || attrs.Attrs["hf.Type"] != "client" {
+		t.Errorf("Unexpected attributes: %v", attrs.Attrs)
+	}
+}
+
+func TestIssueOtherMSP(t *testing.T) {
+	ca := MustNew("Org1MSP")
+	id := ca.MustIssue("bob", Options{MspID: "Org2MSP"})
+	other := ca.MustIssue("carol", Options{})
+
+	if id.MspID != "Org2MSP" {
+		t.Errorf("Expected MSP to be overridden, got %s", id.MspID)
+	}
+	if id.Cert.SerialNumber.Cmp(other.Cert.SerialNumber) == 0 {
+		t.Error("Expected distinct serial numbers")
+	}
+}
@@ -16,6 +16,10 @@ limitations under the License.
 
 package testdata
 
+import "time"
+
+// the three certificates are valid from March 2017 to January 2018
+var ValidAt = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
 
 const TestUser1CN = "testUser"
 const TestUser2CN = "testUser2"
@@ -18,7 +18,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -30,6 +29,16 @@ const KeyToken = "__token"
 const IndexBalance = "cn~balance"
 const IndexAllowance = "cn~allowance"
 
+func tokenData(stub shim.ChaincodeStubInterface) (Token, error) {
+	token := Token{}
+	tokenBytes, err := stub.GetState(KeyToken)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(tokenBytes, &token)
+	return token, err
+}
+
 func (t *TokenChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
@@ -37,22 +46,53 @@ func (t *TokenChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error("Expeted 'init' function.")
 	}
 
+	// an upgrade keeps the existing token data and balances
+	tokenBytes, err := stub.GetState(KeyToken)
+	if err != nil {
+		return shim.Error("Error getting token data")
+	}
+	if tokenBytes != nil {
+		return t.upgrade(stub, args)
+	}
+
 	if len(args) != 1 {
 		return shim.Error("Expectd 1 argument")
 	}
 
+	// the issuer has to be known
+	err = requireX509(stub)
+	if err != nil {
+		return shim.Error("Init requires an X.509 identity")
+	}
+
 	// get token data from JSON
 	token := Token{}
-	err := json.Unmarshal([]byte(args[0]), &token)
+	err = json.Unmarshal([]byte(args[0]), &token)
 	if err != nil {
 		return shim.Error("Error parsing token json")
 	}
+	if !validIdemixAccounts(token.IdemixAccounts) {
+		return shim.Error("Invalid Idemix accounts: " + token.IdemixAccounts)
+	}
+	if err := validateRoles(token.Roles); err != nil {
+		return shim.Error(err.Error())
+	}
+	if token.AuditorKey != "" {
+		if _, err := parseViewingKey(token.AuditorKey); err != nil {
+			return shim.Error("Invalid auditor key: " + err.Error())
+		}
+	}
 
 	err = stub.PutState(KeyToken, []byte(args[0]))
 	if err != nil {
 		return shim.Error("Error saving token data")
 	}
 
+	err = setSchemaVersion(stub, currentSchemaVersion())
+	if err != nil {
+		return shim.Error("Error setting schema version")
+	}
+
 	// get caller CN from his certificate
 	caller, err := CallerCN(stub)
 	if err != nil {
@@ -71,6 +111,15 @@ func (t *TokenChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 func (t *TokenChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
+	if err := checkCertificate(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if x509Functions[function] {
+		if err := requireX509(stub); err != nil {
+			return shim.Error(function + " requires an X.509 identity")
+		}
+	}
+
 	// call routing
 	switch function {
 	case "info":
@@ -86,6 +135,114 @@ func (t *TokenChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.allowancesAsJson(stub, args)
 	case "transferFrom":
 		return t.transferFrom(stub, args)
+	case "mint":
+		return t.mint(stub, args)
+	case "burn":
+		return t.burn(stub, args)
+	case "roles":
+		return t.rolesAsJson(stub, args)
+	case "setRoles":
+		return t.setRoles(stub, args)
+	case "revoke":
+		return t.revoke(stub, args)
+	case "unrevoke":
+		return t.unrevoke(stub, args)
+	case "revocations":
+		return t.revocationsAsJson(stub, args)
+	case "setGuardians":
+		return t.setGuardians(stub, args)
+	case "guardians":
+		return t.guardiansAsJson(stub, args)
+	case "approveRecovery":
+		return t.approveRecovery(stub, args)
+	case "migrateAccount":
+		return t.migrateAccount(stub, args)
+	case "migrations":
+		return t.migrationsAsJson(stub, args)
+	case "setKYC":
+		return t.setKYC(stub, args)
+	case "removeKYC":
+		return t.removeKYC(stub, args)
+	case "kycStatus":
+		return t.kycStatusAsJson(stub, args)
+	case "setTransferRules":
+		return t.setTransferRules(stub, args)
+	case "transferRules":
+		return t.transferRulesAsJson(stub, args)
+	case "setLockUp":
+		return t.setLockUp(stub, args)
+	case "detectTransferRestriction":
+		return t.detectTransferRestriction(stub, args)
+	case "messageForRestriction":
+		return t.messageForRestriction(stub, args)
+	case "setLimits":
+		return t.setLimits(stub, args)
+	case "limits":
+		return t.limitsAsJson(stub, args)
+	case "importSanctions":
+		return t.importSanctions(stub, args)
+	case "removeSanctions":
+		return t.removeSanctions(stub, args)
+	case "checkSanction":
+		return t.checkSanctionAsJson(stub, args)
+	case "sanctionsImport":
+		return t.sanctionsImportAsJson(stub, args)
+	case "setFees":
+		return t.setFees(stub, args)
+	case "collectFees":
+		return t.collectFees(stub, args)
+	case "fees":
+		return t.feesAsJson(stub, args)
+	case "snapshot":
+		return t.snapshot(stub, args)
+	case "balanceOfAt":
+		return t.balanceOfAtAsJson(stub, args)
+	case "totalSupplyAt":
+		return t.totalSupplyAtAsJson(stub, args)
+	case "createDistribution":
+		return t.createDistribution(stub, args)
+	case "distributions":
+		return t.distributionsAsJson(stub, args)
+	case "claim":
+		return t.claim(stub, args)
+	case "claimable":
+		return t.claimableAsJson(stub, args)
+	case "setStakingRewards":
+		return t.setStakingRewards(stub, args)
+	case "staking":
+		return t.stakingAsJson(stub, args)
+	case "stake":
+		return t.stake(stub, args)
+	case "unstake":
+		return t.unstake(stub, args)
+	case "claimRewards":
+		return t.claimRewards(stub, args)
+	case "stakedBalance":
+		return t.stakedBalanceAsJson(stub, args)
+	case "setEndorsers":
+		return t.setEndorsers(stub, args)
+	case "endorsers":
+		return t.endorsersAsJson(stub, args)
+	case "privateDeposit":
+		return t.privateDeposit(stub, args)
+	case "privateWithdraw":
+		return t.privateWithdraw(stub, args)
+	case "privateTransfer":
+		return t.privateTransfer(stub, args)
+	case "privateMigrate":
+		return t.privateMigrate(stub, args)
+	case "privateBalance":
+		return t.privateBalanceAsJson(stub, args)
+	case "confidentialDeposit":
+		return t.confidentialDeposit(stub, args)
+	case "confidentialTransfer":
+		return t.confidentialTransfer(stub, args)
+	case "confidentialWithdraw":
+		return t.confidentialWithdraw(stub, args)
+	case "confidentialBalance":
+		return t.confidentialBalanceAsJson(stub, args)
+	case "confidentialTransfers":
+		return t.confidentialTransfersAsJson(stub, args)
 	}
 
 	return shim.Error("Incorrect function name: " + function)
@@ -112,9 +269,28 @@ func (t *TokenChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 	if from == transfer.To {
 		return shim.Success(nil)
 	}
+	if err := checkNotMigrated(stub, from, transfer.To); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "transfer", Transfer{From: from, To: transfer.To, Value: transfer.Value}); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, Transfer{From: from, To: transfer.To, Value: transfer.Value}); res != nil {
+		return *res
+	}
+
+	// the receiver gets the value net of the fee
+	transfer.From = from
+	event, err := transferFee(stub, transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// get the balances from state
 	fromBalance, err := t.balance(stub, from)
+	if err != nil {
+		return shim.Error("Error getting to or from balance")
+	}
 	toBalance, err := t.balance(stub, transfer.To)
 	if err != nil {
 		return shim.Error("Error getting to or from balance")
@@ -126,20 +302,26 @@ func (t *TokenChaincode) transfer(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	//if (balanceOf[_to] + _value < balanceOf[_to]) throw;
-	if toBalance+transfer.Value < toBalance {
+	if toBalance+event.Net < toBalance {
 		return shim.Error("Receiver balance overflow")
 	}
 
 	// balanceOf[msg.sender] -= _value;
-	err = t.setBalance(stub, from, fromBalance-transfer.Value)
 	// balanceOf[_to] += _value;
-	err = t.setBalance(stub, transfer.To, toBalance+transfer.Value)
+	err = t.setBalances(stub, Balance{User: from, Value: fromBalance - transfer.Value}, Balance{User: transfer.To, Value: toBalance + event.Net})
 	if err != nil {
 		return shim.Error("Error setting to or from balance")
 	}
+	err = recordFee(stub, event)
+	if err != nil {
+		return shim.Error("Error recording fee")
+	}
+	err = recordSpending(stub, from, transfer.Value)
+	if err != nil {
+		return shim.Error("Error recording spending")
+	}
 
-	transfer.From = from
-	evtData, _ := json.Marshal(transfer)
+	evtData, _ := json.Marshal(event)
 	//Transfer(msg.sender, _to, _value);
 	stub.SetEvent("Transfer", evtData)
 
@@ -162,9 +344,15 @@ func (t *TokenChaincode) approve(stub shim.ChaincodeStubInterface, args []string
 	if err != nil {
 		return shim.Error("Error getting from data")
 	}
+	if err := checkNotMigrated(stub, from); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//allowance[msg.sender][_spender] = _value;
-	t.setAllowance(stub, from, approve.Spender, approve.Value)
+	err = t.setAllowance(stub, from, approve.Spender, approve.Value)
+	if err != nil {
+		return shim.Error("Error setting allowance")
+	}
 	stub.SetEvent("Approve", []byte(args[0]))
 
 	return shim.Success(nil)
@@ -189,10 +377,30 @@ func (t *TokenChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []s
 	if transfer.From == transfer.To {
 		return shim.Success(nil)
 	}
+	if err := checkNotMigrated(stub, transfer.From, transfer.To); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "transferFrom", transfer); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, transfer); res != nil {
+		return *res
+	}
+
+	event, err := transferFee(stub, transfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// retrieving balances and allowances
 	fromBalance, err := t.balance(stub, transfer.From)
+	if err != nil {
+		return shim.Error("Error getting to or from balance or allowance")
+	}
 	toBalance, err := t.balance(stub, transfer.To)
+	if err != nil {
+		return shim.Error("Error getting to or from balance or allowance")
+	}
 	allowance, err := t.allowance(stub, transfer.From, spender)
 	if err != nil {
 		return shim.Error("Error getting to or from balance or allowance")
@@ -204,7 +412,7 @@ func (t *TokenChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []s
 	}
 
 	//if (balanceOf[_to] + _value < balanceOf[_to]) throw;
-	if toBalance+transfer.Value < toBalance {
+	if toBalance+event.Net < toBalance {
 		return shim.Error("Receiver balance overflow")
 	}
 
@@ -216,22 +424,159 @@ func (t *TokenChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []s
 	//balanceOf[_from] -= _value;
 	//balanceOf[_to] += _value;
 	//allowance[_from][msg.sender] -= _value;
-	err = t.setBalance(stub, transfer.From, fromBalance-transfer.Value)
-	err = t.setBalance(stub, transfer.To, toBalance+transfer.Value)
-	err = t.setAllowance(stub, transfer.From, spender, allowance-transfer.Value)
+	err = t.setBalances(stub, Balance{User: transfer.From, Value: fromBalance - transfer.Value}, Balance{User: transfer.To, Value: toBalance + event.Net})
+	if err == nil {
+		err = t.setAllowance(stub, transfer.From, spender, allowance-transfer.Value)
+	}
+	if err == nil {
+		err = recordFee(stub, event)
+	}
+	if err == nil {
+		err = recordSpending(stub, transfer.From, transfer.Value)
+	}
 	if err != nil {
 		return shim.Error("Error setting to or from balance or allowance")
 	}
 
 	//Transfer(_from, _to, _value);
-	stub.SetEvent("Transfer", []byte(args[0]))
+	evtData, _ := json.Marshal(event)
+	stub.SetEvent("Transfer", evtData)
+
+	return shim.Success(nil)
+}
+
+// creates tokens for the given account, callers need the minter role
+func (t *TokenChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Mint expected 1 argument")
+	}
+
+	transfer := Transfer{}
+	err := json.Unmarshal([]byte(args[0]), &transfer)
+	if err != nil {
+		return shim.Error("Error parsing transfer json")
+	}
+	if transfer.To == "" {
+		return shim.Error("Expected the receiver")
+	}
+
+	err = requireRole(stub, RoleMinter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := checkNotMigrated(stub, transfer.To); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "mint", Transfer{To: transfer.To, Value: transfer.Value}); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, Transfer{To: transfer.To, Value: transfer.Value}); res != nil {
+		return *res
+	}
+
+	token, err := tokenData(stub)
+	if err != nil {
+		return shim.Error("Error getting token data")
+	}
+	toBalance, err := t.balance(stub, transfer.To)
+	if err != nil {
+		return shim.Error("Error getting to balance")
+	}
+
+	if token.TotalSupply+transfer.Value < token.TotalSupply {
+		return shim.Error("Total supply overflow")
+	}
+	if toBalance+transfer.Value < toBalance {
+		return shim.Error("Receiver balance overflow")
+	}
+
+	err = updateSnapshot(stub, IndexSnapshotSupply, []string{}, token.TotalSupply)
+	if err != nil {
+		return shim.Error("Error recording total supply snapshot")
+	}
+	token.TotalSupply += transfer.Value
+	tokenBytes, _ := json.Marshal(token)
+	err = stub.PutState(KeyToken, tokenBytes)
+	if err != nil {
+		return shim.Error("Error saving token data")
+	}
+	err = t.setBalance(stub, transfer.To, toBalance+transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting to balance")
+	}
+
+	// minted tokens are a transfer from nobody
+	transfer.From = ""
+	evtData, _ := json.Marshal(transfer)
+	stub.SetEvent("Transfer", evtData)
 
 	return shim.Success(nil)
 }
 
-func main() {
-	err := shim.Start(&TokenChaincode{})
+// destroys tokens of the caller
+func (t *TokenChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Burn expected 1 argument")
+	}
+
+	transfer := Transfer{}
+	err := json.Unmarshal([]byte(args[0]), &transfer)
+	if err != nil {
+		return shim.Error("Error parsing transfer json")
+	}
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error getting caller cn")
+	}
+	if transfer.From != "" && transfer.From != caller {
+		return shim.Error("Only the holder can burn its tokens")
+	}
+
+	// burned tokens are a transfer to nobody
+	transfer = Transfer{From: caller, Value: transfer.Value}
+	if err := checkNotMigrated(stub, caller); err != nil {
+		return shim.Error(err.Error())
+	}
+	if res := checkSanctions(stub, "burn", transfer); res != nil {
+		return *res
+	}
+	if res := t.checkRestrictions(stub, transfer); res != nil {
+		return *res
+	}
+
+	token, err := tokenData(stub)
+	if err != nil {
+		return shim.Error("Error getting token data")
+	}
+	fromBalance, err := t.balance(stub, caller)
 	if err != nil {
-		fmt.Errorf("Error starting Token chaincode: %s", err)
+		return shim.Error("Error getting from balance")
 	}
+	if fromBalance < transfer.Value {
+		return shim.Error("Not enough balance")
+	}
+
+	err = updateSnapshot(stub, IndexSnapshotSupply, []string{}, token.TotalSupply)
+	if err != nil {
+		return shim.Error("Error recording total supply snapshot")
+	}
+	token.TotalSupply -= transfer.Value
+	tokenBytes, _ := json.Marshal(token)
+	err = stub.PutState(KeyToken, tokenBytes)
+	if err != nil {
+		return shim.Error("Error saving token data")
+	}
+	err = t.setBalance(stub, caller, fromBalance-transfer.Value)
+	if err != nil {
+		return shim.Error("Error setting from balance")
+	}
+	err = recordSpending(stub, caller, transfer.Value)
+	if err != nil {
+		return shim.Error("Error recording spending")
+	}
+
+	evtData, _ := json.Marshal(transfer)
+	stub.SetEvent("Transfer", evtData)
+
+	return shim.Success(nil)
 }
@@ -38,6 +38,7 @@ func initToken(t *testing.T) *mock.FullMockStub {
 	token := &TokenChaincode{}
 
 	stub := mock.NewFullMockStub("token", token)
+	stub.MockTime(testdata.ValidAt)
 	stub.MockCreator("default", testdata.TestUser1Cert)
 
 	tokenBytes, _ := json.Marshal(fabricToken)
@@ -51,7 +52,7 @@ func initToken(t *testing.T) *mock.FullMockStub {
 	for key, val := range stub.State {
 		if key == KeyToken {
 			tokenDataBytes = val
-		} else {
+		} else if key != KeySchemaVersion {
 			callerBalanceBytes = val
 		}
 	}
@@ -0,0 +1,327 @@
+//go:build tokenctl
+// +build tokenctl
+
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tokenctl drives the token chaincode against a simulated ledger kept on disk,
+// so flows can be tried out without a Fabric network.
+// Build it with: go build -tags tokenctl -o tokenctl
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/token/chaincode/mock"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `Usage: tokenctl [flags] <command> [arguments]
+
+Commands:
+  init <name> <symbol> <decimals> <totalSupply>
+  transfer <to> <value>
+  approve <spender> <value>
+  transfer-from <from> <to> <value>
+  mint <to> <value>
+  burn <value>
+  roles
+  balance [user]
+  allowances [user]
+  info
+  collections <mspId>...   prints the collections config of every pair of MSPs
+
+Only the public state is kept in the ledger file between runs, the private
+data collections and the history of the keys are lost after each command.
+
+Flags:
+`
+
+// simulated ledger persisted between tokenctl runs, without private data and key history
+type ledger struct {
+	TxCount uint64            `json:"txCount"`
+	MspID   string            `json:"mspId"`
+	Cert    string            `json:"cert"`
+	State   map[string][]byte `json:"state"`
+}
+
+func loadLedger(path string) (*ledger, error) {
+	l := &ledger{MspID: "default", State: map[string][]byte{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, errors.New("Failed to parse ledger file: " + err.Error())
+	}
+	if l.State == nil {
+		l.State = map[string][]byte{}
+	}
+	return l, nil
+}
+
+func (l *ledger) save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// builds a mock stub holding the ledger state, acting as the current identity
+func (l *ledger) stub() *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+
+	stub.MockTransactionStart("load")
+	for key, value := range l.State {
+		stub.PutState(key, value)
+	}
+	stub.MockTransactionEnd("load")
+
+	stub.MockCreator(l.MspID, l.Cert)
+	return stub
+}
+
+func parseValue(value string) (uint64, error) {
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid value: " + value)
+	}
+	return v, nil
+}
+
+// maps a tokenctl command to the chaincode function and its JSON argument
+func chaincodeCall(l *ledger, command string, args []string) (string, interface{}, error) {
+	expectArgs := func(min, max int) error {
+		if len(args) < min || len(args) > max {
+			return fmt.Errorf("Wrong number of arguments for %s, see tokenctl -h", command)
+		}
+		return nil
+	}
+
+	// balance and allowances default to the caller
+	userOrCaller := func() (string, error) {
+		if len(args) == 1 {
+			return args[0], nil
+		}
+		return CNFromX509(l.Cert)
+	}
+
+	switch command {
+	case "init":
+		if err := expectArgs(4, 4); err != nil {
+			return "", nil, err
+		}
+		decimals, err := strconv.ParseUint(args[2], 10, 16)
+		if err != nil {
+			return "", nil, errors.New("Invalid decimals: " + args[2])
+		}
+		supply, err := parseValue(args[3])
+		if err != nil {
+			return "", nil, err
+		}
+		return "init", Token{Name: args[0], Symbol: args[1], Decimals: uint16(decimals), TotalSupply: supply}, nil
+	case "transfer":
+		if err := expectArgs(2, 2); err != nil {
+			return "", nil, err
+		}
+		value, err := parseValue(args[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "transfer", Transfer{To: args[0], Value: value}, nil
+	case "approve":
+		if err := expectArgs(2, 2); err != nil {
+			return "", nil, err
+		}
+		value, err := parseValue(args[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "approve", Approve{Spender: args[0], Value: value}, nil
+	case "mint":
+		if err := expectArgs(2, 2); err != nil {
+			return "", nil, err
+		}
+		value, err := parseValue(args[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "mint", Transfer{To: args[0], Value: value}, nil
+	case "burn":
+		if err := expectArgs(1, 1); err != nil {
+			return "", nil, err
+		}
+		value, err := parseValue(args[0])
+		if err != nil {
+			return "", nil, err
+		}
+		return "burn", Transfer{Value: value}, nil
+	case "transfer-from":
+		if err := expectArgs(3, 3); err != nil {
+			return "", nil, err
+		}
+		value, err := parseValue(args[2])
+		if err != nil {
+			return "", nil, err
+		}
+		return "transferFrom", Transfer{From: args[0], To: args[1], Value: value}, nil
+	case "balance", "allowances":
+		if err := expectArgs(0, 1); err != nil {
+			return "", nil, err
+		}
+		user, err := userOrCaller()
+		if err != nil {
+			return "", nil, err
+		}
+		return command, Balance{User: user}, nil
+	case "info", "roles":
+		if err := expectArgs(0, 0); err != nil {
+			return "", nil, err
+		}
+		return command, nil, nil
+	}
+
+	return "", nil, errors.New("Unknown command: " + command)
+}
+
+func printJSON(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println(out.String())
+}
+
+func run(ledgerPath, mspID, certPath, txTime, command string, args []string) error {
+	l, err := loadLedger(ledgerPath)
+	if err != nil {
+		return err
+	}
+
+	// switching identity: the loaded certificate is kept for the next runs
+	if certPath != "" {
+		cert, err := ioutil.ReadFile(certPath)
+		if err != nil {
+			return err
+		}
+		if _, err := CNFromX509(string(cert)); err != nil {
+			return err
+		}
+		l.Cert = string(cert)
+	}
+	if mspID != "" {
+		l.MspID = mspID
+	}
+	if l.Cert == "" {
+		return errors.New("No caller identity, load a PEM certificate with -cert")
+	}
+
+	function, arg, err := chaincodeCall(l, command, args)
+	if err != nil {
+		return err
+	}
+
+	ccArgs := [][]byte{[]byte(function)}
+	if arg != nil {
+		argBytes, _ := json.Marshal(arg)
+		ccArgs = append(ccArgs, argBytes)
+	}
+
+	stub := l.stub()
+	if txTime != "" {
+		t, err := time.Parse(time.RFC3339, txTime)
+		if err != nil {
+			return errors.New("Invalid time: " + txTime)
+		}
+		stub.MockTime(t)
+	}
+	l.TxCount++
+	txID := strconv.FormatUint(l.TxCount, 10)
+
+	var res pb.Response
+	if function == "init" {
+		res = stub.MockInit(txID, ccArgs)
+	} else {
+		res = stub.MockInvoke(txID, ccArgs)
+	}
+
+	// as on a real peer, the state of a failed transaction is not committed
+	if res.Status < shim.ERRORTHRESHOLD {
+		l.State = stub.State
+		for _, evt := range stub.Events {
+			fmt.Printf("Event %s: %s\n", evt.EventName, evt.Payload)
+		}
+		printJSON(res.Payload)
+	}
+
+	if err := l.save(ledgerPath); err != nil {
+		return err
+	}
+
+	if res.Status == StatusSanctioned {
+		return fmt.Errorf("Call committed with status %d without effect: %s", res.Status, res.Message)
+	}
+	if res.Status != shim.OK {
+		return errors.New(res.Message)
+	}
+	return nil
+}
+
+func main() {
+	ledgerPath := flag.String("ledger", "tokenctl.json", "file holding the simulated ledger")
+	mspID := flag.String("msp", "", "MSP ID of the caller, kept for the next runs")
+	certPath := flag.String("cert", "", "PEM certificate of the caller, kept for the next runs")
+	txTime := flag.String("time", "", "RFC 3339 timestamp of the transaction, defaults to now")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// the collections config does not depend on the ledger
+	if flag.Arg(0) == "collections" {
+		configBytes, _ := json.Marshal(BilateralCollections(flag.Args()[1:]))
+		printJSON(configBytes)
+		return
+	}
+
+	if err := run(*ledgerPath, *mspID, *certPath, *txTime, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/msp"
+	"time"
 )
 
 func parsePEM(certPEM string) (*x509.Certificate, error) {
@@ -43,18 +44,80 @@ func CNFromX509(certPEM string) (string, error) {
 	return cert.Subject.CommonName, nil
 }
 
-// extracts CN from caller of a chaincode function
-func CallerCN(stub shim.ChaincodeStubInterface) (string, error) {
+func callerIdentity(stub shim.ChaincodeStubInterface) (msp.SerializedIdentity, error) {
 	data, _ := stub.GetCreator()
 	serializedId := msp.SerializedIdentity{}
 	err := proto.Unmarshal(data, &serializedId)
 	if err != nil {
-		return "", errors.New("Could not unmarshal Creator")
+		return serializedId, errors.New("Could not unmarshal Creator")
+	}
+	return serializedId, nil
+}
+
+// the timestamp of the transaction, the same on every endorsing peer
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Error getting transaction timestamp")
 	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
 
-	cn, err := CNFromX509(string(serializedId.IdBytes))
+// the certificate of an X.509 caller, valid at the transaction time
+// and not revoked on the ledger
+func callerCertificate(stub shim.ChaincodeStubInterface, serializedId msp.SerializedIdentity) (*x509.Certificate, error) {
+	cert, err := parsePEM(string(serializedId.IdBytes))
+	if err != nil {
+		return nil, errors.New("Failed to parse certificate: " + err.Error())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("Certificate is not valid at " + now.Format(time.RFC3339))
+	}
+
+	revoked, err := isRevoked(stub, serializedId.Mspid, cert)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("Certificate is revoked")
+	}
+	return cert, nil
+}
+
+// fails if the caller has an X.509 certificate which is expired or revoked
+func checkCertificate(stub shim.ChaincodeStubInterface) error {
+	serializedId, err := callerIdentity(stub)
+	if err != nil || !isX509(serializedId.IdBytes) {
+		return nil
+	}
+	_, err = callerCertificate(stub, serializedId)
+	return err
+}
+
+// extracts CN from caller of a chaincode function,
+// or the account of an Idemix caller, see idemix.go
+func CallerCN(stub shim.ChaincodeStubInterface) (string, error) {
+	serializedId, err := callerIdentity(stub)
 	if err != nil {
 		return "", err
 	}
+
+	if !isX509(serializedId.IdBytes) {
+		return idemixAccount(stub, serializedId)
+	}
+
+	cert, err := callerCertificate(stub, serializedId)
+	if err != nil {
+		return "", err
+	}
+	cn := cert.Subject.CommonName
+	if isIdemixAccount(cn) {
+		return "", errors.New("CN " + cn + " is reserved for Idemix accounts")
+	}
 	return cn, nil
 }
@@ -0,0 +1,287 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"time"
+)
+
+// Limits of what an account sends per transfer and over a rolling 24 hours
+// window, set by callers with the risk role for accounts and for tiers of
+// accounts. Every transfer of an account with a daily limit is kept under
+// its key until it leaves the window.
+
+const IndexLimits = "cn~limits"
+const IndexTierLimits = "tier~limits"
+const IndexSpending = "cn~time~tx~spent"
+
+// tier of the accounts without limits of their own
+const TierDefault = "default"
+
+const velocityWindow = 24 * time.Hour
+
+func getJson(stub shim.ChaincodeStubInterface, index string, attributes []string, value interface{}) (bool, error) {
+	key, err := stub.CreateCompositeKey(index, attributes)
+	if err != nil {
+		return false, err
+	}
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+// the limits applying to the account, the ones of its tier completing its own
+func velocityLimits(stub shim.ChaincodeStubInterface, cn string) (VelocityLimits, error) {
+	limits := VelocityLimits{User: cn}
+	if _, err := getJson(stub, IndexLimits, []string{cn}, &limits); err != nil {
+		return limits, err
+	}
+	if limits.Tier == "" {
+		limits.Tier = TierDefault
+	}
+
+	tier := VelocityLimits{}
+	if _, err := getJson(stub, IndexTierLimits, []string{limits.Tier}, &tier); err != nil {
+		return limits, err
+	}
+	if limits.PerTransfer == 0 {
+		limits.PerTransfer = tier.PerTransfer
+	}
+	if limits.Daily == 0 {
+		limits.Daily = tier.Daily
+	}
+	return limits, nil
+}
+
+// what the account sent in the window ending now, and the keys of the
+// transfers which left the window
+func spending(stub shim.ChaincodeStubInterface, cn string, now time.Time) (uint64, []string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexSpending, []string{cn})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer iterator.Close()
+
+	var spent uint64
+	expired := []string{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 3 {
+			return 0, nil, fmt.Errorf("Invalid spending key: %q", kv.Key)
+		}
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		if now.Sub(time.Unix(0, nanos)) >= velocityWindow {
+			expired = append(expired, kv.Key)
+			continue
+		}
+		if spent+binary.LittleEndian.Uint64(kv.Value) < spent {
+			spent = ^uint64(0)
+			continue
+		}
+		spent += binary.LittleEndian.Uint64(kv.Value)
+	}
+	return spent, expired, nil
+}
+
+type velocityRule struct {
+	now time.Time
+}
+
+func (rule velocityRule) Detect(stub shim.ChaincodeStubInterface, transfer Transfer) (uint8, error) {
+	if transfer.From == "" {
+		return RestrictionNone, nil
+	}
+	limits, err := velocityLimits(stub, transfer.From)
+	if err != nil {
+		return 0, err
+	}
+	if limits.PerTransfer > 0 && transfer.Value > limits.PerTransfer {
+		return RestrictionTransferLimit, nil
+	}
+	if limits.Daily == 0 {
+		return RestrictionNone, nil
+	}
+
+	spent, _, err := spending(stub, transfer.From, rule.now)
+	if err != nil {
+		return 0, err
+	}
+	if spent+transfer.Value < spent || spent+transfer.Value > limits.Daily {
+		return RestrictionDailyLimit, nil
+	}
+	return RestrictionNone, nil
+}
+
+// keeps the transfer in the window of a sender with a daily limit, dropping
+// the transfers which left it
+func recordSpending(stub shim.ChaincodeStubInterface, from string, value uint64) error {
+	limits, err := velocityLimits(stub, from)
+	if err != nil || limits.Daily == 0 || value == 0 {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	_, expired, err := spending(stub, from, now)
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := stub.DelState(key); err != nil {
+			return err
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(IndexSpending, []string{from, fmt.Sprintf("%020d", now.UnixNano()), stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return stub.PutState(key, data)
+}
+
+// moves the spending of the migrated account to the new one, whose window
+// goes on with it
+func moveSpending(stub shim.ChaincodeStubInterface, from, to string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexSpending, []string{from})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(parts) != 3 {
+			return fmt.Errorf("Invalid spending key: %q", kv.Key)
+		}
+		key, err := stub.CreateCompositeKey(IndexSpending, []string{to, parts[1], parts[2]})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, kv.Value); err != nil {
+			return err
+		}
+		if err := stub.DelState(kv.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sets the limits of an account, or of a tier without user; callers need the
+// risk role. Limits without tier nor amounts remove the ones of the account
+func (t *TokenChaincode) setLimits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("SetLimits expected 1 argument")
+	}
+	limits := VelocityLimits{}
+	err := json.Unmarshal([]byte(args[0]), &limits)
+	if err != nil {
+		return shim.Error("Error parsing limits json")
+	}
+	if limits.User == "" && limits.Tier == "" {
+		return shim.Error("Expected the user or the tier")
+	}
+	err = requireRole(stub, RoleRisk)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	index, attributes := IndexTierLimits, []string{limits.Tier}
+	if limits.User != "" {
+		index, attributes = IndexLimits, []string{limits.User}
+	}
+	key, err := stub.CreateCompositeKey(index, attributes)
+	if err != nil {
+		return shim.Error("Error creating limits key")
+	}
+	limitsBytes, _ := json.Marshal(limits)
+	if limits == (VelocityLimits{User: limits.User}) || limits == (VelocityLimits{Tier: limits.Tier}) {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, limitsBytes)
+	}
+	if err != nil {
+		return shim.Error("Error saving limits")
+	}
+
+	stub.SetEvent("LimitsUpdated", limitsBytes)
+	return shim.Success(nil)
+}
+
+// the limits of the user and what remains of them
+func (t *TokenChaincode) limitsAsJson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Expected user to query")
+	}
+	limitsRq := Balance{}
+	if err := json.Unmarshal([]byte(args[0]), &limitsRq); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	limits, err := velocityLimits(stub, limitsRq.User)
+	if err != nil {
+		return shim.Error("Error getting limits")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spent, _, err := spending(stub, limitsRq.User, now)
+	if err != nil {
+		return shim.Error("Error getting spending")
+	}
+
+	status := VelocityStatus{VelocityLimits: limits, Spent: spent}
+	if limits.Daily > 0 {
+		remaining := uint64(0)
+		if spent < limits.Daily {
+			remaining = limits.Daily - spent
+		}
+		status.RemainingDaily = &remaining
+	}
+	if limits.PerTransfer > 0 || status.RemainingDaily != nil {
+		max := limits.PerTransfer
+		if status.RemainingDaily != nil && (max == 0 || *status.RemainingDaily < max) {
+			max = *status.RemainingDaily
+		}
+		status.MaxTransfer = &max
+	}
+
+	result, _ := json.Marshal(status)
+	return shim.Success(result)
+}
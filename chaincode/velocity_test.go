@@ -0,0 +1,142 @@
+/*
+Copyright Vadim Uvin (Swisscom AG). 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/token/chaincode/mock"
+	"github.com/token/chaincode/testca"
+	"strings"
+	"testing"
+	"time"
+)
+
+const velocityToken = `{"name": "Velocity", "totalSupply": 1000, "roles": {
+	"risk": [{"ou": "risk"}]
+}}`
+
+var riskOfficer = rolesCA.MustIssue("risk", testca.Options{OUs: []string{"client", "risk"}})
+
+// alice holds 500 and is in the retail tier, sending up to 50 per transfer and 100 a day
+func velocityLedger(t *testing.T) *mock.FullMockStub {
+	stub := mock.NewFullMockStub("token", &TokenChaincode{})
+	issuer := roleActors["issuer"]
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	if res := stub.MockInit("init", util.ToChaincodeArgs("init", velocityToken)); res.Status != shim.OK {
+		t.Fatal("Init failed: " + res.Message)
+	}
+	stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"to": "alice", "value": 500}`))
+
+	stub.MockCreator(riskOfficer.MspID, riskOfficer.CertPEM)
+	for _, limits := range []string{`{"tier": "retail", "perTransfer": 50, "daily": 100}`, `{"user": "alice", "tier": "retail"}`} {
+		if res := stub.MockInvoke("2", util.ToChaincodeArgs("setLimits", limits)); res.Status != shim.OK {
+			t.Fatal("SetLimits failed: " + res.Message)
+		}
+	}
+	return stub
+}
+
+func limits(stub *mock.FullMockStub, cn string) VelocityStatus {
+	status := VelocityStatus{}
+	json.Unmarshal(stub.MockInvoke("limits", util.ToChaincodeArgs("limits", `{"user": "`+cn+`"}`)).Payload, &status)
+	return status
+}
+
+func spendingKeys(stub *mock.FullMockStub) int {
+	keys := 0
+	for key := range stub.State {
+		if strings.Contains(key, IndexSpending) {
+			keys++
+		}
+	}
+	return keys
+}
+
+func TestVelocityLimits(t *testing.T) {
+	stub := velocityLedger(t)
+	alice := recoveryActors["alice"]
+	start := time.Now()
+
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("1", util.ToChaincodeArgs("setLimits", `{"user": "alice"}`)); res.Status == shim.OK {
+		t.Error("Expected only risk officers to set limits")
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "bob", "value": 51}`, RestrictionTransferLimit)
+	for _, value := range []string{"50", "40"} {
+		if res := stub.MockInvoke("tx"+value, util.ToChaincodeArgs("transfer", `{"to": "bob", "value": `+value+`}`)); res.Status != shim.OK {
+			t.Fatal("Transfer failed: " + res.Message)
+		}
+	}
+	expectRestricted(t, stub, "transfer", `{"to": "bob", "value": 11}`, RestrictionDailyLimit)
+
+	status := limits(stub, "alice")
+	if status.Tier != "retail" || status.Spent != 90 || *status.RemainingDaily != 10 || *status.MaxTransfer != 10 {
+		t.Errorf("Unexpected limits: %+v", status)
+	}
+	if status := limits(stub, "bob"); status.Tier != TierDefault || status.RemainingDaily != nil || status.MaxTransfer != nil {
+		t.Errorf("Expected bob to have no limits, got %+v", status)
+	}
+
+	// the first transfer leaves the window 24 hours later, and is dropped by the next one
+	stub.MockTime(start.Add(velocityWindow + time.Minute))
+	if status := limits(stub, "alice"); status.Spent != 0 {
+		t.Errorf("Expected the transfers to leave the window, got %d", status.Spent)
+	}
+	if res := stub.MockInvoke("c", util.ToChaincodeArgs("transfer", `{"to": "bob", "value": 50}`)); res.Status != shim.OK {
+		t.Fatal("Transfer failed: " + res.Message)
+	}
+	if keys := spendingKeys(stub); keys != 1 {
+		t.Errorf("Expected the expired transfers to be dropped, %d left", keys)
+	}
+
+	// limits of the account override the ones of its tier
+	stub.MockCreator(riskOfficer.MspID, riskOfficer.CertPEM)
+	stub.MockInvoke("d", util.ToChaincodeArgs("setLimits", `{"user": "alice", "tier": "retail", "daily": 500}`))
+	if status := limits(stub, "alice"); status.PerTransfer != 50 || status.Daily != 500 || *status.MaxTransfer != 50 {
+		t.Errorf("Unexpected limits: %+v", status)
+	}
+}
+
+func TestVelocityTransferFrom(t *testing.T) {
+	stub := velocityLedger(t)
+	issuer, alice := roleActors["issuer"], recoveryActors["alice"]
+
+	stub.MockCreator(riskOfficer.MspID, riskOfficer.CertPEM)
+	stub.MockInvoke("1", util.ToChaincodeArgs("setLimits", `{"user": "issuer", "daily": 10}`))
+	stub.MockCreator(issuer.MspID, issuer.CertPEM)
+	stub.MockInvoke("2", util.ToChaincodeArgs("approve", `{"spender": "alice", "value": 100}`))
+
+	// spending from an allowance counts for the holder
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("3", util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "bob", "value": 8}`)); res.Status != shim.OK {
+		t.Fatal("TransferFrom failed: " + res.Message)
+	}
+	expectRestricted(t, stub, "transferFrom", `{"from": "issuer", "to": "bob", "value": 3}`, RestrictionDailyLimit)
+	if status := limits(stub, "issuer"); status.Spent != 8 || status.Tier != TierDefault {
+		t.Errorf("Unexpected limits: %+v", status)
+	}
+
+	// without amounts the limits of the account are removed
+	stub.MockCreator(riskOfficer.MspID, riskOfficer.CertPEM)
+	stub.MockInvoke("4", util.ToChaincodeArgs("setLimits", `{"user": "issuer"}`))
+	stub.MockCreator(alice.MspID, alice.CertPEM)
+	if res := stub.MockInvoke("5", util.ToChaincodeArgs("transferFrom", `{"from": "issuer", "to": "bob", "value": 3}`)); res.Status != shim.OK {
+		t.Error("TransferFrom failed: " + res.Message)
+	}
+}